@@ -4,82 +4,259 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
 )
 
+// Publish publishes body to topic and waits until the broker stored it.
 func Publish(conn net.Conn, body, topic string) error {
-	commandBody := entity.Message{
-		Headers: map[string]string{
-			"id": uuid.New().String(),
-		},
-		Body: body,
+	_, err := PublishMessage(conn, topic, entity.Message{Body: body})
+	return err
+}
+
+// PublishWithKey publishes body under key; compacted topics keep only the
+// latest message of each key.
+func PublishWithKey(conn net.Conn, key, body, topic string) error {
+	_, err := PublishMessage(conn, topic, entity.Message{Key: key, Body: body})
+	return err
+}
+
+// Delete publishes a tombstone for key, removing it from compacted topics.
+func Delete(conn net.Conn, key, topic string) error {
+	_, err := PublishMessage(conn, topic, entity.Message{Key: key, Tombstone: true})
+	return err
+}
+
+// responseTimeout bounds how long a request waits for the broker reply.
+const responseTimeout = 30 * time.Second
+
+// DefaultCredit is how many messages consumers are sent ahead of their
+// processing. A message is processed, and its offset stored, once it was
+// received from the channel of its consumer.
+const DefaultCredit = 100
+
+// DefaultPrefetch is how many messages queue consumers hold without acking
+// them.
+const DefaultPrefetch = 1
+
+// partitioner chooses the partition of published messages: the hash of their
+// key or round-robin for messages without key.
+var partitioner entity.DefaultPartitioner
+
+// Partitions returns how many partitions topic has.
+func Partitions(conn net.Conn, topic string) (int, error) {
+	response, err := request(conn, entity.Command{Type: entity.TypeMetadata, Topic: topic})
+	if err != nil {
+		return 0, fmt.Errorf("cannot read metadata of topic %s: %w", topic, err)
 	}
+	var metadata entity.TopicMetadata
+	if err = json.Unmarshal([]byte(response.Body), &metadata); err != nil {
+		return 0, err
+	}
+	return metadata.Partitions, nil
+}
 
-	bodyRaw, err := json.Marshal(commandBody)
+// PublishMessage publishes message to topic and waits for the broker to
+// acknowledge it. The broker chooses the partition, by the hash of the key
+// or round-robin. The response holds the partition, offset and timestamp the
+// message was stored at.
+func PublishMessage(conn net.Conn, topic string, message entity.Message) (entity.Response, error) {
+	message.Headers = withID(message.Headers)
+	bodyRaw, err := json.Marshal(message)
 	if err != nil {
-		return err
+		return entity.Response{}, err
 	}
-	cmd := entity.Command{
+	return request(conn, entity.Command{
 		Type:  entity.TypePublish,
 		Topic: topic,
 		Body:  string(bodyRaw),
+	})
+}
+
+// withID returns a copy of headers with an id header, a new one unless the
+// caller set it.
+func withID(headers map[string]string) map[string]string {
+	copied := make(map[string]string, len(headers)+1)
+	for key, value := range headers {
+		copied[key] = value
+	}
+	if copied["id"] == "" {
+		copied["id"] = uuid.New().String()
 	}
+	return copied
+}
 
+// correlationID numbers the requests sent by the package functions.
+var correlationID uint64
+
+func nextCorrelationID() uint64 {
+	return atomic.AddUint64(&correlationID, 1)
+}
+
+// readers are the buffered readers of the connections used by the package
+// functions, one per connection so a response read ahead is not lost. A
+// reader is dropped once reading its connection fails, e.g. once it closed.
+var (
+	readersMu sync.Mutex
+	readers   = make(map[net.Conn]*bufio.Reader)
+)
+
+func readerOf(conn net.Conn) *bufio.Reader {
+	readersMu.Lock()
+	defer readersMu.Unlock()
+	reader, ok := readers[conn]
+	if !ok {
+		reader = bufio.NewReader(conn)
+		readers[conn] = reader
+	}
+	return reader
+}
+
+// readLine reads the next line of conn, dropping its reader on failure.
+func readLine(conn net.Conn) ([]byte, error) {
+	line, _, err := readerOf(conn).ReadLine()
+	if err != nil {
+		readersMu.Lock()
+		delete(readers, conn)
+		readersMu.Unlock()
+	}
+	return line, err
+}
+
+// request sends cmd and waits for its response, returning the error the
+// broker replied with, if any.
+func request(conn net.Conn, cmd entity.Command) (entity.Response, error) {
+	cmd.CorrelationID = nextCorrelationID()
+	if err := send(conn, cmd); err != nil {
+		return entity.Response{}, err
+	}
+	return readResponse(conn, cmd.CorrelationID)
+}
+
+func send(conn net.Conn, cmd entity.Command) error {
 	raw, err := json.Marshal(cmd)
 	if err != nil {
 		return err
 	}
-
 	_, err = fmt.Fprintln(conn, string(raw))
-
 	return err
+}
 
+// readResponse reads the response to the request with correlation id,
+// skipping the responses to other requests.
+func readResponse(conn net.Conn, id uint64) (entity.Response, error) {
+	conn.SetReadDeadline(time.Now().Add(responseTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		reply, err := readLine(conn)
+		if err != nil {
+			return entity.Response{}, err
+		}
+		var response entity.Response
+		if err = json.Unmarshal(reply, &response); err != nil {
+			return entity.Response{}, err
+		}
+		if response.CorrelationID != id {
+			continue
+		}
+		return response, responseError(response)
+	}
 }
 
+// Consume joins the consumer group consumerName of topic. The partitions of
+// the topic are split among the members of the group with the range strategy.
+// An error replied by the broker is delivered as a last message whose Err is
+// the *Error, and the channel is closed.
 func Consume(conn net.Conn, topic, consumerName string) (chan entity.Message, error) {
-	cmd := entity.Command{
+	return consume(conn, entity.Command{
 		Type:         entity.TypeConsume,
 		Topic:        topic,
 		ConsumerName: consumerName,
-	}
+	})
+}
 
-	messages := make(chan entity.Message)
-	raw, err := json.Marshal(cmd)
+// ConsumeWithAssignment joins the consumer group consumerName of topic, which
+// splits the partitions among its members with strategy, entity.AssignRange
+// or entity.AssignRoundRobin.
+func ConsumeWithAssignment(conn net.Conn, topic, consumerName, strategy string) (chan entity.Message, error) {
+	return consume(conn, entity.Command{
+		Type:         entity.TypeConsume,
+		Topic:        topic,
+		ConsumerName: consumerName,
+		Assignment:   strategy,
+	})
+}
 
-	if err != nil {
+// ConsumeFrom consumes topic starting from the first message appended at or
+// after since, regardless of the offset stored for the consumer.
+func ConsumeFrom(conn net.Conn, topic, consumerName string, since time.Time) (chan entity.Message, error) {
+	return consume(conn, entity.Command{
+		Type:         entity.TypeConsume,
+		Topic:        topic,
+		ConsumerName: consumerName,
+		Timestamp:    since.UnixMilli(),
+	})
+}
+
+func consume(conn net.Conn, cmd entity.Command) (chan entity.Message, error) {
+	messages := make(chan entity.Message)
+	cmd.CorrelationID = nextCorrelationID()
+	cmd.Credit = DefaultCredit
+	if err := send(conn, cmd); err != nil {
 		return messages, err
 	}
 
-	if _, err = fmt.Fprintln(conn, string(raw)); err != nil {
+	// the broker acknowledges the command before sending messages
+	if _, err := readResponse(conn, cmd.CorrelationID); err != nil {
 		return messages, err
 	}
 
-	reader := bufio.NewReader(conn)
 	go func() {
 		defer close(messages)
 		for {
-			reply, _, err := reader.ReadLine()
-			if err == io.EOF {
-				return
-			}
+			reply, err := readLine(conn)
 			if err != nil {
-				fmt.Println(err)
 				return
 			}
 			var response entity.Response
 			if err := json.Unmarshal(reply, &response); err != nil {
 				continue
 			}
-			var message entity.Message
-			if err := json.Unmarshal([]byte(response.Body), &message); err != nil {
+			if response.CorrelationID != cmd.CorrelationID {
 				continue
 			}
+			message, err := toMessage(response)
+			if err != nil {
+				messages <- entity.Message{Err: err}
+				return
+			}
 			messages <- message
+			credit := entity.Command{Type: entity.TypeCredit, CorrelationID: cmd.CorrelationID, Credit: 1}
+			if err = send(conn, credit); err != nil {
+				return
+			}
 		}
 	}()
 	return messages, nil
 }
+
+// toMessage returns the message consumed in response.
+func toMessage(response entity.Response) (entity.Message, error) {
+	if err := responseError(response); err != nil {
+		return entity.Message{}, err
+	}
+	var message entity.Message
+	if response.Message != nil {
+		message = *response.Message
+	} else if err := json.Unmarshal([]byte(response.Body), &message); err != nil {
+		return entity.Message{}, err
+	}
+	message.Partition = response.Partition
+	message.Offset = response.Offset
+	return message, nil
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// Error is an error replied by the broker. Callers branch on its code with
+// errors.Is and the errors below, e.g. errors.Is(err, client.ErrUnknownTopic).
+type Error struct {
+	Code    entity.ErrorCode
+	Message string
+}
+
+// Errors replied by the broker, matched by code.
+var (
+	ErrUnknownServerError        = &Error{Code: entity.ErrCodeUnknown, Message: "unknown server error"}
+	ErrInvalidRequest            = &Error{Code: entity.ErrCodeInvalidRequest, Message: "invalid request"}
+	ErrUnsupportedVersion        = &Error{Code: entity.ErrCodeUnsupportedVersion, Message: "unsupported version"}
+	ErrInvalidTopic              = &Error{Code: entity.ErrCodeInvalidTopic, Message: "invalid topic"}
+	ErrUnknownTopic              = &Error{Code: entity.ErrCodeUnknownTopic, Message: "unknown topic or partition"}
+	ErrOffsetOutOfRange          = &Error{Code: entity.ErrCodeOffsetOutOfRange, Message: "offset out of range"}
+	ErrCorruptMessage            = &Error{Code: entity.ErrCodeCorruptMessage, Message: "corrupt message"}
+	ErrMessageTooLarge           = &Error{Code: entity.ErrCodeMessageTooLarge, Message: "message too large"}
+	ErrInvalidRecord             = &Error{Code: entity.ErrCodeInvalidRecord, Message: "invalid record"}
+	ErrStorage                   = &Error{Code: entity.ErrCodeStorage, Message: "storage error"}
+	ErrInconsistentGroupProtocol = &Error{Code: entity.ErrCodeInconsistentGroupProtocol, Message: "inconsistent group protocol"}
+	ErrNotAssigned               = &Error{Code: entity.ErrCodeNotAssigned, Message: "partition not assigned"}
+	ErrNotLeader                 = &Error{Code: entity.ErrCodeNotLeader, Message: "not leader"}
+	ErrAuthorizationFailed       = &Error{Code: entity.ErrCodeAuthorizationFailed, Message: "authorization failed"}
+)
+
+func (e *Error) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+// Is reports whether target is an Error with the same code.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// responseError returns the error replied in a response, or nil.
+func responseError(response entity.Response) error {
+	if response.Error == nil {
+		return nil
+	}
+	code := response.Error.Code
+	if code == "" {
+		code = entity.ErrCodeUnknown
+	}
+	return &Error{Code: code, Message: response.Error.Message}
+}
+
+// codedError returns err as an Error when it carries a code.
+func codedError(err error) error {
+	var codeErr *entity.Error
+	if errors.As(err, &codeErr) {
+		return &Error{Code: codeErr.Code, Message: codeErr.Error()}
+	}
+	return err
+}
@@ -0,0 +1,548 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+	"github.com/rafaelmgr12/kafka-clone/internal/protocol"
+)
+
+// ErrClientClosed is returned by the requests of a closed Client.
+var ErrClientClosed = errors.New("client is closed")
+
+// Client publishes and consumes over a single connection speaking the binary
+// protocol, so message keys and values may hold any bytes. Requests may be
+// sent concurrently: every response is matched to its request by correlation
+// id, and consumed messages are delivered to the channel of their consume
+// call. Messages must be received promptly, as a full channel holds up the
+// other responses of the connection.
+type Client struct {
+	conn  net.Conn
+	codec protocol.Codec
+
+	mu            sync.Mutex
+	nextID        uint64
+	pending       map[uint64]chan entity.Response
+	subscriptions map[uint64]*subscription
+	partitions    map[string]int
+	err           error
+	done          chan struct{}
+
+	// handshake asks the broker for its versions before the first request.
+	handshake      sync.Once
+	handshakeErr   error
+	brokerVersions []entity.ApiVersion
+}
+
+// subscription delivers the messages consumed by a consume command. Only
+// readResponses closes its channel.
+type subscription struct {
+	messages chan entity.Message
+	// queue marks the subscriptions of queues, whose messages are acked
+	// instead of giving their credit back.
+	queue bool
+	// forgotten is closed once the consume command failed, so its messages
+	// are no longer delivered.
+	forgotten chan struct{}
+}
+
+// ConsumeOptions tune how a Client joins a consumer group.
+type ConsumeOptions struct {
+	// Since starts from the first message appended at or after it instead
+	// of the stored offsets.
+	Since time.Time
+	// Assignment is the partition assignment strategy of the group,
+	// entity.AssignRange by default.
+	Assignment string
+	// OffsetReset is the policy applied when the stored offset was removed
+	// from the topic, entity.OffsetResetEarliest by default.
+	OffsetReset string
+	// Credit is how many messages are sent ahead of their processing,
+	// DefaultCredit by default.
+	Credit int
+	// ManualCommit leaves committing offsets to Commit and CommitAsync, so
+	// messages are only skipped after a rebalance or a restart once the
+	// caller committed them.
+	ManualCommit bool
+	// AutoCommitInterval commits the offsets of the processed messages at
+	// this interval instead; a message is processed once the next message
+	// was received from the channel.
+	AutoCommitInterval time.Duration
+}
+
+// QueueOptions tune how a Client consumes a queue.
+type QueueOptions struct {
+	// Prefetch is how many messages are delivered without being acked,
+	// DefaultPrefetch by default.
+	Prefetch int
+	// VisibilityTimeout is how long a message may go without being acked
+	// before it is delivered again, entity.DefaultVisibilityTimeout by
+	// default.
+	VisibilityTimeout time.Duration
+	// MaxAttempts is how many times a message is delivered before it is
+	// moved to the dead-letter topic, entity.DefaultMaxAttempts by default.
+	MaxAttempts int
+	// RetryBackoff is how long a nacked message waits before it is
+	// delivered again, doubling with every attempt,
+	// entity.DefaultRetryBackoff by default.
+	RetryBackoff time.Duration
+}
+
+// FetchOptions limit what a fetch returns.
+type FetchOptions struct {
+	// MaxMessages and MaxBytes limit the messages returned, 100 messages
+	// and 1 MiB by default; the first message is returned whatever its size.
+	MaxMessages int
+	MaxBytes    int
+	// MaxWait is how long the broker waits for a message when there is
+	// none past the offset yet; zero returns right away.
+	MaxWait time.Duration
+}
+
+// NewClient starts reading the responses of conn, which is closed by Close.
+func NewClient(conn net.Conn) *Client {
+	c := &Client{
+		conn:          conn,
+		codec:         protocol.Binary(conn),
+		pending:       make(map[uint64]chan entity.Response),
+		subscriptions: make(map[uint64]*subscription),
+		partitions:    make(map[string]int),
+		done:          make(chan struct{}),
+	}
+	go c.readResponses()
+	return c
+}
+
+// Partitions returns how many partitions topic has. The count is cached, as
+// partitions are never removed from a topic.
+func (c *Client) Partitions(topic string) (int, error) {
+	c.mu.Lock()
+	n, ok := c.partitions[topic]
+	c.mu.Unlock()
+	if ok {
+		return n, nil
+	}
+
+	response, err := c.request(entity.Command{Type: entity.TypeMetadata, Topic: topic}, nil)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read metadata of topic %s: %w", topic, err)
+	}
+	var metadata entity.TopicMetadata
+	if err = json.Unmarshal([]byte(response.Body), &metadata); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	c.partitions[topic] = metadata.Partitions
+	c.mu.Unlock()
+	return metadata.Partitions, nil
+}
+
+// Publish publishes message to topic and waits for the broker to acknowledge
+// it.
+func (c *Client) Publish(topic string, message entity.Message) (entity.Response, error) {
+	partitions, err := c.Partitions(topic)
+	if err != nil {
+		return entity.Response{}, err
+	}
+	partition := partitioner.Partition(message.Key, partitions)
+	message.Headers = withID(message.Headers)
+	return c.request(entity.Command{
+		Type:      entity.TypePublish,
+		Topic:     topic,
+		Partition: &partition,
+		Message:   &message,
+	}, nil)
+}
+
+// Consume joins the consumer group of topic and returns the channel its
+// messages are delivered to, which is closed with the client, or once the
+// broker stopped consuming after a last message whose Err is the *Error it
+// replied.
+func (c *Client) Consume(topic, group string, options ConsumeOptions) (chan entity.Message, error) {
+	cmd := entity.Command{
+		Type:         entity.TypeConsume,
+		Topic:        topic,
+		ConsumerName: group,
+		Assignment:   options.Assignment,
+		OffsetReset:  options.OffsetReset,
+		Credit:       options.Credit,
+		ManualCommit: options.ManualCommit || options.AutoCommitInterval > 0,
+	}
+	if cmd.Credit <= 0 {
+		cmd.Credit = DefaultCredit
+	}
+	if !options.Since.IsZero() {
+		cmd.Timestamp = options.Since.UnixMilli()
+	}
+	messages := make(chan entity.Message)
+	if _, err := c.request(cmd, messages); err != nil {
+		return nil, err
+	}
+	if options.AutoCommitInterval > 0 {
+		processed := make(chan entity.Message)
+		go c.autoCommit(topic, group, options.AutoCommitInterval, messages, processed)
+		return processed, nil
+	}
+	return messages, nil
+}
+
+// Queue joins the queue group of topic, competing with its other members
+// for messages: every message is delivered to a single member, which acks it
+// with Ack once processed. Messages not acked within the visibility timeout
+// are delivered again, to another member when there is one.
+func (c *Client) Queue(topic, group string, options QueueOptions) (chan entity.Message, error) {
+	// brokers without acks would consume as a consumer group
+	if err := c.negotiate(&entity.Command{Type: entity.TypeAck}); err != nil {
+		return nil, err
+	}
+	cmd := entity.Command{
+		Type:              entity.TypeConsume,
+		Topic:             topic,
+		ConsumerName:      group,
+		Credit:            options.Prefetch,
+		Queue:             true,
+		VisibilityTimeout: options.VisibilityTimeout.Milliseconds(),
+		MaxAttempts:       options.MaxAttempts,
+		RetryBackoff:      options.RetryBackoff.Milliseconds(),
+	}
+	if cmd.Credit <= 0 {
+		cmd.Credit = DefaultPrefetch
+	}
+	messages := make(chan entity.Message)
+	if _, err := c.request(cmd, messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// Ack acks a message received from the queue group of topic, so it is not
+// delivered again. It fails with ErrNotAssigned once the visibility timeout
+// of the message expired.
+func (c *Client) Ack(topic, group string, message entity.Message) error {
+	_, err := c.request(entity.Command{
+		Type:         entity.TypeAck,
+		Topic:        topic,
+		ConsumerName: group,
+		Partition:    &message.Partition,
+		Offset:       message.Offset,
+	}, nil)
+	return err
+}
+
+// Nack tells the queue group of topic a message received from it could not be
+// processed for reason. The message is delivered again after the retry
+// backoff, or moved to the dead-letter topic once delivered its maximum
+// attempts. It fails with ErrNotAssigned once the visibility timeout of the
+// message expired.
+func (c *Client) Nack(topic, group string, message entity.Message, reason string) error {
+	_, err := c.request(entity.Command{
+		Type:         entity.TypeNack,
+		Topic:        topic,
+		ConsumerName: group,
+		Partition:    &message.Partition,
+		Offset:       message.Offset,
+		Reason:       reason,
+	}, nil)
+	return err
+}
+
+// Commit stores offset, the offset of the next message to consume, for a
+// partition of topic the group assigned to the client, and waits for the
+// broker to acknowledge it. It fails with ErrNotAssigned once the partition
+// was assigned to another member.
+func (c *Client) Commit(topic, group string, partition int, offset uint) error {
+	_, err := c.request(commitCommand(topic, group, partition, offset), nil)
+	return err
+}
+
+// CommitAsync commits like Commit without waiting for the broker, returning
+// the channel its result is sent to. Commits are sent in the order of the
+// calls, so a later commit is never overwritten by an earlier one.
+func (c *Client) CommitAsync(topic, group string, partition int, offset uint) <-chan error {
+	result := make(chan error, 1)
+	cmd := commitCommand(topic, group, partition, offset)
+	err := c.negotiate(&cmd)
+	var id uint64
+	var responses chan entity.Response
+	if err == nil {
+		id, responses, err = c.send(cmd, nil)
+	}
+	if err != nil {
+		result <- err
+		return result
+	}
+	go func() {
+		_, err := c.wait(id, responses)
+		result <- err
+	}()
+	return result
+}
+
+func commitCommand(topic, group string, partition int, offset uint) entity.Command {
+	return entity.Command{
+		Type:         entity.TypeCommit,
+		Topic:        topic,
+		ConsumerName: group,
+		Partition:    &partition,
+		Offset:       offset,
+	}
+}
+
+// autoCommit delivers messages to processed and commits, every interval, the
+// offsets of the messages processed since the last commit. A message is
+// processed once the caller received the next one, as it then handled it.
+func (c *Client) autoCommit(topic, group string, interval time.Duration, messages, processed chan entity.Message) {
+	defer close(processed)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	offsets := make(map[int]uint)
+	commit := func() {
+		for partition, offset := range offsets {
+			result := c.CommitAsync(topic, group, partition, offset)
+			go func() {
+				if err := <-result; err != nil {
+					fmt.Println(err)
+				}
+			}()
+			delete(offsets, partition)
+		}
+	}
+	var last *entity.Message
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+		DELIVER:
+			for {
+				select {
+				case processed <- message:
+					break DELIVER
+				case <-ticker.C:
+					commit()
+				}
+			}
+			if last != nil {
+				offsets[last.Partition] = last.Offset + 1
+			}
+			last = &message
+		case <-ticker.C:
+			commit()
+		}
+	}
+}
+
+// Fetch returns the messages of a topic partition from offset, letting the
+// caller consume at its own pace instead of joining a consumer group.
+func (c *Client) Fetch(topic string, partition int, offset uint, options FetchOptions) (entity.Fetched, error) {
+	response, err := c.request(entity.Command{
+		Type:        entity.TypeFetch,
+		Topic:       topic,
+		Partition:   &partition,
+		Offset:      offset,
+		MaxMessages: options.MaxMessages,
+		MaxBytes:    options.MaxBytes,
+		MaxWait:     options.MaxWait.Milliseconds(),
+	}, nil)
+	if err != nil {
+		return entity.Fetched{}, err
+	}
+	var fetched entity.Fetched
+	if err = json.Unmarshal([]byte(response.Body), &fetched); err != nil {
+		return entity.Fetched{}, err
+	}
+	return fetched, nil
+}
+
+// ApiVersions returns the versions of every command type the broker
+// supports.
+func (c *Client) ApiVersions() ([]entity.ApiVersion, error) {
+	response, err := c.roundTrip(entity.Command{Type: entity.TypeApiVersions}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var versions entity.ApiVersions
+	if err = json.Unmarshal([]byte(response.Body), &versions); err != nil {
+		return nil, err
+	}
+	return versions.Versions, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// request sends cmd with the highest version of its type supported by both the
+// client and the broker, failing with ErrUnsupportedVersion when there is
+// none.
+func (c *Client) request(cmd entity.Command, messages chan entity.Message) (entity.Response, error) {
+	if err := c.negotiate(&cmd); err != nil {
+		return entity.Response{}, err
+	}
+	return c.roundTrip(cmd, messages)
+}
+
+// negotiate sets the version of cmd, asking the broker for its versions on
+// the first request.
+func (c *Client) negotiate(cmd *entity.Command) error {
+	c.handshake.Do(func() {
+		if c.brokerVersions, c.handshakeErr = c.ApiVersions(); c.handshakeErr != nil {
+			c.handshakeErr = fmt.Errorf("cannot negotiate versions: %w", c.handshakeErr)
+		}
+	})
+	if c.handshakeErr != nil {
+		return c.handshakeErr
+	}
+	version, err := protocol.Negotiate(protocol.Versions, c.brokerVersions, cmd.Type)
+	if err != nil {
+		return codedError(err)
+	}
+	cmd.Version = version
+	return nil
+}
+
+// roundTrip sends cmd with a new correlation id and waits for its response.
+// The messages consumed by a consume command are delivered to messages.
+func (c *Client) roundTrip(cmd entity.Command, messages chan entity.Message) (entity.Response, error) {
+	id, responses, err := c.send(cmd, messages)
+	if err != nil {
+		return entity.Response{}, err
+	}
+	return c.wait(id, responses)
+}
+
+// send sends cmd with a new correlation id, returning the id and the channel
+// its response is delivered to.
+func (c *Client) send(cmd entity.Command, messages chan entity.Message) (uint64, chan entity.Response, error) {
+	responses := make(chan entity.Response, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return 0, nil, c.err
+	}
+	c.nextID++
+	cmd.CorrelationID = c.nextID
+	c.pending[cmd.CorrelationID] = responses
+	if messages != nil {
+		c.subscriptions[cmd.CorrelationID] = &subscription{
+			messages:  messages,
+			queue:     cmd.Queue,
+			forgotten: make(chan struct{}),
+		}
+	}
+	c.mu.Unlock()
+
+	if err := c.codec.WriteCommand(cmd); err != nil {
+		c.forget(cmd.CorrelationID)
+		return 0, nil, err
+	}
+	return cmd.CorrelationID, responses, nil
+}
+
+// wait waits for the response of the request with correlation id id.
+func (c *Client) wait(id uint64, responses chan entity.Response) (entity.Response, error) {
+	timer := time.NewTimer(responseTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case response := <-responses:
+		if err = responseError(response); err == nil {
+			return response, nil
+		}
+	case <-c.done:
+		err = c.err
+	case <-timer.C:
+		err = fmt.Errorf("no response to request %d", id)
+	}
+	c.forget(id)
+	return entity.Response{}, err
+}
+
+// forget drops a failed request. The channel of its subscription is left to
+// readResponses, which may be delivering to it.
+func (c *Client) forget(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+	if sub, ok := c.subscriptions[id]; ok {
+		delete(c.subscriptions, id)
+		close(sub.forgotten)
+	}
+}
+
+// grant gives back the credit of a message received from the subscription of
+// the consume command with correlationID.
+func (c *Client) grant(correlationID uint64) {
+	version, err := protocol.Negotiate(protocol.Versions, c.brokerVersions, entity.TypeCredit)
+	if err != nil {
+		// brokers without credit send messages without limit
+		return
+	}
+	credit := entity.Command{Type: entity.TypeCredit, Version: version, CorrelationID: correlationID, Credit: 1}
+	if err = c.codec.WriteCommand(credit); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// readResponses delivers every response to its request or consume channel
+// until the connection is closed.
+func (c *Client) readResponses() {
+	var err error
+	for {
+		var response entity.Response
+		if response, err = c.codec.ReadResponse(); err != nil {
+			break
+		}
+
+		c.mu.Lock()
+		if responses, ok := c.pending[response.CorrelationID]; ok {
+			delete(c.pending, response.CorrelationID)
+			c.mu.Unlock()
+			responses <- response
+			continue
+		}
+		sub, ok := c.subscriptions[response.CorrelationID]
+		c.mu.Unlock()
+		if !ok {
+			continue
+		}
+		message, e := toMessage(response)
+		if e != nil {
+			// the broker stopped consuming: the error is the last message
+			c.mu.Lock()
+			delete(c.subscriptions, response.CorrelationID)
+			c.mu.Unlock()
+			message = entity.Message{Err: e}
+		}
+		select {
+		case sub.messages <- message:
+		case <-sub.forgotten:
+			close(sub.messages)
+			continue
+		}
+		if e != nil {
+			close(sub.messages)
+			continue
+		}
+		if !sub.queue {
+			c.grant(response.CorrelationID)
+		}
+	}
+
+	c.mu.Lock()
+	c.err = fmt.Errorf("%w: %s", ErrClientClosed, err)
+	for id, sub := range c.subscriptions {
+		close(sub.messages)
+		delete(c.subscriptions, id)
+	}
+	close(c.done)
+	c.mu.Unlock()
+}
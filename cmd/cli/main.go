@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"time"
 
 	"github.com/rafaelmgr12/kafka-clone/client"
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
 )
 
 func main() {
@@ -26,9 +28,12 @@ func main() {
 	topic := flag.String("t", "", "topic to consume")
 	consumerName := flag.String("n", "", "consumer name")
 	message := flag.String("m", "", "message to publish")
+	key := flag.String("k", "", "key of the message to publish")
+	assignment := flag.String("a", "", "partition assignment strategy of the consumer group: range or roundrobin")
+	since := flag.Duration("s", 0, "consume messages published in the last duration, e.g. 1h")
 	flag.Parse()
 
-	handleFlags(*flagConsumer, *flagPublisher, *topic, *consumerName, *message, conn)
+	handleFlags(*flagConsumer, *flagPublisher, *topic, *consumerName, *message, *key, *assignment, *since, conn)
 }
 
 func getEnv(key, defaultValue string) string {
@@ -39,7 +44,7 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
-func handleFlags(isConsumer, isPublisher bool, topic, consumerName, message string, conn net.Conn) {
+func handleFlags(isConsumer, isPublisher bool, topic, consumerName, message, key, assignment string, since time.Duration, conn net.Conn) {
 	if !isConsumer && !isPublisher {
 		println("Must specify either consumer or publisher flag")
 		os.Exit(3)
@@ -56,38 +61,50 @@ func handleFlags(isConsumer, isPublisher bool, topic, consumerName, message stri
 	}
 
 	if isConsumer {
-		handleConsumer(consumerName, topic, conn)
+		handleConsumer(consumerName, topic, assignment, since, conn)
 	} else if isPublisher {
-		handlePublisher(message, topic, conn)
+		handlePublisher(message, key, topic, conn)
 	}
 }
 
-func handleConsumer(consumerName, topic string, conn net.Conn) {
+func handleConsumer(consumerName, topic, assignment string, since time.Duration, conn net.Conn) {
 	if consumerName == "" {
 		println("Must specify the consumer name to publish")
 		os.Exit(6)
 	}
 
-	messages, err := client.Consume(conn, topic, consumerName)
+	var messages chan entity.Message
+	var err error
+	if since > 0 {
+		messages, err = client.ConsumeFrom(conn, topic, consumerName, time.Now().Add(-since))
+	} else {
+		messages, err = client.ConsumeWithAssignment(conn, topic, consumerName, assignment)
+	}
 	if err != nil {
 		println(err)
 		os.Exit(7)
 	}
 
 	for m := range messages {
+		if m.Err != nil {
+			println(m.Err.Error())
+			os.Exit(10)
+		}
 		b, _ := json.Marshal(m)
 		println(string(b))
 	}
 }
 
-func handlePublisher(message, topic string, conn net.Conn) {
+func handlePublisher(message, key, topic string, conn net.Conn) {
 	if message == "" {
 		println("Must specify the message to publish")
 		os.Exit(8)
 	}
 
-	if err := client.Publish(conn, message, topic); err != nil {
-		println(err)
+	response, err := client.PublishMessage(conn, topic, entity.Message{Key: key, Body: message})
+	if err != nil {
+		println(err.Error())
 		os.Exit(9)
 	}
+	fmt.Printf("published to %s partition %d at offset %d\n", response.Topic, response.Partition, response.Offset)
 }
@@ -6,9 +6,12 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/rafaelmgr12/kafka-clone/internal/infra"
+	"github.com/rafaelmgr12/kafka-clone/internal/storage"
 )
 
 func main() {
@@ -53,9 +56,161 @@ func main() {
 		panic(err)
 	}
 
+	segmentBytes, err := strconv.ParseInt(getEnv("K_SEGMENT_BYTES", "1073741824"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	segmentMs, err := strconv.ParseInt(getEnv("K_SEGMENT_MS", "604800000"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	fsync, err := storage.ParseSyncPolicy(getEnv("K_FSYNC", "never"))
+	if err != nil {
+		panic(err)
+	}
+
+	retentionMs, err := strconv.ParseInt(getEnv("K_RETENTION_MS", "-1"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	retentionBytes, err := strconv.ParseInt(getEnv("K_RETENTION_BYTES", "-1"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	retentionCheckMs, err := strconv.ParseInt(getEnv("K_RETENTION_CHECK_MS", "300000"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	deleteRetentionMs, err := strconv.ParseInt(getEnv("K_DELETE_RETENTION_MS", "86400000"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	partitions, err := strconv.Atoi(getEnv("K_PARTITIONS", "1"))
+	if err != nil {
+		panic(err)
+	}
+
+	topics, err := parseTopicConfig(os.Getenv("K_TOPIC_CONFIG"))
+	if err != nil {
+		panic(err)
+	}
+
 	conf := infra.Config{
-		Path:    path,
-		Workers: uint(workers),
+		Path:                   path,
+		Workers:                uint(workers),
+		SegmentBytes:           segmentBytes,
+		SegmentAge:             time.Duration(segmentMs) * time.Millisecond,
+		Sync:                   fsync,
+		RetentionAge:           time.Duration(retentionMs) * time.Millisecond,
+		RetentionBytes:         retentionBytes,
+		RetentionCheckInterval: time.Duration(retentionCheckMs) * time.Millisecond,
+		DeleteRetention:        time.Duration(deleteRetentionMs) * time.Millisecond,
+		Partitions:             partitions,
+		Topics:                 topics,
+	}
+	if kafkaPort := os.Getenv("K_KAFKA_PORT"); kafkaPort != "" {
+		kafkaAddr, err := net.ResolveTCPAddr("tcp", "localhost:"+kafkaPort)
+		if err != nil {
+			panic(err)
+		}
+		kafkaListen, err := net.ListenTCP("tcp", kafkaAddr)
+		if err != nil {
+			panic(err)
+		}
+		defer kafkaListen.Close()
+		fmt.Printf("listening for kafka clients on port %s...\n", kafkaPort)
+		conf.Kafka = kafkaListen
+		conf.KafkaHost = getEnv("K_KAFKA_HOST", "localhost")
+	}
+	if httpPort := os.Getenv("K_HTTP_PORT"); httpPort != "" {
+		httpAddr, err := net.ResolveTCPAddr("tcp", "localhost:"+httpPort)
+		if err != nil {
+			panic(err)
+		}
+		httpListen, err := net.ListenTCP("tcp", httpAddr)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("listening for http requests on port %s...\n", httpPort)
+		conf.HTTP = httpListen
 	}
 	infra.Start(conf, listen, done)
 }
+
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// parseTopicConfig parses per topic overrides written as a comma separated
+// list of <topic>:<key>=<value>, e.g. "orders:fsync=always,logs:fsync=never".
+func parseTopicConfig(value string) (map[string]infra.TopicConfig, error) {
+	topics := make(map[string]infra.TopicConfig)
+	if value == "" {
+		return topics, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		topic, setting, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid topic config: %q", entry)
+		}
+		key, val, ok := strings.Cut(setting, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid topic config: %q", entry)
+		}
+
+		conf := topics[topic]
+		switch key {
+		case "fsync":
+			fsync, err := storage.ParseSyncPolicy(val)
+			if err != nil {
+				return nil, err
+			}
+			conf.Sync = &fsync
+		case "retention.ms":
+			ms, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid retention.ms: %w", err)
+			}
+			age := time.Duration(ms) * time.Millisecond
+			conf.RetentionAge = &age
+		case "retention.bytes":
+			bytes, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid retention.bytes: %w", err)
+			}
+			conf.RetentionBytes = &bytes
+		case "cleanup.policy":
+			if val != infra.CleanupDelete && val != infra.CleanupCompact {
+				return nil, fmt.Errorf("invalid cleanup.policy: %q", val)
+			}
+			conf.CleanupPolicy = val
+		case "delete.retention.ms":
+			ms, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid delete.retention.ms: %w", err)
+			}
+			age := time.Duration(ms) * time.Millisecond
+			conf.DeleteRetention = &age
+		case "partitions":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid partitions: %q", val)
+			}
+			conf.Partitions = &n
+		default:
+			return nil, fmt.Errorf("unknown topic config %q", key)
+		}
+		topics[topic] = conf
+	}
+	return topics, nil
+}
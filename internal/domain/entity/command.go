@@ -8,6 +8,13 @@ const (
 	TypePublish = iota
 	TypeConsume
 	TypeClose
+	TypeMetadata
+	TypeApiVersions
+	TypeFetch
+	TypeCredit
+	TypeCommit
+	TypeAck
+	TypeNack
 )
 
 type Command struct {
@@ -15,11 +22,123 @@ type Command struct {
 	Topic        string `json:"topic"`
 	Body         string `json:"body"`
 	ConsumerName string `json:"consumer_name"`
-	Offset       uint   `json:"offset"`
-	Connection   net.Conn
+	// Offset is the offset a fetch command reads from, the one a commit
+	// command stores, the offset of the next message the group consumes,
+	// or the offset of the message an ack or nack command acknowledges.
+	Offset uint `json:"offset"`
+	// Partition is the partition a publish command appends to; when it is
+	// nil the server chooses it with the default partitioner.
+	Partition *int `json:"partition,omitempty"`
+	// Timestamp makes a consume command start from the first message
+	// appended at or after it, in unix milliseconds.
+	Timestamp int64 `json:"timestamp,omitempty"`
+	// OffsetReset is the policy of a consume command when its offset was
+	// removed from the topic: earliest, latest or error.
+	OffsetReset string `json:"offset_reset,omitempty"`
+	// Assignment is the strategy a consume command asks its group to assign
+	// partitions with: range or roundrobin.
+	Assignment string `json:"assignment,omitempty"`
+	// CorrelationID is copied to the responses of the command, so a
+	// connection can carry many requests at once.
+	CorrelationID uint64 `json:"correlation_id,omitempty"`
+	Connection    net.Conn
+	// Message is the message of a publish command decoded by the binary
+	// protocol, which does not encode it in Body.
+	Message *Message `json:"-"`
+	// Writer writes the responses of the command in the protocol of its
+	// connection.
+	Writer ResponseWriter `json:"-"`
+	// Version is the version of the command type the command is encoded
+	// with, negotiated with an api versions command.
+	Version int16 `json:"version,omitempty"`
+	// MaxMessages and MaxBytes limit the messages returned by a fetch
+	// command, which waits up to MaxWait milliseconds for the first one.
+	MaxMessages int   `json:"max_messages,omitempty"`
+	MaxBytes    int   `json:"max_bytes,omitempty"`
+	MaxWait     int64 `json:"max_wait,omitempty"`
+	// Credit is how many messages a consume command may be sent ahead of
+	// their processing, or hold without acking them in a queue, zero for
+	// no limit, or how many more a credit command grants. Credit commands
+	// carry the correlation id of their consume command and get no
+	// response.
+	Credit int `json:"credit,omitempty"`
+	// ManualCommit makes a consume command store offsets only when commit
+	// commands commit them, instead of as its messages are sent or their
+	// credit comes back.
+	ManualCommit bool `json:"manual_commit,omitempty"`
+	// Queue makes a consume command join its group as a queue instead:
+	// every message is delivered to a single member, which acks it with an
+	// ack command within VisibilityTimeout milliseconds, 30s by default, or
+	// the message is delivered again.
+	Queue             bool  `json:"queue,omitempty"`
+	VisibilityTimeout int64 `json:"visibility_timeout,omitempty"`
+	// MaxAttempts is how many times a queue delivers a message to a member
+	// before moving it to the dead-letter topic, 5 by default, and
+	// RetryBackoff how many milliseconds a message nacked by the member
+	// waits before it is delivered again, 1s by default, doubling with
+	// every attempt.
+	MaxAttempts  int   `json:"max_attempts,omitempty"`
+	RetryBackoff int64 `json:"retry_backoff,omitempty"`
+	// Reason is why a nack command could not process its message, kept in
+	// the headers of the message once moved to the dead-letter topic.
+	Reason string `json:"reason,omitempty"`
 }
 
+// ResponseWriter writes responses to a connection in the protocol it speaks.
+// It may be called concurrently.
+type ResponseWriter interface {
+	WriteResponse(response Response) error
+}
+
+// Response is sent in reply to every command but close, and for every
+// message consumed.
 type Response struct {
-	Offset uint   `json:"offset"`
-	Body   string `json:"body"`
+	Topic     string `json:"topic,omitempty"`
+	Partition int    `json:"partition"`
+	Offset    uint   `json:"offset"`
+	// Timestamp is the time the message was appended, in unix milliseconds.
+	Timestamp int64  `json:"timestamp"`
+	Body      string `json:"body"`
+	// Error is set when the command could not be handled.
+	Error *ResponseError `json:"error,omitempty"`
+	// CorrelationID is the one of the command replied to, or of the consume
+	// command for consumed messages.
+	CorrelationID uint64 `json:"correlation_id,omitempty"`
+	// Message is the message consumed, encoded in Body by the JSON protocol.
+	Message *Message `json:"-"`
+}
+
+type ResponseError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e *ResponseError) Error() string {
+	return e.Message
+}
+
+// TopicMetadata is the body of the response to a metadata command.
+type TopicMetadata struct {
+	Topic      string `json:"topic"`
+	Partitions int    `json:"partitions"`
+}
+
+// ApiVersion is the range of versions of a command type a peer supports.
+type ApiVersion struct {
+	Type       int   `json:"type"`
+	MinVersion int16 `json:"min_version"`
+	MaxVersion int16 `json:"max_version"`
+}
+
+// ApiVersions is the body of the response to an api versions command.
+type ApiVersions struct {
+	Versions []ApiVersion `json:"api_versions"`
+}
+
+// Fetched is the body of the response to a fetch command.
+type Fetched struct {
+	Messages []Message `json:"messages"`
+	// HighWatermark is the offset the next message appended to the
+	// partition gets, so consumers can tell how far behind they are.
+	HighWatermark uint `json:"high_watermark"`
 }
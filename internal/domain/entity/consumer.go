@@ -1,144 +1,285 @@
 package entity
 
 import (
-	"bufio"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"os"
-	"time"
+	"sync"
+)
+
+// Policies applied when a consumer offset is no longer stored in the topic
+// log, e.g. because it was removed by retention.
+const (
+	OffsetResetEarliest = "earliest"
+	OffsetResetLatest   = "latest"
+	OffsetResetError    = "error"
 )
 
 type Consumer struct {
-	ID        string
-	TopicFile *os.File
-	Reader    *bufio.Reader
-	Topic     string
+	ID     string
+	Log    Log
+	Reader LogReader
+	Topic  string
+	// Partition is the partition of the topic read by the consumer, which
+	// keeps one offset per partition.
+	Partition int
 	Conn      io.ReadWriteCloser
+	// OffsetReset is the policy applied when the consumer offset is out of
+	// range, defaults to OffsetResetEarliest.
+	OffsetReset string
+	// CorrelationID is the one of the consume command, sent with every
+	// message.
+	CorrelationID uint64
+	// Writer sends the consumed messages in the protocol of Conn.
+	Writer ResponseWriter
+	// Credit limits the messages sent ahead of the client processing them
+	// and stores their offsets once processed; nil sends messages as fast
+	// as they are written, storing their offsets right away.
+	Credit *Credit
+	// ManualCommit leaves storing the offset to commit commands, so the
+	// client commits it once the messages are processed.
+	ManualCommit bool
 
-	Name     string
-	MetaFile *os.File
-	Meta     *MetaConsumer
-	Done     chan struct{}
+	Name    string
+	Offsets Offsets
+	Meta    *MetaConsumer
+	Done    chan struct{}
+	// Stopped is closed once Start returned, after storing the offset.
+	Stopped chan struct{}
 }
 
+// MetaConsumer is the offset stored for a consumer.
 type MetaConsumer struct {
 	Offset uint `json:"offset"`
+	// mu serializes the updates of the offset by the consumer, its credit
+	// and commit commands.
+	mu sync.Mutex
 }
 
-func NewConsumer(name string, conn net.Conn, topic, path string) (Consumer, error) {
-	// open consumer file
-	id := fmt.Sprintf("%s/%s", path, fileName(name, topic))
-	file, err := os.OpenFile(id, os.O_RDWR|os.O_CREATE, 0644)
+// NewConsumer creates a consumer of a topic partition that resumes from its
+// stored offset, or from the first message appended at or after since when it
+// is non-zero.
+func NewConsumer(name string, conn net.Conn, topic string, partition int, log Log, since int64, storage Storage) (Consumer, error) {
+	id := fileName(name, topic, partition)
+	offsets, err := storage.Offsets(name, topic, partition)
 	if err != nil {
-		return Consumer{}, fmt.Errorf("cannot open consumer file: %w", err)
+		return Consumer{}, err
 	}
-
-	data, err := io.ReadAll(file)
+	offset, err := offsets.Load()
 	if err != nil {
-		return Consumer{}, fmt.Errorf("consumer file is corrupted: %w", err)
-	}
-
-	if len(data) == 0 {
-		data = []byte("{}")
-	}
-
-	var meta MetaConsumer
-	if err = json.Unmarshal(data, &meta); err != nil {
-		return Consumer{}, fmt.Errorf("consumer file is corrupted: %w", err)
+		offsets.Close()
+		return Consumer{}, err
 	}
 
-	// open topic file
-	filePath := fmt.Sprintf("%s/%s.topic", path, topic)
-	topicFile, err := os.OpenFile(filePath, os.O_RDONLY|os.O_CREATE, 0644)
-	if err != nil {
-		return Consumer{}, fmt.Errorf("cannot open topic file: %w", err)
+	if since > 0 {
+		if offset, err = log.OffsetForTime(since); err != nil {
+			offsets.Close()
+			return Consumer{}, fmt.Errorf("cannot find offset for timestamp: %w", err)
+		}
 	}
 
-	reader := bufio.NewReader(topicFile)
-	fmt.Printf("Consumer %s created with offset %d\n", id, meta.Offset)
-	for i := uint(0); i < meta.Offset; i++ {
-		// move reader to the first line that needs to be consumed: meta.Offset
-		reader.ReadLine()
-	}
+	fmt.Printf("Consumer %s created with offset %d\n", id, offset)
 
 	done := make(chan struct{}, 1)
 	return Consumer{
 		ID:        id,
-		Reader:    reader,
-		TopicFile: topicFile,
+		Log:       log,
+		Reader:    log.Reader(offset),
+		Topic:     topic,
+		Partition: partition,
 		Name:      name,
-		MetaFile:  file,
-		Meta:      &meta,
+		Offsets:   offsets,
+		Meta:      &MetaConsumer{Offset: uint(offset)},
 		Done:      done,
+		Stopped:   make(chan struct{}),
 		Conn:      conn,
-	}, err
+	}, nil
 }
 
 func (c Consumer) Start() {
 	fmt.Printf("%s consuming...\n", c.ID)
+	defer close(c.Stopped)
+	defer c.release()
 	for {
 		select {
 		case <-c.Done:
 			return
 		default:
-			line, _, err := c.Reader.ReadLine()
+			// take the channel before reading, so an append in between is
+			// not missed
+			appended := c.Log.Appended()
+			record, err := c.Reader.Next()
 			if err == io.EOF {
-				time.Sleep(500 * time.Millisecond)
+				select {
+				case <-c.Done:
+				case <-appended:
+				}
 				continue
 			}
 
-			if err != nil {
-				fmt.Printf("%s unable to read topic file: %s", c.ID, err)
+			if errors.Is(err, ErrClosed) {
+				fmt.Printf("%s topic log closed\n", c.ID)
+				return
+			}
+
+			if errors.Is(err, ErrOffsetOutOfRange) {
+				if err = c.resetOffset(); err != nil {
+					fmt.Printf("%s stopped: %s\n", c.ID, err)
+					c.replyError(err)
+					return
+				}
 				continue
 			}
 
-			response := Response{
-				Offset: c.Meta.Offset,
-				Body:   string(line),
+			if errors.Is(err, ErrCorrupt) {
+				fmt.Printf("%s stopped at offset %d: %s\n", c.ID, c.Reader.Offset(), err)
+				c.replyError(err)
+				return
 			}
 
-			resp, err := json.Marshal(response)
 			if err != nil {
-				fmt.Printf("%s unable to marshal response json: %s", c.ID, err)
+				fmt.Printf("%s unable to read topic log: %s", c.ID, err)
 				continue
 			}
 
-			fmt.Fprintln(c.Conn, string(resp))
-			c.Meta.Offset++
-			c.updateMetaFile()
+			if c.Credit != nil && !c.Credit.acquire(c.Done) {
+				return
+			}
+
+			response := Response{
+				Topic:     c.Topic,
+				Partition: c.Partition,
+				Offset:    uint(record.Offset),
+				Timestamp: record.Timestamp,
+				Message: &Message{
+					Key:       string(record.Key),
+					Headers:   record.Headers,
+					Body:      string(record.Value),
+					Tombstone: record.Value == nil,
+				},
+				CorrelationID: c.CorrelationID,
+			}
+			// tracked before it is written, as its credit may come back
+			// right after
+			if c.Credit != nil {
+				c.Credit.track(c, uint(record.Offset))
+			}
+			if err = c.Writer.WriteResponse(response); err != nil {
+				// the group stops the consumer once the connection closes
+				fmt.Printf("%s unable to write response: %s\n", c.ID, err)
+				return
+			}
+			if c.Credit != nil {
+				continue
+			}
+			if !c.ManualCommit {
+				c.storeOffset(uint(record.Offset) + 1)
+			}
 		}
 	}
 }
 
-func (c Consumer) updateMetaFile() error {
-	data, err := json.Marshal(c.Meta)
-	if err != nil {
-		return err
+// resetOffset moves the consumer according to its offset reset policy once
+// its offset was removed from the topic log.
+func (c Consumer) resetOffset() error {
+	var offset uint64
+	switch c.OffsetReset {
+	case OffsetResetEarliest, "":
+		offset = c.Log.StartOffset()
+	case OffsetResetLatest:
+		offset = c.Log.NextOffset()
+	default:
+		return fmt.Errorf("%w: %d", ErrOffsetOutOfRange, c.Reader.Offset())
 	}
-	if err = c.MetaFile.Truncate(0); err != nil {
+	fmt.Printf("%s offset %d is out of range, resetting to %d\n", c.ID, c.Reader.Offset(), offset)
+	c.Reader.Seek(offset)
+	return c.storeOffset(uint(offset))
+}
+
+// commit stores offset, the offset of the next message the client has not
+// processed yet.
+func (c Consumer) commit(offset uint) error {
+	if err := checkOffset(c.Log, offset); err != nil {
 		return err
 	}
-	c.MetaFile.Seek(0, 0)
-	_, err = c.MetaFile.Write(data)
+	return c.storeOffset(offset)
+}
 
-	return err
+// checkOffset checks offset is stored in log or the offset of its next
+// message.
+func checkOffset(log Log, offset uint) error {
+	if uint64(offset) < log.StartOffset() || uint64(offset) > log.NextOffset() {
+		return fmt.Errorf("%w: %d", ErrOffsetOutOfRange, offset)
+	}
+	return nil
 }
 
-func (c Consumer) Close() {
-	fmt.Printf("%s closing...\n", c.ID)
+// storeOffset stores offset as the offset the consumer resumes from.
+func (c Consumer) storeOffset(offset uint) error {
+	defer c.lockOffset()()
+	c.Meta.Offset = offset
+	return c.updateMetaFile()
+}
+
+// replyError tells the client why the consumer stopped.
+func (c Consumer) replyError(reason error) {
+	err := c.Writer.WriteResponse(Response{
+		Topic:     c.Topic,
+		Partition: c.Partition,
+		Offset:    uint(c.Reader.Offset()),
+		Error: &ResponseError{
+			Code:    ErrorCodeOf(reason),
+			Message: reason.Error(),
+		},
+		CorrelationID: c.CorrelationID,
+	})
+	if err != nil {
+		fmt.Printf("%s unable to write response: %s", c.ID, err)
+	}
+}
+
+func (c Consumer) updateMetaFile() error {
+	return c.Offsets.Store(uint64(c.Meta.Offset))
+}
+
+// Stop stops consuming and waits for the consumer to store its offset,
+// leaving the connection open.
+func (c Consumer) Stop() {
+	c.stop()
+	<-c.Stopped
+}
+
+// stop tells the consumer to stop without waiting for it.
+func (c Consumer) stop() {
+	fmt.Printf("%s stopping...\n", c.ID)
 	close(c.Done)
+}
+
+// release stores the consumer offset and closes its offsets once it stopped
+// consuming.
+func (c Consumer) release() {
+	defer c.lockOffset()()
 	c.updateMetaFile()
-	c.TopicFile.Close()
-	c.MetaFile.Close()
+	c.Offsets.Close()
+}
+
+// lockOffset serializes the updates of the offset of the consumer,
+// returning the unlock function.
+func (c Consumer) lockOffset() func() {
+	c.Meta.mu.Lock()
+	return c.Meta.mu.Unlock
+}
+
+func (c Consumer) Close() {
+	c.Stop()
 	c.Conn.Close()
 }
 
 func (c Consumer) FileName() string {
-	return fileName(c.Name, c.Topic)
+	return fileName(c.Name, c.Topic, c.Partition)
 }
 
-func fileName(name, topic string) string {
-	return name + "." + topic + ".consumer"
+func fileName(name, topic string, partition int) string {
+	return fmt.Sprintf("%s.%s-%d.consumer", name, topic, partition)
 }
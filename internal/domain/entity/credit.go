@@ -0,0 +1,90 @@
+package entity
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Credit is how many messages the consumers of a member may send ahead of
+// its client processing them. The client gives credit back with credit
+// commands as it processes messages, and the offset of a message is only
+// stored once its credit came back, so messages sent but not processed are
+// consumed again after a rebalance or a restart.
+type Credit struct {
+	mu        sync.Mutex
+	available int
+	// granted is closed and replaced whenever credit is granted, waking
+	// the consumers waiting for it.
+	granted chan struct{}
+	// sent are the messages whose credit has not come back yet, in the
+	// order they were sent.
+	sent []sentMessage
+}
+
+type sentMessage struct {
+	consumer Consumer
+	offset   uint
+}
+
+// NewCredit returns the credit of a member allowed n messages ahead.
+func NewCredit(n int) *Credit {
+	return &Credit{available: n, granted: make(chan struct{})}
+}
+
+// acquire takes the credit of a message, waiting for one until done is
+// closed. It reports whether it took one.
+func (c *Credit) acquire(done <-chan struct{}) bool {
+	for {
+		c.mu.Lock()
+		if c.available > 0 {
+			c.available--
+			c.mu.Unlock()
+			return true
+		}
+		granted := c.granted
+		c.mu.Unlock()
+
+		select {
+		case <-granted:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// track records that consumer sent the message at offset.
+func (c *Credit) track(consumer Consumer, offset uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent = append(c.sent, sentMessage{consumer: consumer, offset: offset})
+}
+
+// Grant gives n credits back, the client having processed the n oldest
+// messages sent, and stores their offsets unless their consumers commit them
+// manually. Messages of consumers stopped since are skipped: the consumers now
+// reading their partitions resume from the offsets stored when they stopped.
+func (c *Credit) Grant(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	processed := n
+	if processed > len(c.sent) {
+		processed = len(c.sent)
+	}
+	for _, m := range c.sent[:processed] {
+		if m.consumer.ManualCommit {
+			continue
+		}
+		select {
+		case <-m.consumer.Done:
+		default:
+			if err := m.consumer.storeOffset(m.offset + 1); err != nil {
+				fmt.Printf("%s unable to store offset: %s\n", m.consumer.ID, err)
+			}
+		}
+	}
+	c.sent = c.sent[processed:]
+	c.available += n
+	close(c.granted)
+	c.granted = make(chan struct{})
+}
@@ -0,0 +1,95 @@
+package entity
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// ErrorCode identifies why a command failed, so clients can handle errors
+// without parsing their messages.
+type ErrorCode string
+
+const (
+	// ErrCodeUnknown is replied for errors without a more specific code.
+	ErrCodeUnknown ErrorCode = "UNKNOWN_SERVER_ERROR"
+	// ErrCodeInvalidRequest is replied for malformed commands, e.g. invalid
+	// JSON, an unknown command type or an unknown option.
+	ErrCodeInvalidRequest ErrorCode = "INVALID_REQUEST"
+	// ErrCodeUnsupportedVersion is replied for commands encoded with a
+	// version the broker does not support.
+	ErrCodeUnsupportedVersion ErrorCode = "UNSUPPORTED_VERSION"
+	// ErrCodeInvalidTopic is replied for topic names that cannot be stored.
+	ErrCodeInvalidTopic ErrorCode = "INVALID_TOPIC"
+	// ErrCodeUnknownTopic is replied for partitions the topic does not have.
+	ErrCodeUnknownTopic ErrorCode = "UNKNOWN_TOPIC"
+	// ErrCodeOffsetOutOfRange is replied when the offset of a consumer was
+	// removed from the topic and its reset policy is OffsetResetError.
+	ErrCodeOffsetOutOfRange ErrorCode = "OFFSET_OUT_OF_RANGE"
+	// ErrCodeCorruptMessage is replied when a stored message cannot be read.
+	ErrCodeCorruptMessage ErrorCode = "CORRUPT_MESSAGE"
+	// ErrCodeMessageTooLarge is replied when a message does not fit in a
+	// batch.
+	ErrCodeMessageTooLarge ErrorCode = "MESSAGE_TOO_LARGE"
+	// ErrCodeInvalidRecord is replied when a message is rejected by the
+	// topic, e.g. a message without key published to a compacted topic.
+	ErrCodeInvalidRecord ErrorCode = "INVALID_RECORD"
+	// ErrCodeStorage is replied when the topic files cannot be accessed.
+	ErrCodeStorage ErrorCode = "STORAGE_ERROR"
+	// ErrCodeInconsistentGroupProtocol is replied when joining a consumer
+	// group with another assignment strategy than its members.
+	ErrCodeInconsistentGroupProtocol ErrorCode = "INCONSISTENT_GROUP_PROTOCOL"
+	// ErrCodeNotAssigned is replied when committing the offset of a
+	// partition not assigned to the member, e.g. after a rebalance, or
+	// acking or nacking a message of a queue not delivered to the member,
+	// e.g. after its visibility timeout.
+	ErrCodeNotAssigned ErrorCode = "NOT_ASSIGNED"
+	// ErrCodeNotLeader and ErrCodeAuthorizationFailed are not replied by a
+	// single broker without access control, but are reserved so clients can
+	// handle them.
+	ErrCodeNotLeader           ErrorCode = "NOT_LEADER"
+	ErrCodeAuthorizationFailed ErrorCode = "AUTHORIZATION_FAILED"
+)
+
+// Error is an error replied with a specific code.
+type Error struct {
+	Code ErrorCode
+	Err  error
+}
+
+// NewError wraps err to be replied with code.
+func NewError(code ErrorCode, err error) error {
+	return &Error{Code: code, Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCodeOf returns the code err is replied with.
+func ErrorCodeOf(err error) ErrorCode {
+	var codeErr *Error
+	var pathErr *fs.PathError
+	switch {
+	case errors.As(err, &codeErr):
+		return codeErr.Code
+	case errors.Is(err, ErrInvalidTopic):
+		return ErrCodeInvalidTopic
+	case errors.Is(err, ErrUnknownPartition):
+		return ErrCodeUnknownTopic
+	case errors.Is(err, ErrOffsetOutOfRange):
+		return ErrCodeOffsetOutOfRange
+	case errors.Is(err, ErrCorrupt):
+		return ErrCodeCorruptMessage
+	case errors.Is(err, ErrTooLarge):
+		return ErrCodeMessageTooLarge
+	case errors.Is(err, ErrMissingKey):
+		return ErrCodeInvalidRecord
+	case errors.As(err, &pathErr):
+		return ErrCodeStorage
+	}
+	return ErrCodeUnknown
+}
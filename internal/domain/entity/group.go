@@ -0,0 +1,357 @@
+package entity
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Strategies assigning the partitions of a topic among the members of a
+// consumer group: range gives each member a contiguous block of partitions,
+// round-robin deals them one by one.
+const (
+	AssignRange      = "range"
+	AssignRoundRobin = "roundrobin"
+)
+
+// Group is a consumer group reading a topic. Every partition is consumed by
+// exactly one member, and the partitions are assigned again whenever a member
+// joins or leaves. Offsets are stored per group and partition.
+type Group struct {
+	mu       sync.Mutex
+	Name     string
+	Topic    string
+	Strategy string
+	Storage  Storage
+
+	partitions []Log
+	members    []*member
+	// stopping are the consumers told to stop by rebalances, which start
+	// the consumers of the new assignment once they all stopped.
+	stopping []Consumer
+	// generation counts the rebalances, so only the latest one assigns the
+	// partitions, from since when it is non-zero.
+	generation int
+	since      int64
+}
+
+type member struct {
+	conn          net.Conn
+	writer        ResponseWriter
+	correlationID uint64
+	offsetReset   string
+	consumers     []Consumer
+	// credit is shared by the consumers of the member, nil when unlimited.
+	credit       *Credit
+	manualCommit bool
+}
+
+// NewGroup creates an empty consumer group of topic.
+func NewGroup(name, topic, strategy string, storage Storage) (*Group, error) {
+	if strategy == "" {
+		strategy = AssignRange
+	}
+	if strategy != AssignRange && strategy != AssignRoundRobin {
+		return nil, NewError(ErrCodeInvalidRequest, fmt.Errorf("unknown assignment strategy: %s", strategy))
+	}
+	return &Group{
+		Name:     name,
+		Topic:    topic,
+		Strategy: strategy,
+		Storage:  storage,
+	}, nil
+}
+
+// Join adds the member consuming through the connection of the consume
+// command c and rebalances the group over partitions, the current logs of the
+// topic. A command timestamp moves the offsets of every partition to the
+// first message appended at or after it.
+func (g *Group) Join(c Command, partitions []Log) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	m := &member{
+		conn:          c.Connection,
+		writer:        c.Writer,
+		correlationID: c.CorrelationID,
+		offsetReset:   c.OffsetReset,
+		manualCommit:  c.ManualCommit,
+	}
+	if c.Credit > 0 {
+		m.credit = NewCredit(c.Credit)
+	}
+	g.members = append(g.members, m)
+	g.partitions = partitions
+	if c.Timestamp > 0 {
+		g.since = c.Timestamp
+	}
+	g.rebalance()
+}
+
+// Leave removes the members consuming through conn and rebalances the group.
+// It reports whether the group has members left.
+func (g *Group) Leave(conn net.Conn) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	members := g.members[:0]
+	left := false
+	for _, m := range g.members {
+		if m.conn != conn {
+			members = append(members, m)
+			continue
+		}
+		for _, c := range m.consumers {
+			c.stop()
+			g.stopping = append(g.stopping, c)
+		}
+		m.consumers = nil
+		left = true
+	}
+	g.members = members
+	if left && len(g.members) > 0 {
+		g.rebalance()
+	}
+	return len(g.members) > 0
+}
+
+// Empty reports whether the group has no members left.
+func (g *Group) Empty() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.members) == 0
+}
+
+// Wait waits for the consumers told to stop to store their offsets.
+func (g *Group) Wait() {
+	g.mu.Lock()
+	stopping := g.stopping
+	g.mu.Unlock()
+
+	for _, c := range stopping {
+		<-c.Stopped
+	}
+}
+
+// Grant gives n credits to the member consuming through conn with the
+// consume command of correlationID. It reports whether there is such a
+// member with credit.
+func (g *Group) Grant(conn net.Conn, correlationID uint64, n int) bool {
+	g.mu.Lock()
+	var credit *Credit
+	for _, m := range g.members {
+		if m.conn == conn && m.correlationID == correlationID {
+			credit = m.credit
+		}
+	}
+	g.mu.Unlock()
+
+	if credit == nil {
+		return false
+	}
+	credit.Grant(n)
+	return true
+}
+
+// Commit stores offset for partition, which must be assigned to a member
+// consuming through conn. A nil conn commits for a client outside the group:
+// the consumer of the partition takes the offset as its own, so stopping it
+// does not overwrite the commit, and the offset of a partition not assigned
+// yet is stored for the consumer to resume from.
+func (g *Group) Commit(conn net.Conn, partition int, offset uint) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, m := range g.members {
+		if conn != nil && m.conn != conn {
+			continue
+		}
+		for _, c := range m.consumers {
+			if c.Partition == partition {
+				return c.commit(offset)
+			}
+		}
+	}
+	if conn == nil && len(g.stopping) == 0 {
+		return StoreOffset(g.Storage, g.Name, g.Topic, partition, offset)
+	}
+	err := fmt.Errorf("partition %d of %s is not assigned to the member of group %s", partition, g.Topic, g.Name)
+	return NewError(ErrCodeNotAssigned, err)
+}
+
+// Offset returns the offset the group resumes partition from, the one of its
+// consumer when the partition is assigned.
+func (g *Group) Offset(partition int) (uint, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, m := range g.members {
+		for _, c := range m.consumers {
+			if c.Partition == partition {
+				defer c.lockOffset()()
+				return c.Meta.Offset, nil
+			}
+		}
+	}
+	return LoadOffset(g.Storage, g.Name, g.Topic, partition)
+}
+
+// StoreOffset stores offset as the offset the group name resumes partition
+// of topic from, when no consumer of the group reads it.
+func StoreOffset(storage Storage, name, topic string, partition int, offset uint) error {
+	log, err := storage.Partition(topic, partition)
+	if err != nil {
+		return err
+	}
+	if err = checkOffset(log, offset); err != nil {
+		return err
+	}
+	offsets, err := storage.Offsets(name, topic, partition)
+	if err != nil {
+		return err
+	}
+	defer offsets.Close()
+	return offsets.Store(uint64(offset))
+}
+
+// LoadOffset returns the offset stored for the group name and partition of
+// topic.
+func LoadOffset(storage Storage, name, topic string, partition int) (uint, error) {
+	if _, err := storage.Partition(topic, partition); err != nil {
+		return 0, err
+	}
+	offsets, err := storage.Offsets(name, topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	defer offsets.Close()
+	offset, err := offsets.Load()
+	return uint(offset), err
+}
+
+// Close stops every member of the group and closes their connections, which
+// lets the consumers blocked writing to them stop, and waits for the
+// consumers to store their offsets.
+func (g *Group) Close() {
+	g.mu.Lock()
+	for _, m := range g.members {
+		for _, c := range m.consumers {
+			c.stop()
+			g.stopping = append(g.stopping, c)
+		}
+		m.consumers = nil
+		m.conn.Close()
+	}
+	g.members = nil
+	g.generation++
+	stopping := g.stopping
+	g.stopping = nil
+	g.mu.Unlock()
+
+	for _, c := range stopping {
+		<-c.Stopped
+	}
+}
+
+// rebalance tells every consumer of the group to stop and assigns the
+// partitions once they all stopped, so no partition is read by two members
+// at once. Consumers blocked writing to a connection that is not read may
+// take long to stop, so they are waited for without holding g.mu. It must be
+// called with g.mu held.
+func (g *Group) rebalance() {
+	for _, m := range g.members {
+		for _, c := range m.consumers {
+			c.stop()
+			g.stopping = append(g.stopping, c)
+		}
+		m.consumers = nil
+	}
+	g.generation++
+	go g.assign(g.generation, g.stopping)
+}
+
+// assign waits for the consumers stopping and, unless another rebalance
+// started meanwhile, starts the consumers of the new assignment from the
+// stored offsets. A member whose consumer cannot be created is sent the
+// error.
+func (g *Group) assign(generation int, stopping []Consumer) {
+	for _, c := range stopping {
+		<-c.Stopped
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if generation != g.generation {
+		return
+	}
+	g.stopping = nil
+	since := g.since
+	g.since = 0
+
+	assignment := assign(g.Strategy, len(g.members), len(g.partitions))
+	for i, m := range g.members {
+		for _, partition := range assignment[i] {
+			consumer, err := NewConsumer(g.Name, m.conn, g.Topic, partition, g.partitions[partition], since, g.Storage)
+			if err != nil {
+				err = fmt.Errorf("cannot assign partition %d: %w", partition, err)
+				fmt.Printf("group %s of %s: %s\n", g.Name, g.Topic, err)
+				m.replyError(g.Topic, partition, err)
+				continue
+			}
+			consumer.OffsetReset = m.offsetReset
+			consumer.CorrelationID = m.correlationID
+			consumer.Writer = m.writer
+			consumer.Credit = m.credit
+			consumer.ManualCommit = m.manualCommit
+			m.consumers = append(m.consumers, consumer)
+			go consumer.Start()
+		}
+		fmt.Printf("group %s of %s: member %d assigned partitions %v\n", g.Name, g.Topic, i, assignment[i])
+	}
+}
+
+// replyError tells the member a partition could not be assigned to it.
+func (m *member) replyError(topic string, partition int, reason error) {
+	err := m.writer.WriteResponse(Response{
+		Topic:     topic,
+		Partition: partition,
+		Error: &ResponseError{
+			Code:    ErrorCodeOf(reason),
+			Message: reason.Error(),
+		},
+		CorrelationID: m.correlationID,
+	})
+	if err != nil {
+		fmt.Printf("unable to write response: %s\n", err)
+	}
+}
+
+// assign splits partitions among members with strategy, returning the
+// partitions of every member.
+func assign(strategy string, members, partitions int) [][]int {
+	assignment := make([][]int, members)
+	if members == 0 {
+		return assignment
+	}
+	switch strategy {
+	case AssignRoundRobin:
+		for p := 0; p < partitions; p++ {
+			assignment[p%members] = append(assignment[p%members], p)
+		}
+	default:
+		// the first partitions%members members get one extra partition
+		per, extra := partitions/members, partitions%members
+		p := 0
+		for i := range assignment {
+			n := per
+			if i < extra {
+				n++
+			}
+			for ; n > 0; n-- {
+				assignment[i] = append(assignment[i], p)
+				p++
+			}
+		}
+	}
+	return assignment
+}
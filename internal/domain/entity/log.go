@@ -0,0 +1,96 @@
+package entity
+
+import "errors"
+
+var (
+	ErrClosed = errors.New("log is closed")
+	// ErrOffsetOutOfRange is returned when reading from an offset that was
+	// removed by retention.
+	ErrOffsetOutOfRange = errors.New("offset out of range")
+	// ErrCorrupt is returned when a stored record cannot be decoded.
+	ErrCorrupt = errors.New("corrupt record")
+	// ErrTooLarge is returned when appending records that do not fit in a
+	// batch.
+	ErrTooLarge = errors.New("batch is too large")
+	// ErrMissingKey is returned when appending a record without a key to a
+	// compacted log.
+	ErrMissingKey = errors.New("records of a compacted log must have a key")
+	// ErrInvalidTopic is returned for topic names that cannot be stored.
+	ErrInvalidTopic = errors.New("invalid topic name")
+	// ErrUnknownPartition is returned for partitions the topic does not have.
+	ErrUnknownPartition = errors.New("unknown partition")
+)
+
+// Record is a single entry of a Log.
+type Record struct {
+	Offset uint64
+	// Timestamp is the time the record was appended, in unix milliseconds.
+	Timestamp int64
+	// Key identifies the records compaction keeps only the latest of.
+	Key     []byte
+	Headers map[string]string
+	// Value is nil for tombstones, which delete their key on compaction.
+	Value []byte
+}
+
+// Log is an append-only sequence of records identified by consecutive
+// offsets, storing a partition of a topic.
+type Log interface {
+	// Append stamps records with consecutive offsets and the current time
+	// and stores them, returning the stamped records.
+	Append(records ...Record) ([]Record, error)
+	// Reader returns a reader positioned at offset.
+	Reader(offset uint64) LogReader
+	// StartOffset returns the offset of the first record still stored.
+	StartOffset() uint64
+	// NextOffset returns the high watermark, the offset after the last
+	// record readers can read.
+	NextOffset() uint64
+	// Appended returns a channel closed when the next appended records can
+	// be read, or when the log is closed, so readers that caught up can wait
+	// for new records.
+	Appended() <-chan struct{}
+	// OffsetForTime returns the offset of the first record appended at or
+	// after timestamp, in unix milliseconds, or the next offset if there is
+	// none.
+	OffsetForTime(timestamp int64) (uint64, error)
+	// Truncate removes the records at and after offset.
+	Truncate(offset uint64) error
+	Close() error
+}
+
+// LogReader reads the records of a Log sequentially.
+type LogReader interface {
+	// Next returns the next record. It returns io.EOF when the reader has
+	// caught up with the end of the log and ErrOffsetOutOfRange when its
+	// offset is no longer stored.
+	Next() (Record, error)
+	// Offset returns the offset of the next record to be read.
+	Offset() uint64
+	// Seek moves the reader to offset.
+	Seek(offset uint64)
+}
+
+// Storage keeps the partition logs of every topic and the offsets of the
+// consumer groups reading them.
+type Storage interface {
+	// Topic returns the partition logs of a topic, creating it on first use.
+	Topic(topic string) ([]Log, error)
+	// Partition returns the log of a single partition of a topic.
+	Partition(topic string, partition int) (Log, error)
+	// Logs returns the partition logs of every topic opened so far.
+	Logs() []Log
+	// Topics returns the names of the topics opened so far, sorted.
+	Topics() []string
+	// Offsets opens the offset a consumer group stores for a partition.
+	Offsets(group, topic string, partition int) (Offsets, error)
+	Close() error
+}
+
+// Offsets is the stored offset of a consumer group partition.
+type Offsets interface {
+	// Load returns the stored offset, or zero when there is none.
+	Load() (uint64, error)
+	Store(offset uint64) error
+	Close() error
+}
@@ -1,6 +1,21 @@
 package entity
 
 type Message struct {
+	// Key is optional; compacted topics keep only the latest message of
+	// each key.
+	Key     string            `json:"key,omitempty"`
 	Headers map[string]string `json:"headers,omitempty"`
 	Body    string            `json:"body"`
+	// Tombstone marks a message without body, which deletes its key from
+	// compacted topics.
+	Tombstone bool `json:"tombstone,omitempty"`
+	// Partition and Offset locate a consumed message in its topic.
+	Partition int  `json:"partition"`
+	Offset    uint `json:"offset"`
+	// Timestamp is the time a fetched message was appended, in unix
+	// milliseconds.
+	Timestamp int64 `json:"timestamp,omitempty"`
+	// Err is set on the last message a client delivers to a consumer before
+	// closing its channel, holding the error the broker stopped it with.
+	Err error `json:"-"`
 }
@@ -0,0 +1,64 @@
+package entity
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// Partitioner chooses the partition of a topic a message is published to.
+type Partitioner interface {
+	Partition(key string, partitions int) int
+}
+
+// DefaultPartitioner sends messages with a key to the partition of the key
+// hash, so they keep their order, and spreads messages without a key in
+// round-robin.
+type DefaultPartitioner struct {
+	next uint32
+}
+
+func (p *DefaultPartitioner) Partition(key string, partitions int) int {
+	if partitions <= 1 {
+		return 0
+	}
+	if key == "" {
+		return int((atomic.AddUint32(&p.next, 1) - 1) % uint32(partitions))
+	}
+	return int(uint32(Murmur2([]byte(key))&0x7fffffff) % uint32(partitions))
+}
+
+// Murmur2 is the 32-bit murmur2 hash used by Kafka producers to partition
+// keys, so keys are spread the same way as by Kafka clients.
+func Murmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
@@ -0,0 +1,540 @@
+package entity
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultVisibilityTimeout is how long a queue member has to ack a
+	// message when its consume command does not set a visibility timeout.
+	DefaultVisibilityTimeout = 30 * time.Second
+	// DefaultMaxAttempts and DefaultRetryBackoff apply to the messages of
+	// queue members whose consume command does not set them.
+	DefaultMaxAttempts  = 5
+	DefaultRetryBackoff = time.Second
+	// maxRetryBackoff bounds how long a nacked message waits.
+	maxRetryBackoff = 10 * time.Minute
+	// redeliveryInterval is how often a queue looks for messages to
+	// deliver again.
+	redeliveryInterval = 100 * time.Millisecond
+)
+
+// Headers set on the messages delivered by queues and moved to dead-letter
+// topics. HeaderDeliveryAttempt counts the deliveries of a message, from 1;
+// dead letters also keep why they failed and where they were read from.
+const (
+	HeaderDeliveryAttempt     = "delivery-attempt"
+	HeaderDeadLetterReason    = "dlq-reason"
+	HeaderDeadLetterTopic     = "dlq-topic"
+	HeaderDeadLetterPartition = "dlq-partition"
+	HeaderDeadLetterOffset    = "dlq-offset"
+)
+
+// DeadLetterTopic returns the topic the messages of topic that queue members
+// failed to process are moved to.
+func DeadLetterTopic(topic string) string {
+	return topic + ".dlq"
+}
+
+// Queue hands the messages of a topic to competing members, every message to
+// a single member, as job queues do. A member acks a message within its
+// visibility timeout or the message is delivered again, to another member
+// when there is one; the messages of a member that leaves are delivered again
+// right away. A member that fails to process a message nacks it, which
+// delivers it again after a backoff; once delivered the maximum attempts of
+// the member, a message nacked or not acked in time is moved to the
+// dead-letter topic. Every partition is read by a Consumer that stores the
+// offset of its first message not acked yet, so messages still in flight are
+// delivered again once the queue is consumed after a restart.
+type Queue struct {
+	mu      sync.Mutex
+	Name    string
+	Topic   string
+	Storage Storage
+
+	partitioner DefaultPartitioner
+	members     []*queueMember
+	partitions  []*queuePartition
+	// next is the member the round-robin of deliveries starts from.
+	next int
+	// available is closed and replaced whenever a member may take more
+	// messages, waking up the deliveries waiting for one.
+	available chan struct{}
+	done      chan struct{}
+	closed    bool
+}
+
+type queueMember struct {
+	conn          net.Conn
+	writer        ResponseWriter
+	correlationID uint64
+	// prefetch is how many messages the member may hold without acking
+	// them, zero for no limit.
+	prefetch    int
+	visibility  time.Duration
+	maxAttempts int
+	backoff     time.Duration
+	inFlight    int
+}
+
+// delivery is a message read from a partition and not acked yet.
+type delivery struct {
+	partition *queuePartition
+	response  Response
+	// member holds the message until deadline, nil while the message waits
+	// to be delivered again.
+	member   *queueMember
+	previous *queueMember
+	deadline time.Time
+	attempts int
+	// retryAt is when a nacked message is delivered again.
+	retryAt time.Time
+	// reason is why the last attempt failed, the one the message is moved
+	// to the dead-letter topic with.
+	reason string
+}
+
+// queuePartition is the ResponseWriter of the consumer of a partition,
+// delivering the messages it reads to the members of the queue.
+type queuePartition struct {
+	queue    *Queue
+	consumer Consumer
+	inFlight map[uint]*delivery
+	// outstanding are the offsets delivered whose message or a message
+	// before was not acked yet, in order, and acked the ones of them acked.
+	outstanding []uint
+	acked       map[uint]bool
+	// next is the offset after the last message delivered.
+	next uint
+}
+
+// NewQueue creates a queue of topic without members.
+func NewQueue(name, topic string, storage Storage) *Queue {
+	return &Queue{
+		Name:      name,
+		Topic:     topic,
+		Storage:   storage,
+		available: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Join adds the member consuming through the connection of the consume
+// command c, whose credit is how many messages it may hold without acking
+// them. The first member starts reading partitions, the current logs of the
+// topic, from the stored offsets or from the command timestamp.
+func (q *Queue) Join(c Command, partitions []Log) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	m := &queueMember{
+		conn:          c.Connection,
+		writer:        c.Writer,
+		correlationID: c.CorrelationID,
+		prefetch:      c.Credit,
+		visibility:    time.Duration(c.VisibilityTimeout) * time.Millisecond,
+		maxAttempts:   c.MaxAttempts,
+		backoff:       time.Duration(c.RetryBackoff) * time.Millisecond,
+	}
+	if m.visibility <= 0 {
+		m.visibility = DefaultVisibilityTimeout
+	}
+	if m.maxAttempts <= 0 {
+		m.maxAttempts = DefaultMaxAttempts
+	}
+	if m.backoff <= 0 {
+		m.backoff = DefaultRetryBackoff
+	}
+	if q.partitions == nil {
+		if err := q.start(c, partitions); err != nil {
+			return err
+		}
+	}
+	q.members = append(q.members, m)
+	q.signal()
+	return nil
+}
+
+// start reads partitions with a consumer each, from the stored offsets or
+// from the timestamp of the consume command c. Consumers are started only
+// once every partition has one, so a failure leaves the queue unread. It
+// must be called with q.mu held.
+func (q *Queue) start(c Command, partitions []Log) error {
+	var created []*queuePartition
+	for i, log := range partitions {
+		consumer, err := NewConsumer(q.Name, nil, q.Topic, i, log, c.Timestamp, q.Storage)
+		if err != nil {
+			for _, p := range created {
+				p.consumer.release()
+			}
+			return fmt.Errorf("cannot read partition %d: %w", i, err)
+		}
+		p := &queuePartition{
+			queue:    q,
+			inFlight: make(map[uint]*delivery),
+			acked:    make(map[uint]bool),
+			next:     consumer.Meta.Offset,
+		}
+		consumer.OffsetReset = c.OffsetReset
+		consumer.ManualCommit = true
+		consumer.Writer = p
+		p.consumer = consumer
+		created = append(created, p)
+	}
+	q.partitions = created
+	for _, p := range created {
+		go p.consumer.Start()
+	}
+	go q.redeliver()
+	return nil
+}
+
+// Leave removes the members consuming through conn, delivering their
+// messages again. It reports whether the queue has members left; once the
+// last one leaves the queue is closed.
+func (q *Queue) Leave(conn net.Conn) bool {
+	q.mu.Lock()
+	members := q.members[:0]
+	for _, m := range q.members {
+		if m.conn != conn {
+			members = append(members, m)
+			continue
+		}
+		for _, p := range q.partitions {
+			for _, d := range p.inFlight {
+				if d.member == m {
+					d.deadline = time.Time{}
+				}
+			}
+		}
+	}
+	q.members = members
+	left := len(q.members) > 0
+	q.mu.Unlock()
+
+	if !left {
+		q.Close()
+	}
+	return left
+}
+
+// Ack acks the message of partition at offset, which must be delivered to a
+// member consuming through conn, and stores the offset of the first message
+// of the partition not acked yet.
+func (q *Queue) Ack(conn net.Conn, partition int, offset uint) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	d, err := q.delivered(conn, partition, offset)
+	if err != nil {
+		return err
+	}
+	return q.complete(d)
+}
+
+// Nack tells the message of partition at offset, which must be delivered to
+// a member consuming through conn, could not be processed for reason. The
+// message is delivered again after the backoff of the member, or moved to
+// the dead-letter topic once delivered its maximum attempts.
+func (q *Queue) Nack(conn net.Conn, partition int, offset uint, reason string) error {
+	q.mu.Lock()
+	d, err := q.delivered(conn, partition, offset)
+	if err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	m := d.member
+	m.inFlight--
+	d.previous, d.member = m, nil
+	d.reason = reason
+	q.signal()
+	if d.attempts < m.maxAttempts {
+		d.retryAt = time.Now().Add(retryBackoff(m.backoff, d.attempts))
+		q.mu.Unlock()
+		return nil
+	}
+	q.mu.Unlock()
+
+	if err = q.deadLetter(d); err != nil {
+		q.mu.Lock()
+		d.retryAt = time.Now().Add(retryBackoff(m.backoff, d.attempts))
+		q.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// delivered returns the message of partition at offset delivered to a member
+// consuming through conn. It must be called with q.mu held.
+func (q *Queue) delivered(conn net.Conn, partition int, offset uint) (*delivery, error) {
+	var d *delivery
+	if partition >= 0 && partition < len(q.partitions) {
+		d = q.partitions[partition].inFlight[offset]
+	}
+	if d == nil || d.member == nil || d.member.conn != conn {
+		err := fmt.Errorf("message %d of partition %d of %s is not delivered to the member of queue %s", offset, partition, q.Topic, q.Name)
+		return nil, NewError(ErrCodeNotAssigned, err)
+	}
+	return d, nil
+}
+
+// complete removes the message of d, acked or moved to the dead-letter
+// topic, and stores the offset of the first message of its partition not
+// acked yet. It must be called with q.mu held.
+func (q *Queue) complete(d *delivery) error {
+	p := d.partition
+	offset := d.response.Offset
+	delete(p.inFlight, offset)
+	if d.member != nil {
+		d.member.inFlight--
+		d.member = nil
+		q.signal()
+	}
+	p.acked[offset] = true
+	for len(p.outstanding) > 0 && p.acked[p.outstanding[0]] {
+		delete(p.acked, p.outstanding[0])
+		p.outstanding = p.outstanding[1:]
+	}
+	committed := p.next
+	if len(p.outstanding) > 0 {
+		committed = p.outstanding[0]
+	}
+	return p.consumer.storeOffset(committed)
+}
+
+// Close stops reading the partitions and closes the connections of the
+// members. Messages not acked are delivered again when the queue is next
+// consumed, from the stored offsets.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.done)
+	for _, m := range q.members {
+		m.conn.Close()
+	}
+	q.members = nil
+	partitions := q.partitions
+	q.mu.Unlock()
+
+	// the consumers waiting to deliver a message return once done is closed
+	for _, p := range partitions {
+		p.consumer.Stop()
+	}
+}
+
+// WriteResponse delivers a message read by the consumer of the partition,
+// waiting for a member to take it. The error a consumer stops with is sent
+// to every member.
+func (p *queuePartition) WriteResponse(response Response) error {
+	if response.Error != nil {
+		p.queue.broadcast(response)
+		return nil
+	}
+	return p.queue.deliver(&delivery{partition: p, response: response})
+}
+
+// deliver writes the message of d to the next member that may take it,
+// waiting for one until the queue is closed.
+func (q *Queue) deliver(d *delivery) error {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return ErrClosed
+		}
+		if m := q.pick(d.previous); m != nil {
+			p := d.partition
+			offset := d.response.Offset
+			if _, ok := p.inFlight[offset]; !ok {
+				p.outstanding = append(p.outstanding, offset)
+				p.next = offset + 1
+			}
+			p.inFlight[offset] = d
+			d.member, d.deadline = m, time.Now().Add(m.visibility)
+			d.attempts++
+			m.inFlight++
+			response := d.response
+			response.CorrelationID = m.correlationID
+			message := *response.Message
+			message.Headers = make(map[string]string, len(message.Headers)+1)
+			for key, value := range response.Message.Headers {
+				message.Headers[key] = value
+			}
+			message.Headers[HeaderDeliveryAttempt] = strconv.Itoa(d.attempts)
+			response.Message = &message
+			q.mu.Unlock()
+
+			if err := m.writer.WriteResponse(response); err != nil {
+				// the member leaves once its connection is closed, which
+				// delivers the message again
+				fmt.Printf("queue %s of %s unable to deliver message: %s\n", q.Name, q.Topic, err)
+			}
+			return nil
+		}
+		available := q.available
+		q.mu.Unlock()
+
+		select {
+		case <-available:
+		case <-q.done:
+			return ErrClosed
+		}
+	}
+}
+
+// pick returns the next member, round-robin, that may take a message,
+// preferring another member than previous. It must be called with q.mu held.
+func (q *Queue) pick(previous *queueMember) *queueMember {
+	var fallback *queueMember
+	for i := range q.members {
+		m := q.members[(q.next+i)%len(q.members)]
+		if m.prefetch > 0 && m.inFlight >= m.prefetch {
+			continue
+		}
+		if m == previous {
+			fallback = m
+			continue
+		}
+		q.next = (q.next + i + 1) % len(q.members)
+		return m
+	}
+	return fallback
+}
+
+// redeliver delivers again, every redeliveryInterval, the messages whose
+// visibility timeout expired or whose backoff elapsed, until the queue is
+// closed. Messages on their last attempt, not acked in time or not moved
+// when nacked, are moved to the dead-letter topic instead.
+func (q *Queue) redeliver() {
+	ticker := time.NewTicker(redeliveryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+		}
+		for _, d := range q.expired(time.Now()) {
+			if d.attempts >= d.previous.maxAttempts {
+				err := q.deadLetter(d)
+				if err == nil {
+					continue
+				}
+				fmt.Printf("queue %s of %s %s\n", q.Name, q.Topic, err)
+			}
+			if err := q.deliver(d); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// expired takes the messages whose visibility timeout expired back from
+// their members and returns them with the nacked messages due, in the order
+// of their partitions and offsets.
+func (q *Queue) expired(now time.Time) []*delivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var expired []*delivery
+	for _, p := range q.partitions {
+		for _, d := range p.inFlight {
+			switch {
+			case d.member != nil && !now.Before(d.deadline):
+				d.member.inFlight--
+				d.previous, d.member = d.member, nil
+				d.reason = "visibility timeout expired"
+				expired = append(expired, d)
+			case d.member == nil && !d.retryAt.IsZero() && !now.Before(d.retryAt):
+				d.retryAt = time.Time{}
+				expired = append(expired, d)
+			}
+		}
+	}
+	if len(expired) > 0 {
+		q.signal()
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		a, b := expired[i].response, expired[j].response
+		return a.Partition < b.Partition || a.Partition == b.Partition && a.Offset < b.Offset
+	})
+	return expired
+}
+
+// deadLetter appends the message of d to the dead-letter topic, with the
+// reason of its last attempt and where it was read from in its headers, and
+// completes it.
+func (q *Queue) deadLetter(d *delivery) error {
+	partitions, err := q.Storage.Topic(DeadLetterTopic(q.Topic))
+	if err != nil {
+		return fmt.Errorf("cannot open dead-letter topic: %w", err)
+	}
+	message := d.response.Message
+	headers := make(map[string]string, len(message.Headers)+5)
+	for key, value := range message.Headers {
+		headers[key] = value
+	}
+	headers[HeaderDeliveryAttempt] = strconv.Itoa(d.attempts)
+	headers[HeaderDeadLetterReason] = d.reason
+	headers[HeaderDeadLetterTopic] = q.Topic
+	headers[HeaderDeadLetterPartition] = strconv.Itoa(d.response.Partition)
+	headers[HeaderDeadLetterOffset] = strconv.FormatUint(uint64(d.response.Offset), 10)
+	record := Record{Headers: headers, Value: []byte(message.Body)}
+	if message.Key != "" {
+		record.Key = []byte(message.Key)
+	}
+	if message.Tombstone {
+		record.Value = nil
+	}
+	log := partitions[q.partitioner.Partition(message.Key, len(partitions))]
+	if _, err = log.Append(record); err != nil {
+		return fmt.Errorf("cannot move message %d of partition %d to the dead-letter topic: %w", d.response.Offset, d.response.Partition, err)
+	}
+	fmt.Printf("queue %s of %s moved message %d of partition %d to %s: %s\n", q.Name, q.Topic, d.response.Offset, d.response.Partition, DeadLetterTopic(q.Topic), d.reason)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.complete(d)
+}
+
+// retryBackoff returns how long a message nacked on its attempt waits,
+// doubling backoff with every attempt.
+func retryBackoff(backoff time.Duration, attempt int) time.Duration {
+	for i := 1; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return backoff
+}
+
+// broadcast sends response to every member.
+func (q *Queue) broadcast(response Response) {
+	q.mu.Lock()
+	members := append([]*queueMember(nil), q.members...)
+	q.mu.Unlock()
+
+	for _, m := range members {
+		response.CorrelationID = m.correlationID
+		if err := m.writer.WriteResponse(response); err != nil {
+			fmt.Printf("queue %s of %s unable to write response: %s\n", q.Name, q.Topic, err)
+		}
+	}
+}
+
+// signal wakes up the deliveries waiting for a member. It must be called
+// with q.mu held.
+func (q *Queue) signal() {
+	close(q.available)
+	q.available = make(chan struct{})
+}
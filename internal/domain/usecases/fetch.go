@@ -0,0 +1,84 @@
+package usecases
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+const (
+	// defaultFetchMessages and defaultFetchBytes limit fetch commands that
+	// do not set their own limits.
+	defaultFetchMessages = 100
+	defaultFetchBytes    = 1 << 20
+)
+
+// Fetch replies to a fetch command c with the messages of a partition from
+// its offset, up to its maximum messages and bytes; the first message is
+// returned whatever its size, so consumers make progress. When there is no
+// message past the offset yet, it waits for one up to the maximum wait of
+// the command.
+func Fetch(c entity.Command, partition int, log entity.Log) error {
+	offset := uint64(c.Offset)
+	if offset < log.StartOffset() || offset > log.NextOffset() {
+		return fmt.Errorf("%w: %d", entity.ErrOffsetOutOfRange, offset)
+	}
+	if appended := log.Appended(); log.NextOffset() <= offset && c.MaxWait > 0 {
+		timer := time.NewTimer(time.Duration(c.MaxWait) * time.Millisecond)
+		select {
+		case <-appended:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	maxMessages, maxBytes := c.MaxMessages, c.MaxBytes
+	if maxMessages <= 0 {
+		maxMessages = defaultFetchMessages
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultFetchBytes
+	}
+	fetched := entity.Fetched{Messages: []entity.Message{}}
+	reader := log.Reader(offset)
+	size := 0
+	for len(fetched.Messages) < maxMessages {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if len(fetched.Messages) == 0 {
+				return err
+			}
+			break
+		}
+		recordSize := len(record.Key) + len(record.Value)
+		for key, value := range record.Headers {
+			recordSize += len(key) + len(value)
+		}
+		if len(fetched.Messages) > 0 && size+recordSize > maxBytes {
+			break
+		}
+		size += recordSize
+		fetched.Messages = append(fetched.Messages, entity.Message{
+			Key:       string(record.Key),
+			Headers:   record.Headers,
+			Body:      string(record.Value),
+			Tombstone: record.Value == nil,
+			Partition: partition,
+			Offset:    uint(record.Offset),
+			Timestamp: record.Timestamp,
+		})
+	}
+	fetched.HighWatermark = uint(log.NextOffset())
+
+	body, err := json.Marshal(fetched)
+	if err != nil {
+		return err
+	}
+	return reply(c, entity.Response{Topic: c.Topic, Partition: partition, Offset: uint(offset), Body: string(body)})
+}
@@ -0,0 +1,27 @@
+package usecases
+
+import (
+	"encoding/json"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// Metadata replies to a metadata command with how many partitions its topic
+// has.
+func Metadata(c entity.Command, partitions int) error {
+	body, err := json.Marshal(entity.TopicMetadata{Topic: c.Topic, Partitions: partitions})
+	if err != nil {
+		return err
+	}
+	return reply(c, entity.Response{Topic: c.Topic, Body: string(body)})
+}
+
+// ApiVersions replies to an api versions command with the versions of every
+// command type the broker supports.
+func ApiVersions(c entity.Command, versions []entity.ApiVersion) error {
+	body, err := json.Marshal(entity.ApiVersions{Versions: versions})
+	if err != nil {
+		return err
+	}
+	return reply(c, entity.Response{Body: string(body)})
+}
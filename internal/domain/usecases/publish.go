@@ -1,30 +1,31 @@
 package usecases
 
 import (
-	"encoding/json"
-	"fmt"
-	"net"
-	"os"
-
 	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
 )
 
-func Publish(conn net.Conn, message entity.Message, topic, path string) error {
-	filePath := fmt.Sprintf("%s/%s.topic", path, topic)
-
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
+// Publish appends message to a partition of the topic of the publish command
+// c and acknowledges it with the offset and timestamp it was stored at.
+func Publish(c entity.Command, partition int, message entity.Message, log entity.Log) error {
+	record := entity.Record{
+		Headers: message.Headers,
+		Value:   []byte(message.Body),
 	}
-	defer file.Close()
-
-	raw, err := json.Marshal(message)
+	if message.Key != "" {
+		record.Key = []byte(message.Key)
+	}
+	if message.Tombstone {
+		record.Value = nil
+	}
+	records, err := log.Append(record)
 	if err != nil {
 		return err
 	}
 
-	raw = append(raw, byte('\n'))
-	_, err = file.Write(raw)
-
-	return err
+	return reply(c, entity.Response{
+		Topic:     c.Topic,
+		Partition: partition,
+		Offset:    uint(records[0].Offset),
+		Timestamp: records[0].Timestamp,
+	})
 }
@@ -0,0 +1,41 @@
+package usecases
+
+import (
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// ReplyError replies to a command that could not be handled.
+func ReplyError(c entity.Command, err error) error {
+	return reply(c, entity.Response{
+		Topic: c.Topic,
+		Error: &entity.ResponseError{
+			Code:    entity.ErrorCodeOf(err),
+			Message: err.Error(),
+		},
+	})
+}
+
+// Subscribed acknowledges a consume command; the consumed messages follow
+// with the same correlation id.
+func Subscribed(c entity.Command) error {
+	return reply(c, entity.Response{Topic: c.Topic})
+}
+
+// Committed acknowledges a commit command once the offset of partition is
+// stored.
+func Committed(c entity.Command, partition int) error {
+	return reply(c, entity.Response{Topic: c.Topic, Partition: partition, Offset: c.Offset})
+}
+
+// Acked acknowledges an ack or nack command once the message of partition is
+// acked or nacked.
+func Acked(c entity.Command, partition int) error {
+	return reply(c, entity.Response{Topic: c.Topic, Partition: partition, Offset: c.Offset})
+}
+
+// reply sends response to the connection of the command c, with its
+// correlation id.
+func reply(c entity.Command, response entity.Response) error {
+	response.CorrelationID = c.CorrelationID
+	return c.Writer.WriteResponse(response)
+}
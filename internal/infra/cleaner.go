@@ -0,0 +1,36 @@
+package infra
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/storage"
+)
+
+// cleanLogs periodically deletes the segments of every topic log that fell
+// out of its retention and compacts the topics with the compact cleanup
+// policy, until stop is closed.
+func cleanLogs(interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, topicLog := range logs.Logs() {
+				l, ok := topicLog.(*storage.Log)
+				if !ok {
+					continue
+				}
+				if _, err := l.DeleteExpiredSegments(now); err != nil && !errors.Is(err, storage.ErrClosed) {
+					log.Printf("unable to apply retention: %s\n", err)
+				}
+				if _, err := l.Compact(now); err != nil && !errors.Is(err, storage.ErrClosed) {
+					log.Printf("unable to compact log: %s\n", err)
+				}
+			}
+		}
+	}
+}
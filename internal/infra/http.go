@@ -0,0 +1,296 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+const (
+	// defaultReadLimit and maxReadLimit bound how many messages a read of
+	// the HTTP gateway returns.
+	defaultReadLimit = 100
+	maxReadLimit     = 1000
+)
+
+// httpWriter passes the response routeCommand writes for an HTTP request to
+// its handler, fetches writing it from their own goroutine.
+type httpWriter struct {
+	responses chan entity.Response
+}
+
+func newHTTPWriter() *httpWriter {
+	return &httpWriter{responses: make(chan entity.Response, 1)}
+}
+
+func (w *httpWriter) WriteResponse(response entity.Response) error {
+	w.responses <- response
+	return nil
+}
+
+// response waits for the response of the command routed for r, returning
+// the error it replies as a coded error.
+func (w *httpWriter) response(r *http.Request) (entity.Response, error) {
+	select {
+	case response := <-w.responses:
+		if response.Error != nil {
+			return response, entity.NewError(response.Error.Code, errors.New(response.Error.Message))
+		}
+		return response, nil
+	case <-r.Context().Done():
+		return entity.Response{}, r.Context().Err()
+	}
+}
+
+// httpOffset is the offset of a consumer group partition, the offset of the
+// next message the group consumes.
+type httpOffset struct {
+	Group     string `json:"group"`
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    uint   `json:"offset"`
+}
+
+// serveHTTP serves the HTTP gateway on listen until stop is closed, which
+// cancels the context of every request, streams included.
+func serveHTTP(listen *net.TCPListener, stop chan bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	server := &http.Server{
+		Handler:     http.HandlerFunc(routeHTTP),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-stop
+		cancel()
+		server.Close()
+	}()
+	if err := server.Serve(listen); err != nil && err != http.ErrServerClosed {
+		log.Printf("unable to serve http: %s\n", err)
+	}
+}
+
+// routeHTTP serves the endpoints of the gateway:
+//
+//	GET  /topics/{topic}                              partitions of the topic
+//	POST /topics/{topic}/messages?partition=          publish a message
+//	GET  /topics/{topic}/messages?partition=&offset=&limit=
+//	GET  /topics/{topic}/stream?consumer=&partition=&offset=&timestamp=&offset_reset=
+//	GET  /groups/{group}/offsets/{topic}/{partition}  offset of a group
+//	POST /groups/{group}/offsets/{topic}/{partition}  commit an offset
+func routeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("received http request %s %s\n", r.Method, r.URL.Path)
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(path) == 2 && path[0] == "topics" && r.Method == http.MethodGet:
+		topicMetadata(w, r, path[1])
+	case len(path) == 3 && path[0] == "topics" && path[2] == "messages" && r.Method == http.MethodPost:
+		publishHTTP(w, r, path[1])
+	case len(path) == 3 && path[0] == "topics" && path[2] == "messages" && r.Method == http.MethodGet:
+		readHTTP(w, r, path[1])
+	case len(path) == 3 && path[0] == "topics" && path[2] == "stream" && r.Method == http.MethodGet:
+		streamHTTP(w, r, path[1])
+	case len(path) == 5 && path[0] == "groups" && path[2] == "offsets":
+		partition, err := strconv.Atoi(path[4])
+		if err != nil {
+			writeHTTPError(w, path[3], entity.NewError(entity.ErrCodeInvalidRequest, fmt.Errorf("invalid partition: %q", path[4])))
+			return
+		}
+		offset := httpOffset{Group: path[1], Topic: path[3], Partition: partition}
+		switch r.Method {
+		case http.MethodGet:
+			loadOffsetHTTP(w, offset)
+		case http.MethodPost:
+			commitOffsetHTTP(w, r, offset)
+		default:
+			writeHTTPError(w, "", entity.NewError(entity.ErrCodeInvalidRequest, fmt.Errorf("method %s is not allowed", r.Method)))
+		}
+	default:
+		writeHTTPError(w, "", entity.NewError(entity.ErrCodeInvalidRequest, fmt.Errorf("no endpoint %s %s", r.Method, r.URL.Path)))
+	}
+}
+
+func topicMetadata(w http.ResponseWriter, r *http.Request, topic string) {
+	writer := newHTTPWriter()
+	if err := routeCommand(entity.Command{Type: entity.TypeMetadata, Topic: topic, Writer: writer}); err != nil {
+		writeHTTPError(w, topic, err)
+		return
+	}
+	response, err := writer.response(r)
+	if err != nil {
+		writeHTTPError(w, topic, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, response.Body)
+}
+
+// publishHTTP publishes the message in the request body, replying with the
+// acknowledgement of the publish command.
+func publishHTTP(w http.ResponseWriter, r *http.Request, topic string) {
+	var message entity.Message
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		writeHTTPError(w, topic, entity.NewError(entity.ErrCodeInvalidRequest, fmt.Errorf("invalid message: %w", err)))
+		return
+	}
+	writer := newHTTPWriter()
+	c := entity.Command{Type: entity.TypePublish, Topic: topic, Message: &message, Writer: writer}
+	if value := r.URL.Query().Get("partition"); value != "" {
+		partition, err := strconv.Atoi(value)
+		if err != nil {
+			writeHTTPError(w, topic, entity.NewError(entity.ErrCodeInvalidRequest, fmt.Errorf("invalid partition: %q", value)))
+			return
+		}
+		c.Partition = &partition
+	}
+	if err := routeCommand(c); err != nil {
+		writeHTTPError(w, topic, err)
+		return
+	}
+	response, err := writer.response(r)
+	if err != nil {
+		writeHTTPError(w, topic, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// readHTTP replies with the messages of a partition from an offset, as many
+// as a fetch command returns up to the limit; it does not wait for new
+// messages.
+func readHTTP(w http.ResponseWriter, r *http.Request, topic string) {
+	query := r.URL.Query()
+	partition, err := queryInt(query.Get("partition"), 0)
+	if err != nil {
+		writeHTTPError(w, topic, err)
+		return
+	}
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil {
+		writeHTTPError(w, topic, err)
+		return
+	}
+	limit, err := queryInt(query.Get("limit"), defaultReadLimit)
+	if err != nil {
+		writeHTTPError(w, topic, err)
+		return
+	}
+	if limit > maxReadLimit {
+		limit = maxReadLimit
+	}
+
+	writer := newHTTPWriter()
+	c := entity.Command{
+		Type:        entity.TypeFetch,
+		Topic:       topic,
+		Partition:   &partition,
+		Offset:      uint(offset),
+		MaxMessages: limit,
+		Writer:      writer,
+	}
+	if err = routeCommand(c); err != nil {
+		writeHTTPError(w, topic, err)
+		return
+	}
+	response, err := writer.response(r)
+	if err != nil {
+		writeHTTPError(w, topic, err)
+		return
+	}
+	var fetched entity.Fetched
+	if err = json.Unmarshal([]byte(response.Body), &fetched); err != nil {
+		writeHTTPError(w, topic, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, fetched.Messages)
+}
+
+func loadOffsetHTTP(w http.ResponseWriter, offset httpOffset) {
+	var err error
+	if offset.Offset, err = loadOffset(offset.Group, offset.Topic, offset.Partition); err != nil {
+		writeHTTPError(w, offset.Topic, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, offset)
+}
+
+// commitOffsetHTTP commits the offset in the request body for a consumer
+// group, as a commit command of a member would. A member consuming the
+// partition resumes from it after a rebalance, unless it commits again.
+func commitOffsetHTTP(w http.ResponseWriter, r *http.Request, offset httpOffset) {
+	var body struct {
+		Offset *uint `json:"offset"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Offset == nil {
+		writeHTTPError(w, offset.Topic, entity.NewError(entity.ErrCodeInvalidRequest, errors.New("invalid offset: expected {\"offset\": <offset>}")))
+		return
+	}
+	offset.Offset = *body.Offset
+	writer := newHTTPWriter()
+	c := entity.Command{
+		Type:         entity.TypeCommit,
+		Topic:        offset.Topic,
+		ConsumerName: offset.Group,
+		Partition:    &offset.Partition,
+		Offset:       offset.Offset,
+		Writer:       writer,
+	}
+	if err := routeCommand(c); err != nil {
+		writeHTTPError(w, offset.Topic, err)
+		return
+	}
+	if _, err := writer.response(r); err != nil {
+		writeHTTPError(w, offset.Topic, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, offset)
+}
+
+func queryInt(value string, defaultValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, entity.NewError(entity.ErrCodeInvalidRequest, fmt.Errorf("invalid query parameter: %q", value))
+	}
+	return n, nil
+}
+
+// writeHTTPError replies the coded error as the JSON protocol does, with
+// the HTTP status closest to its code.
+func writeHTTPError(w http.ResponseWriter, topic string, err error) {
+	log.Printf("error on http request: %s\n", err)
+	code := entity.ErrorCodeOf(err)
+	status := http.StatusInternalServerError
+	switch code {
+	case entity.ErrCodeInvalidRequest, entity.ErrCodeInvalidTopic, entity.ErrCodeInvalidRecord, entity.ErrCodeUnsupportedVersion:
+		status = http.StatusBadRequest
+	case entity.ErrCodeMessageTooLarge:
+		status = http.StatusRequestEntityTooLarge
+	case entity.ErrCodeUnknownTopic:
+		status = http.StatusNotFound
+	case entity.ErrCodeOffsetOutOfRange:
+		status = http.StatusRequestedRangeNotSatisfiable
+	}
+	writeJSON(w, status, entity.Response{
+		Topic: topic,
+		Error: &entity.ResponseError{Code: code, Message: err.Error()},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("unable to write http response: %s\n", err)
+	}
+}
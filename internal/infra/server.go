@@ -1,54 +1,210 @@
 package infra
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
 	"github.com/rafaelmgr12/kafka-clone/internal/domain/usecases"
+	"github.com/rafaelmgr12/kafka-clone/internal/kafka"
+	"github.com/rafaelmgr12/kafka-clone/internal/protocol"
+	"github.com/rafaelmgr12/kafka-clone/internal/storage"
 )
 
-var consumers map[string]entity.Consumer
+// groups are the consumer groups with members, by group name and topic, and
+// queues the groups consuming as queues.
+var groups map[string]*entity.Group
+var queues map[string]*entity.Queue
+var groupsMu sync.Mutex
+var logs entity.Storage
+var partitioner entity.DefaultPartitioner
+
+// maxFetchWait bounds how long a fetch command waits for messages.
+const maxFetchWait = 30 * time.Second
 
 type Config struct {
+	// Storage keeps topics and consumer offsets; when nil they are stored
+	// in files under Path.
+	Storage entity.Storage
 	Path    string
 	Workers uint
+	// SegmentBytes and SegmentAge control when a topic log rolls to a new
+	// segment file; zero disables the limit.
+	SegmentBytes int64
+	SegmentAge   time.Duration
+	// Sync is the durability policy of publishes, unless overridden in
+	// Topics.
+	Sync storage.SyncPolicy
+	// RetentionAge and RetentionBytes limit how long and how much data is
+	// kept per topic, unless overridden in Topics; zero disables the limit.
+	// Expired segments are deleted every RetentionCheckInterval.
+	RetentionAge           time.Duration
+	RetentionBytes         int64
+	RetentionCheckInterval time.Duration
+	// DeleteRetention is how long tombstones are kept by compacted topics.
+	DeleteRetention time.Duration
+	// Partitions is how many partitions topics are created with, unless
+	// overridden in Topics.
+	Partitions int
+	Topics     map[string]TopicConfig
+	// Kafka listens for clients of the Kafka protocol when not nil, the
+	// broker advertising itself to them at KafkaHost.
+	Kafka     *net.TCPListener
+	KafkaHost string
+	// HTTP serves the HTTP gateway when not nil.
+	HTTP *net.TCPListener
+}
+
+// Cleanup policies of a topic: delete removes whole segments once they fall
+// out of retention, compact keeps the latest message of each key.
+const (
+	CleanupDelete  = "delete"
+	CleanupCompact = "compact"
+)
+
+// TopicConfig overrides the server configuration for a single topic.
+type TopicConfig struct {
+	Sync            *storage.SyncPolicy
+	RetentionAge    *time.Duration
+	RetentionBytes  *int64
+	CleanupPolicy   string
+	DeleteRetention *time.Duration
+	Partitions      *int
+}
+
+func (conf Config) logConfig(topic string) storage.Config {
+	logConf := storage.Config{
+		SegmentBytes:    conf.SegmentBytes,
+		SegmentAge:      conf.SegmentAge,
+		Sync:            conf.Sync,
+		RetentionAge:    conf.RetentionAge,
+		RetentionBytes:  conf.RetentionBytes,
+		DeleteRetention: conf.DeleteRetention,
+	}
+	if topicConf, ok := conf.Topics[topic]; ok {
+		if topicConf.Sync != nil {
+			logConf.Sync = *topicConf.Sync
+		}
+		if topicConf.RetentionAge != nil {
+			logConf.RetentionAge = *topicConf.RetentionAge
+		}
+		if topicConf.RetentionBytes != nil {
+			logConf.RetentionBytes = *topicConf.RetentionBytes
+		}
+		logConf.Compact = topicConf.CleanupPolicy == CleanupCompact
+		if topicConf.DeleteRetention != nil {
+			logConf.DeleteRetention = *topicConf.DeleteRetention
+		}
+	}
+	return logConf
+}
+
+func (conf Config) partitions(topic string) int {
+	if topicConf, ok := conf.Topics[topic]; ok && topicConf.Partitions != nil {
+		return *topicConf.Partitions
+	}
+	return conf.Partitions
 }
 
 func Start(conf Config, listen *net.TCPListener, done <-chan struct{}) {
-	consumers = make(map[string]entity.Consumer)
-	commands := make(chan entity.Command)
+	groups = make(map[string]*entity.Group)
+	queues = make(map[string]*entity.Queue)
+	logs = conf.Storage
+	if logs == nil {
+		registry := storage.NewRegistry(conf.Path, conf.logConfig, conf.partitions)
+		if err := registry.OpenAll(); err != nil {
+			log.Printf("unable to open topic logs: %s\n", err)
+		}
+		logs = registry
+	}
+	// every connection is served by a single worker, so its commands are
+	// handled in the order they were sent
+	workers := int(conf.Workers)
+	if workers < 1 {
+		workers = 1
+	}
+	commands := make([]chan entity.Command, workers)
+	for i := range commands {
+		commands[i] = make(chan entity.Command)
+	}
 	stopCommands := make(chan bool, 1)
 
 	go waitForCommands(listen, commands, stopCommands)
-	for i := 0; i < int(conf.Workers); i++ {
-		go handleCommands(conf.Path, commands)
+	if conf.RetentionCheckInterval > 0 {
+		go cleanLogs(conf.RetentionCheckInterval, stopCommands)
+	}
+	if conf.Kafka != nil {
+		server := kafka.Server{
+			Storage: logs,
+			Host:    conf.KafkaHost,
+			Port:    int32(conf.Kafka.Addr().(*net.TCPAddr).Port),
+		}
+		go server.Serve(conf.Kafka, stopCommands)
+	}
+	var servers sync.WaitGroup
+	if conf.HTTP != nil {
+		servers.Add(1)
+		go func() {
+			defer servers.Done()
+			serveHTTP(conf.HTTP, stopCommands)
+		}()
+	}
+	for _, workerCommands := range commands {
+		go handleCommands(workerCommands, stopCommands)
 	}
 	<-done
 	close(stopCommands)
+	// the http server has released its listener once it returns, so the
+	// server can be started again right away
+	servers.Wait()
 	log.Println("closing consumers...")
-	for _, consumer := range consumers {
-		consumer.Close()
+	groupsMu.Lock()
+	for _, group := range groups {
+		group.Close()
+	}
+	for _, queue := range queues {
+		queue.Close()
+	}
+	groupsMu.Unlock()
+	if err := logs.Close(); err != nil {
+		log.Printf("unable to close topic logs: %s\n", err)
 	}
 }
 
-func handleCommands(path string, commands chan entity.Command) {
-	for c := range commands {
-		if err := routeCommand(c, path); err != nil {
+func handleCommands(commands chan entity.Command, stopCommands chan bool) {
+	for {
+		var c entity.Command
+		select {
+		case <-stopCommands:
+			return
+		case c = <-commands:
+		}
+		if err := routeCommand(c); err != nil {
 			log.Printf("error on routing command: %s", err)
+			if err = usecases.ReplyError(c, err); err != nil {
+				log.Printf("unable to reply error: %s\n", err)
+			}
 		}
 	}
 }
 
-func waitForCommands(listen *net.TCPListener, commands chan entity.Command, stopCommands chan bool) {
-	defer close(commands)
-	for {
+// waitForCommands accepts connections on listen until stopCommands is
+// closed. The worker channels are left open, as connections still being
+// handled may send to them.
+func waitForCommands(listen *net.TCPListener, commands []chan entity.Command, stopCommands chan bool) {
+	for n := 0; ; n++ {
+		select {
+		case <-stopCommands:
+			return
+		default:
+		}
 		listen.SetDeadline(time.Now().Add(200 * time.Millisecond))
 		conn, err := listen.AcceptTCP()
 		if err != nil {
@@ -61,81 +217,326 @@ func waitForCommands(listen *net.TCPListener, commands chan entity.Command, stop
 		if err := conn.SetKeepAlive(true); err != nil {
 			log.Printf("unable to set keep alive: %s\n", err)
 		}
-		go handleConnection(conn, commands, stopCommands)
+		go handleConnection(conn, commands[n%len(commands)], stopCommands)
 	}
 }
 
+// handleConnection reads the commands of conn in the protocol it speaks,
+// detected from its first byte, until it is closed.
 func handleConnection(conn net.Conn, commands chan entity.Command, stopCommands chan bool) {
 	defer conn.Close()
-	reader := bufio.NewReader(conn)
+	codec, err := protocol.Detect(conn)
+	if err != nil {
+		return
+	}
 	for {
-		line, _, err := reader.ReadLine()
-		if err == io.EOF {
-			command := entity.Command{Type: entity.TypeClose, Connection: conn}
-			commands <- command
-			return
-		}
-		if err != nil {
-			if closedConnection(err) {
-				return
+		command, err := codec.ReadCommand()
+		command.Connection = conn
+		command.Writer = codec
+		var codeErr *entity.Error
+		if errors.As(err, &codeErr) {
+			log.Printf("invalid command: %s\n", err)
+			if err = usecases.ReplyError(command, err); err != nil {
+				log.Printf("unable to reply error: %s\n", err)
 			}
-			log.Printf("unable to read connection: %s\n", err)
 			continue
 		}
-		var command entity.Command
-		if err = json.Unmarshal(line, &command); err != nil {
-			log.Printf("error on json: %s\n", err)
-			continue
+		if err != nil {
+			if err != io.EOF && !closedConnection(err) {
+				log.Printf("unable to read connection: %s\n", err)
+			}
+			command = entity.Command{Type: entity.TypeClose, Connection: conn}
 		}
-		command.Connection = conn
 		select {
 		case <-stopCommands:
 			return
 		case commands <- command:
 		}
+		if err != nil {
+			return
+		}
 	}
 }
 
-func routeCommand(c entity.Command, path string) error {
+func routeCommand(c entity.Command) error {
 	commandNames := map[int]string{
-		entity.TypeClose:   "close",
-		entity.TypeConsume: "consume",
-		entity.TypePublish: "publish",
+		entity.TypeClose:       "close",
+		entity.TypeConsume:     "consume",
+		entity.TypePublish:     "publish",
+		entity.TypeMetadata:    "metadata",
+		entity.TypeApiVersions: "api versions",
+		entity.TypeFetch:       "fetch",
+		entity.TypeCredit:      "credit",
+		entity.TypeCommit:      "commit",
+		entity.TypeAck:         "ack",
+		entity.TypeNack:        "nack",
 	}
 	log.Printf("received command type=%s \n", commandNames[c.Type])
 
 	switch c.Type {
 	case entity.TypePublish:
 		var message entity.Message
-		if err := json.Unmarshal([]byte(c.Body), &message); err != nil {
+		if c.Message != nil {
+			message = *c.Message
+		} else if err := json.Unmarshal([]byte(c.Body), &message); err != nil {
+			return entity.NewError(entity.ErrCodeInvalidRequest, fmt.Errorf("invalid message: %w", err))
+		}
+		partitions, err := logs.Topic(c.Topic)
+		if err != nil {
 			return err
 		}
-		return usecases.Publish(c.Connection, message, c.Topic, path)
+		partition := partitioner.Partition(message.Key, len(partitions))
+		if c.Partition != nil {
+			partition = *c.Partition
+		}
+		topicLog, err := logs.Partition(c.Topic, partition)
+		if err != nil {
+			return err
+		}
+		// publishes wait for their fsync aside, so the worker keeps serving
+		// its other connections and their publishes are synced together
+		go func() {
+			if err := usecases.Publish(c, partition, message, topicLog); err != nil {
+				log.Printf("error on publishing: %s", err)
+				if err = usecases.ReplyError(c, err); err != nil {
+					log.Printf("unable to reply error: %s\n", err)
+				}
+			}
+		}()
+		return nil
 	case entity.TypeConsume:
-		consumer, err := entity.NewConsumer(c.ConsumerName, c.Connection, c.Topic, path)
+		if err := checkOffsetReset(c.OffsetReset); err != nil {
+			return err
+		}
+		partitions, err := logs.Topic(c.Topic)
+		if err != nil {
+			return err
+		}
+		if c.Queue {
+			return joinQueue(c, partitions)
+		}
+		return joinGroup(c, partitions)
+	case entity.TypeMetadata:
+		partitions, err := logs.Topic(c.Topic)
+		if err != nil {
+			return err
+		}
+		return usecases.Metadata(c, len(partitions))
+	case entity.TypeApiVersions:
+		return usecases.ApiVersions(c, protocol.Versions)
+	case entity.TypeFetch:
+		partition := 0
+		if c.Partition != nil {
+			partition = *c.Partition
+		}
+		topicLog, err := logs.Partition(c.Topic, partition)
 		if err != nil {
 			return err
 		}
-		consumers[consumer.FileName()] = consumer
-		go consumer.Start()
+		if c.MaxWait > maxFetchWait.Milliseconds() {
+			c.MaxWait = maxFetchWait.Milliseconds()
+		}
+		// long polls wait aside, so the worker keeps serving its other
+		// connections
+		go func() {
+			if err := usecases.Fetch(c, partition, topicLog); err != nil {
+				log.Printf("error on fetching: %s", err)
+				if err = usecases.ReplyError(c, err); err != nil {
+					log.Printf("unable to reply error: %s\n", err)
+				}
+			}
+		}()
+		return nil
+	case entity.TypeCredit:
+		grantCredit(c)
 		return nil
+	case entity.TypeCommit:
+		return commitOffset(c)
+	case entity.TypeAck, entity.TypeNack:
+		return ackMessage(c)
 	case entity.TypeClose:
 		closeConsumer(c.Connection)
 		return nil
 	}
 
-	return fmt.Errorf("no expected command type: %d\n", c.Type)
+	return entity.NewError(entity.ErrCodeInvalidRequest, fmt.Errorf("no expected command type: %d", c.Type))
+}
+
+func checkOffsetReset(policy string) error {
+	switch policy {
+	case "", entity.OffsetResetEarliest, entity.OffsetResetLatest, entity.OffsetResetError:
+		return nil
+	}
+	return entity.NewError(entity.ErrCodeInvalidRequest, fmt.Errorf("unknown offset reset policy: %s", policy))
+}
+
+// joinGroup adds the connection of a consume command to the group named by
+// the command, creating the group on first use.
+func joinGroup(c entity.Command, partitions []entity.Log) error {
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+
+	key := c.ConsumerName + "." + c.Topic
+	if _, ok := queues[key]; ok {
+		return entity.NewError(entity.ErrCodeInvalidRequest, fmt.Errorf("group %s of %s consumes as a queue", c.ConsumerName, c.Topic))
+	}
+	group, ok := groups[key]
+	if !ok {
+		var err error
+		if group, err = entity.NewGroup(c.ConsumerName, c.Topic, c.Assignment, logs); err != nil {
+			return err
+		}
+	} else if c.Assignment != "" && c.Assignment != group.Strategy {
+		err := fmt.Errorf("group %s uses the %s assignment strategy, not %s", c.ConsumerName, group.Strategy, c.Assignment)
+		return entity.NewError(entity.ErrCodeInconsistentGroupProtocol, err)
+	}
+	// acknowledge before joining, so the reply precedes the first message
+	if err := usecases.Subscribed(c); err != nil {
+		return err
+	}
+	groups[key] = group
+	group.Join(c, partitions)
+	return nil
+}
+
+// joinQueue adds the connection of a consume command to the queue named by
+// the command, creating the queue on first use.
+func joinQueue(c entity.Command, partitions []entity.Log) error {
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+
+	key := c.ConsumerName + "." + c.Topic
+	if _, ok := groups[key]; ok {
+		return entity.NewError(entity.ErrCodeInvalidRequest, fmt.Errorf("group %s of %s does not consume as a queue", c.ConsumerName, c.Topic))
+	}
+	queue, ok := queues[key]
+	if !ok {
+		queue = entity.NewQueue(c.ConsumerName, c.Topic, logs)
+	}
+	if err := usecases.Subscribed(c); err != nil {
+		return err
+	}
+	queues[key] = queue
+	return queue.Join(c, partitions)
+}
+
+// grantCredit gives the credit of a credit command to the group member
+// subscribed by the consume command of its connection and correlation id.
+// Credit commands get no response, so unknown subscriptions are only logged.
+func grantCredit(c entity.Command) {
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+
+	for _, group := range groups {
+		if group.Grant(c.Connection, c.CorrelationID, c.Credit) {
+			return
+		}
+	}
+	log.Printf("no subscription %d to grant credit to\n", c.CorrelationID)
+}
+
+// commitOffset stores the offset of a commit command for the partition of
+// its group assigned to the connection, and acknowledges it. Commands without
+// connection, from the HTTP gateway, commit for the group whether or not it
+// has members.
+func commitOffset(c entity.Command) error {
+	if c.Partition == nil {
+		return entity.NewError(entity.ErrCodeInvalidRequest, errors.New("commit command without partition"))
+	}
+	key := c.ConsumerName + "." + c.Topic
+	groupsMu.Lock()
+	group, ok := groups[key]
+	if _, queue := queues[key]; queue && c.Connection == nil {
+		groupsMu.Unlock()
+		return entity.NewError(entity.ErrCodeInvalidRequest, fmt.Errorf("group %s of %s consumes as a queue", c.ConsumerName, c.Topic))
+	}
+	if !ok && c.Connection == nil {
+		// stored under groupsMu, so a member joining meanwhile resumes from it
+		err := entity.StoreOffset(logs, c.ConsumerName, c.Topic, *c.Partition, c.Offset)
+		groupsMu.Unlock()
+		if err != nil {
+			return err
+		}
+		return usecases.Committed(c, *c.Partition)
+	}
+	groupsMu.Unlock()
+	if !ok {
+		err := fmt.Errorf("connection is not a member of group %s of %s", c.ConsumerName, c.Topic)
+		return entity.NewError(entity.ErrCodeNotAssigned, err)
+	}
+	if err := group.Commit(c.Connection, *c.Partition, c.Offset); err != nil {
+		return err
+	}
+	return usecases.Committed(c, *c.Partition)
+}
+
+// loadOffset returns the offset a consumer group resumes a partition from,
+// the one of its consumer when a member reads the partition.
+func loadOffset(name, topic string, partition int) (uint, error) {
+	groupsMu.Lock()
+	group, ok := groups[name+"."+topic]
+	groupsMu.Unlock()
+	if ok {
+		return group.Offset(partition)
+	}
+	return entity.LoadOffset(logs, name, topic, partition)
+}
+
+// ackMessage acks or nacks the message of an ack or nack command delivered
+// to the connection by its queue, and acknowledges the command.
+func ackMessage(c entity.Command) error {
+	if c.Partition == nil {
+		return entity.NewError(entity.ErrCodeInvalidRequest, errors.New("ack command without partition"))
+	}
+	groupsMu.Lock()
+	queue, ok := queues[c.ConsumerName+"."+c.Topic]
+	groupsMu.Unlock()
+	if !ok {
+		err := fmt.Errorf("connection is not a member of queue %s of %s", c.ConsumerName, c.Topic)
+		return entity.NewError(entity.ErrCodeNotAssigned, err)
+	}
+	var err error
+	if c.Type == entity.TypeNack {
+		err = queue.Nack(c.Connection, *c.Partition, c.Offset, c.Reason)
+	} else {
+		err = queue.Ack(c.Connection, *c.Partition, c.Offset)
+	}
+	if err != nil {
+		return err
+	}
+	return usecases.Acked(c, *c.Partition)
 }
 
+// closeConsumer removes the connection from the groups and queues it is a
+// member of.
 func closeConsumer(conn net.Conn) {
-	for key, consumer := range consumers {
-		if consumer.Conn == conn {
-			consumer.Close()
-			delete(consumers, key)
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+
+	for key, group := range groups {
+		if !group.Leave(conn) {
+			go retireGroup(key, group)
+		}
+	}
+	for key, queue := range queues {
+		if !queue.Leave(conn) {
+			delete(queues, key)
 		}
 	}
 }
 
+// retireGroup removes a group left by every member once its consumers stored
+// their offsets, so a member joining meanwhile resumes from them.
+func retireGroup(key string, group *entity.Group) {
+	group.Wait()
+
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	if groups[key] == group && group.Empty() {
+		delete(groups, key)
+	}
+}
+
 func softError(err error) bool {
 	if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
 		return true
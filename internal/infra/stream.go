@@ -0,0 +1,155 @@
+package infra
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/usecases"
+	"github.com/rafaelmgr12/kafka-clone/internal/protocol"
+)
+
+// streamOffsets is the position of a stream reading a partition from an
+// explicit offset, which is not stored.
+type streamOffsets struct{}
+
+func (streamOffsets) Load() (uint64, error) { return 0, nil }
+func (streamOffsets) Store(uint64) error    { return nil }
+func (streamOffsets) Close() error          { return nil }
+
+// streamHTTP streams the messages of a topic as server-sent events, or over
+// a WebSocket when the request upgrades to it, every event holding the
+// response a consume command gets. With a consumer name the stream joins its
+// consumer group as a consume command does and leaves it once the client
+// goes away; otherwise it reads a partition from an offset or timestamp.
+func streamHTTP(w http.ResponseWriter, r *http.Request, topic string) {
+	query := r.URL.Query()
+	c := entity.Command{
+		Type:         entity.TypeConsume,
+		Topic:        topic,
+		ConsumerName: query.Get("consumer"),
+		OffsetReset:  query.Get("offset_reset"),
+	}
+	partition, err := queryInt(query.Get("partition"), 0)
+	if err != nil {
+		writeHTTPError(w, topic, err)
+		return
+	}
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil {
+		writeHTTPError(w, topic, err)
+		return
+	}
+	if value := query.Get("timestamp"); value != "" {
+		if c.Timestamp, err = strconv.ParseInt(value, 10, 64); err != nil {
+			writeHTTPError(w, topic, entity.NewError(entity.ErrCodeInvalidRequest, fmt.Errorf("invalid timestamp: %q", value)))
+			return
+		}
+	}
+	if err = checkOffsetReset(c.OffsetReset); err != nil {
+		writeHTTPError(w, topic, err)
+		return
+	}
+	var topicLog entity.Log
+	if c.ConsumerName == "" {
+		if topicLog, err = logs.Partition(topic, partition); err != nil {
+			writeHTTPError(w, topic, err)
+			return
+		}
+		if c.Timestamp > 0 {
+			start, err := topicLog.OffsetForTime(c.Timestamp)
+			if err != nil {
+				writeHTTPError(w, topic, fmt.Errorf("cannot find offset for timestamp: %w", err))
+				return
+			}
+			offset = int(start)
+		}
+	}
+	websocket := strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if websocket && key == "" {
+		writeHTTPError(w, topic, entity.NewError(entity.ErrCodeInvalidRequest, errors.New("missing Sec-WebSocket-Key header")))
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeHTTPError(w, topic, errors.New("connection cannot be streamed"))
+		return
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("unable to stream http connection: %s\n", err)
+		return
+	}
+	defer conn.Close()
+
+	var wait func() error
+	if websocket {
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		buf.WriteString("Sec-WebSocket-Accept: " + protocol.WebSocketAccept(key) + "\r\n\r\n")
+		ws := protocol.NewWebSocket(buf.Reader, conn)
+		c.Writer, wait = ws, ws.Wait
+	} else {
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nCache-Control: no-cache\r\nConnection: close\r\n\r\n")
+		c.Writer = protocol.EventStream(conn)
+		wait = func() error {
+			_, err := io.Copy(io.Discard, buf.Reader)
+			return err
+		}
+	}
+	if err = buf.Flush(); err != nil {
+		log.Printf("unable to stream http connection: %s\n", err)
+		return
+	}
+	c.Connection = conn
+
+	// the stream ends when the client goes away or the server stops
+	go func() {
+		<-r.Context().Done()
+		conn.Close()
+	}()
+	if c.ConsumerName != "" {
+		if err = routeCommand(c); err != nil {
+			log.Printf("error on routing command: %s", err)
+			if err = usecases.ReplyError(c, err); err != nil {
+				log.Printf("unable to reply error: %s\n", err)
+			}
+			return
+		}
+		defer routeCommand(entity.Command{Type: entity.TypeClose, Connection: conn})
+	} else {
+		if err = usecases.Subscribed(c); err != nil {
+			return
+		}
+		consumer := streamConsumer(c, partition, topicLog, uint64(offset))
+		go consumer.Start()
+		defer consumer.Stop()
+	}
+	if err = wait(); err != nil && err != io.EOF && !closedConnection(err) {
+		log.Printf("unable to read http stream: %s\n", err)
+	}
+}
+
+// streamConsumer reads a partition from offset for a stream without consumer
+// group.
+func streamConsumer(c entity.Command, partition int, topicLog entity.Log, offset uint64) entity.Consumer {
+	return entity.Consumer{
+		ID:          fmt.Sprintf("stream.%s-%d", c.Topic, partition),
+		Log:         topicLog,
+		Reader:      topicLog.Reader(offset),
+		Topic:       c.Topic,
+		Partition:   partition,
+		Conn:        c.Connection,
+		OffsetReset: c.OffsetReset,
+		Writer:      c.Writer,
+		Offsets:     streamOffsets{},
+		Meta:        &entity.MetaConsumer{Offset: uint(offset)},
+		Done:        make(chan struct{}, 1),
+		Stopped:     make(chan struct{}),
+	}
+}
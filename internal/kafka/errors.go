@@ -0,0 +1,70 @@
+package kafka
+
+import (
+	"errors"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// Kafka error codes replied.
+const (
+	codeUnknownServerError       = -1
+	codeNone                     = 0
+	codeOffsetOutOfRange         = 1
+	codeCorruptMessage           = 2
+	codeUnknownTopicOrPartition  = 3
+	codeNotLeaderForPartition    = 6
+	codeMessageTooLarge          = 10
+	codeInvalidTopic             = 17
+	codeInvalidRequiredAcks      = 21
+	codeTopicAuthorizationFailed = 29
+	codeUnsupportedVersion       = 35
+	codeInvalidRequest           = 42
+	codeKafkaStorageError        = 56
+	codeUnsupportedCompression   = 76
+	codeInvalidRecord            = 87
+)
+
+// errInvalidAcks is returned to producers asking for acks other than -1, 0
+// or 1.
+var errInvalidAcks = errors.New("acks must be -1, 0 or 1")
+
+// errorCode returns the Kafka error code of err, codeNone when it is nil.
+func errorCode(err error) int16 {
+	if err == nil {
+		return codeNone
+	}
+	switch {
+	case errors.Is(err, errCorruptBatch):
+		return codeCorruptMessage
+	case errors.Is(err, errUnsupportedCompression):
+		return codeUnsupportedCompression
+	case errors.Is(err, errInvalidAcks):
+		return codeInvalidRequiredAcks
+	}
+	switch entity.ErrorCodeOf(err) {
+	case entity.ErrCodeInvalidRequest:
+		return codeInvalidRequest
+	case entity.ErrCodeUnsupportedVersion:
+		return codeUnsupportedVersion
+	case entity.ErrCodeInvalidTopic:
+		return codeInvalidTopic
+	case entity.ErrCodeUnknownTopic:
+		return codeUnknownTopicOrPartition
+	case entity.ErrCodeOffsetOutOfRange:
+		return codeOffsetOutOfRange
+	case entity.ErrCodeCorruptMessage:
+		return codeCorruptMessage
+	case entity.ErrCodeMessageTooLarge:
+		return codeMessageTooLarge
+	case entity.ErrCodeInvalidRecord:
+		return codeInvalidRecord
+	case entity.ErrCodeStorage:
+		return codeKafkaStorageError
+	case entity.ErrCodeNotLeader:
+		return codeNotLeaderForPartition
+	case entity.ErrCodeAuthorizationFailed:
+		return codeTopicAuthorizationFailed
+	}
+	return codeUnknownServerError
+}
@@ -0,0 +1,270 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+type fetchTopic struct {
+	name       string
+	partitions []fetchPartition
+}
+
+type fetchPartition struct {
+	index    int32
+	offset   int64
+	maxBytes int32
+
+	err           error
+	highWatermark int64
+	startOffset   int64
+	records       []byte
+}
+
+// fetch reads the records of every partition from the requested offsets.
+// Fetch sessions are not kept: every request is answered in full, with a
+// session id of zero.
+func (s *Server) fetch(req request, e *encoder) {
+	d := &req.body
+	d.int32()
+	maxWait := time.Duration(d.int32()) * time.Millisecond
+	d.int32()
+	maxBytes := d.int32()
+	d.int8()
+	if req.version >= 7 {
+		d.int32()
+		d.int32()
+	}
+	topics := make([]fetchTopic, d.arrayLength())
+	for i := range topics {
+		topics[i].name = d.string()
+		topics[i].partitions = make([]fetchPartition, d.arrayLength())
+		for j := range topics[i].partitions {
+			p := &topics[i].partitions[j]
+			p.index = d.int32()
+			if req.version >= 9 {
+				d.int32()
+			}
+			p.offset = d.int64()
+			if req.version >= 5 {
+				d.int64()
+			}
+			p.maxBytes = d.int32()
+		}
+	}
+	if req.version >= 7 {
+		for i, n := 0, d.arrayLength(); i < n; i++ {
+			d.string()
+			for j, m := 0, d.arrayLength(); j < m; j++ {
+				d.int32()
+			}
+		}
+	}
+	if req.version >= 11 {
+		d.string()
+	}
+	if d.err != nil {
+		return
+	}
+
+	// wait until a partition has records past its offset or fails
+	if appended, ok := s.readable(topics); !ok && maxWait > 0 {
+		waitAppended(appended, maxWait)
+	}
+	budget := int(maxBytes)
+	for i := range topics {
+		for j := range topics[i].partitions {
+			s.read(topics[i].name, &topics[i].partitions[j], &budget)
+		}
+	}
+
+	e.int32(0)
+	if req.version >= 7 {
+		e.int16(codeNone)
+		e.int32(0)
+	}
+	e.arrayLength(len(topics))
+	for _, topic := range topics {
+		e.string(topic.name)
+		e.arrayLength(len(topic.partitions))
+		for _, p := range topic.partitions {
+			e.int32(p.index)
+			e.int16(errorCode(p.err))
+			e.int64(p.highWatermark)
+			e.int64(p.highWatermark)
+			if req.version >= 5 {
+				e.int64(p.startOffset)
+			}
+			e.arrayLength(-1)
+			if req.version >= 11 {
+				e.int32(-1)
+			}
+			e.bytes(p.records)
+		}
+	}
+}
+
+// readable reports whether a fetch of topics would return records or errors
+// right away. When it would not, it returns the channels closed on the next
+// append to each partition.
+func (s *Server) readable(topics []fetchTopic) ([]<-chan struct{}, bool) {
+	var appended []<-chan struct{}
+	for _, topic := range topics {
+		for _, p := range topic.partitions {
+			log, err := s.Storage.Partition(topic.name, int(p.index))
+			if err != nil {
+				return nil, true
+			}
+			wait := log.Appended()
+			if p.offset < int64(log.StartOffset()) || p.offset != int64(log.NextOffset()) {
+				return nil, true
+			}
+			appended = append(appended, wait)
+		}
+	}
+	return appended, false
+}
+
+// waitAppended blocks until one of the appended channels is closed or the
+// timeout elapses.
+func waitAppended(appended []<-chan struct{}, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	wake := make(chan struct{}, len(appended))
+	done := make(chan struct{})
+	defer close(done)
+	for _, wait := range appended {
+		go func(wait <-chan struct{}) {
+			select {
+			case <-wait:
+				wake <- struct{}{}
+			case <-done:
+			}
+		}(wait)
+	}
+	select {
+	case <-wake:
+	case <-timer.C:
+	}
+}
+
+// read encodes the records of partition p from its offset, up to its maximum
+// bytes and the budget left for the whole response. The first record is
+// returned whatever its size, so consumers make progress.
+func (s *Server) read(topic string, p *fetchPartition, budget *int) {
+	p.highWatermark, p.startOffset = -1, -1
+	p.records = []byte{}
+	log, err := s.Storage.Partition(topic, int(p.index))
+	if err != nil {
+		p.err = err
+		return
+	}
+	p.highWatermark, p.startOffset = int64(log.NextOffset()), int64(log.StartOffset())
+	if p.offset < p.startOffset || p.offset > p.highWatermark {
+		p.err = fmt.Errorf("%w: %d", entity.ErrOffsetOutOfRange, p.offset)
+		return
+	}
+
+	reader := log.Reader(uint64(p.offset))
+	var records []entity.Record
+	size := 0
+	for size < int(p.maxBytes) && size < *budget {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if len(records) == 0 {
+				p.err = err
+			}
+			break
+		}
+		recordSize := 32 + len(rec.Key) + len(rec.Value)
+		for key, value := range rec.Headers {
+			recordSize += len(key) + len(value)
+		}
+		if len(records) > 0 && (size+recordSize > int(p.maxBytes) || size+recordSize > *budget) {
+			break
+		}
+		records = append(records, rec)
+		size += recordSize
+	}
+	if errors.Is(p.err, entity.ErrOffsetOutOfRange) || len(records) == 0 {
+		return
+	}
+	p.records = encodeBatch(records)
+	*budget -= len(p.records)
+}
+
+// listOffsets returns the earliest or latest offset of every partition, or
+// the first offset appended at or after a timestamp.
+func (s *Server) listOffsets(req request, e *encoder) {
+	const (
+		latest   = -1
+		earliest = -2
+	)
+	d := &req.body
+	d.int32()
+	if req.version >= 2 {
+		d.int8()
+		e.int32(0)
+	}
+	topics := d.arrayLength()
+	e.arrayLength(topics)
+	for i := 0; i < topics && d.err == nil; i++ {
+		topic := d.string()
+		e.string(topic)
+		partitions := d.arrayLength()
+		e.arrayLength(partitions)
+		for j := 0; j < partitions && d.err == nil; j++ {
+			partition := d.int32()
+			if req.version >= 4 {
+				d.int32()
+			}
+			timestamp := d.int64()
+
+			offset := int64(-1)
+			found := int64(-1)
+			log, err := s.Storage.Partition(topic, int(partition))
+			if err == nil {
+				switch timestamp {
+				case latest:
+					offset = int64(log.NextOffset())
+				case earliest:
+					offset = int64(log.StartOffset())
+				default:
+					offset, found, err = offsetForTime(log, timestamp)
+				}
+			}
+
+			e.int32(partition)
+			e.int16(errorCode(err))
+			e.int64(found)
+			e.int64(offset)
+			if req.version >= 4 {
+				e.int32(0)
+			}
+		}
+	}
+}
+
+// offsetForTime returns the offset and timestamp of the first record of log
+// appended at or after timestamp, -1 for both when there is none.
+func offsetForTime(log entity.Log, timestamp int64) (int64, int64, error) {
+	offset, err := log.OffsetForTime(timestamp)
+	if err != nil {
+		return -1, -1, err
+	}
+	rec, err := log.Reader(offset).Next()
+	if err == io.EOF {
+		return -1, -1, nil
+	}
+	if err != nil {
+		return -1, -1, err
+	}
+	return int64(rec.Offset), rec.Timestamp, nil
+}
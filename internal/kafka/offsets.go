@@ -0,0 +1,115 @@
+package kafka
+
+import (
+	"fmt"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// offsetCommit stores the offsets of a consumer group, shared with the
+// groups of the broker protocol. Generations and members are not checked, as
+// there is no group membership.
+func (s *Server) offsetCommit(req request, e *encoder) {
+	d := &req.body
+	group := d.string()
+	d.int32()
+	d.string()
+	if req.version >= 7 {
+		d.nullableString()
+	}
+	if req.version <= 4 {
+		d.int64()
+	}
+	if req.version >= 3 {
+		e.int32(0)
+	}
+	topics := d.arrayLength()
+	e.arrayLength(topics)
+	for i := 0; i < topics && d.err == nil; i++ {
+		topic := d.string()
+		e.string(topic)
+		partitions := d.arrayLength()
+		e.arrayLength(partitions)
+		for j := 0; j < partitions && d.err == nil; j++ {
+			partition := d.int32()
+			offset := d.int64()
+			if req.version >= 6 {
+				d.int32()
+			}
+			d.nullableString()
+
+			e.int32(partition)
+			e.int16(errorCode(s.storeOffset(group, topic, int(partition), offset)))
+		}
+	}
+}
+
+func (s *Server) storeOffset(group, topic string, partition int, offset int64) error {
+	if offset < 0 {
+		return fmt.Errorf("%w: %d", entity.ErrOffsetOutOfRange, offset)
+	}
+	if _, err := s.Storage.Partition(topic, partition); err != nil {
+		return err
+	}
+	offsets, err := s.Storage.Offsets(group, topic, partition)
+	if err != nil {
+		return err
+	}
+	defer offsets.Close()
+	return offsets.Store(uint64(offset))
+}
+
+// offsetFetch returns the offsets of a consumer group. Listing every offset
+// of a group, with a null topic array, is not supported and returns none.
+func (s *Server) offsetFetch(req request, e *encoder) {
+	d := &req.body
+	group := d.string()
+	if req.version >= 3 {
+		e.int32(0)
+	}
+	topics := d.arrayLength()
+	if topics < 0 {
+		topics = 0
+	}
+	e.arrayLength(topics)
+	for i := 0; i < topics && d.err == nil; i++ {
+		topic := d.string()
+		e.string(topic)
+		partitions := d.arrayLength()
+		e.arrayLength(partitions)
+		for j := 0; j < partitions && d.err == nil; j++ {
+			partition := d.int32()
+			offset, err := s.loadOffset(group, topic, int(partition))
+
+			e.int32(partition)
+			e.int64(offset)
+			if req.version >= 5 {
+				e.int32(-1)
+			}
+			e.nullableString(nil)
+			e.int16(errorCode(err))
+		}
+	}
+	if req.version >= 2 {
+		e.int16(codeNone)
+	}
+}
+
+// loadOffset returns the stored offset of a group partition. Groups that
+// have not stored an offset yet, or stored zero, get -1 so clients apply
+// their offset reset policy.
+func (s *Server) loadOffset(group, topic string, partition int) (int64, error) {
+	if _, err := s.Storage.Partition(topic, partition); err != nil {
+		return -1, err
+	}
+	offsets, err := s.Storage.Offsets(group, topic, partition)
+	if err != nil {
+		return -1, err
+	}
+	defer offsets.Close()
+	offset, err := offsets.Load()
+	if err != nil || offset == 0 {
+		return -1, err
+	}
+	return int64(offset), nil
+}
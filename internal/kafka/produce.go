@@ -0,0 +1,73 @@
+package kafka
+
+import "fmt"
+
+// produce appends the records of every partition and encodes the response,
+// reporting whether there is one: producers sending acks=0 expect none.
+func (s *Server) produce(req request, e *encoder) bool {
+	d := &req.body
+	d.nullableString()
+	acks := d.int16()
+	d.int32()
+
+	topics := d.arrayLength()
+	e.arrayLength(topics)
+	for i := 0; i < topics && d.err == nil; i++ {
+		topic := d.string()
+		e.string(topic)
+		partitions := d.arrayLength()
+		e.arrayLength(partitions)
+		for j := 0; j < partitions && d.err == nil; j++ {
+			partition := d.int32()
+			raw := d.bytes()
+
+			offset, timestamp, startOffset := int64(-1), int64(-1), int64(-1)
+			err := fmt.Errorf("%w: %d", errInvalidAcks, acks)
+			if acks >= -1 && acks <= 1 {
+				offset, timestamp, startOffset, err = s.append(topic, int(partition), raw)
+			}
+
+			e.int32(partition)
+			e.int16(errorCode(err))
+			e.int64(offset)
+			e.int64(timestamp)
+			if req.version >= 5 {
+				e.int64(startOffset)
+			}
+			if req.version >= 8 {
+				e.arrayLength(0)
+				if err != nil {
+					message := err.Error()
+					e.nullableString(&message)
+				} else {
+					e.nullableString(nil)
+				}
+			}
+		}
+	}
+	e.int32(0)
+	return acks != 0
+}
+
+// append stores the records of raw in a partition, returning the offset of
+// the first one, the time they were appended at and the start offset of the
+// partition.
+func (s *Server) append(topic string, partition int, raw []byte) (int64, int64, int64, error) {
+	records, err := decodeBatches(raw)
+	if err != nil {
+		return -1, -1, -1, err
+	}
+	log, err := s.Storage.Partition(topic, partition)
+	if err != nil {
+		return -1, -1, -1, err
+	}
+	if len(records) == 0 {
+		next := int64(log.NextOffset())
+		return next, -1, int64(log.StartOffset()), nil
+	}
+	stamped, err := log.Append(records...)
+	if err != nil {
+		return -1, -1, -1, err
+	}
+	return int64(stamped[0].Offset), stamped[0].Timestamp, int64(log.StartOffset()), nil
+}
@@ -0,0 +1,168 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// Records are exchanged in record batches of magic 2, the only format of
+// the protocol versions served:
+//
+//	batch:  baseOffset int64 | batchLength int32 | partitionLeaderEpoch int32 |
+//	        magic int8 | crc uint32 | attributes int16 | lastOffsetDelta int32 |
+//	        baseTimestamp int64 | maxTimestamp int64 | producerId int64 |
+//	        producerEpoch int16 | baseSequence int32 | recordCount int32 | records
+//	record: length varint | attributes int8 | timestampDelta varint |
+//	        offsetDelta varint | key varbytes | value varbytes |
+//	        headerCount varint | (key varbytes | value varbytes)...
+//
+// The CRC32C covers everything after it. Varints are zigzag encoded.
+const (
+	batchMagic = 2
+	// batchOverhead is the size of a batch header up to its records count,
+	// batchCRCStart where the checked bytes start.
+	batchOverhead = 61
+	batchCRCStart = 21
+
+	compressionMask = 0x07
+	compressionGzip = 1
+	controlFlag     = 0x20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	errUnsupportedCompression = errors.New("unsupported compression type")
+	errCorruptBatch           = errors.New("corrupt record batch")
+)
+
+// encodeBatch encodes records, sorted by offset, in a single batch. Offsets
+// may have gaps, as in compacted logs.
+func encodeBatch(records []entity.Record) []byte {
+	first, last := records[0], records[len(records)-1]
+	maxTimestamp := first.Timestamp
+	for _, rec := range records {
+		if rec.Timestamp > maxTimestamp {
+			maxTimestamp = rec.Timestamp
+		}
+	}
+
+	e := encoder{buf: make([]byte, 0, batchOverhead+64*len(records))}
+	e.int64(int64(first.Offset))
+	e.int32(0) // batch length
+	e.int32(-1)
+	e.int8(batchMagic)
+	e.int32(0) // crc
+	e.int16(0)
+	e.int32(int32(last.Offset - first.Offset))
+	e.int64(first.Timestamp)
+	e.int64(maxTimestamp)
+	e.int64(-1)
+	e.int16(-1)
+	e.int32(-1)
+	e.int32(int32(len(records)))
+
+	var record []byte
+	for _, rec := range records {
+		record = record[:0]
+		record = append(record, 0)
+		record = binary.AppendVarint(record, rec.Timestamp-first.Timestamp)
+		record = binary.AppendVarint(record, int64(rec.Offset-first.Offset))
+		record = appendVarBytes(record, rec.Key)
+		record = appendVarBytes(record, rec.Value)
+		record = binary.AppendVarint(record, int64(len(rec.Headers)))
+		for key, value := range rec.Headers {
+			record = appendVarBytes(record, []byte(key))
+			record = appendVarBytes(record, []byte(value))
+		}
+		e.buf = binary.AppendVarint(e.buf, int64(len(record)))
+		e.buf = append(e.buf, record...)
+	}
+
+	binary.BigEndian.PutUint32(e.buf[8:], uint32(len(e.buf)-12))
+	binary.BigEndian.PutUint32(e.buf[17:], crc32.Checksum(e.buf[batchCRCStart:], crcTable))
+	return e.buf
+}
+
+// decodeBatches decodes the records of the batches in raw, skipping control
+// batches. Their offsets and timestamps are left to the log to assign.
+func decodeBatches(raw []byte) ([]entity.Record, error) {
+	var records []entity.Record
+	for len(raw) > 0 {
+		if len(raw) < batchOverhead {
+			return nil, errCorruptBatch
+		}
+		length := int(int32(binary.BigEndian.Uint32(raw[8:])))
+		if length < batchOverhead-12 || 12+length > len(raw) {
+			return nil, errCorruptBatch
+		}
+		batch := raw[:12+length]
+		raw = raw[12+length:]
+
+		if batch[16] != batchMagic {
+			return nil, fmt.Errorf("%w: unsupported magic %d", errCorruptBatch, batch[16])
+		}
+		if crc32.Checksum(batch[batchCRCStart:], crcTable) != binary.BigEndian.Uint32(batch[17:]) {
+			return nil, fmt.Errorf("%w: checksum mismatch", errCorruptBatch)
+		}
+		attributes := binary.BigEndian.Uint16(batch[21:])
+		if attributes&controlFlag != 0 {
+			continue
+		}
+		count := int(int32(binary.BigEndian.Uint32(batch[57:])))
+		body := batch[batchOverhead:]
+		switch attributes & compressionMask {
+		case 0:
+		case compressionGzip:
+			reader, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s", errCorruptBatch, err)
+			}
+			if body, err = io.ReadAll(reader); err != nil {
+				return nil, fmt.Errorf("%w: %s", errCorruptBatch, err)
+			}
+		default:
+			return nil, errUnsupportedCompression
+		}
+
+		d := decoder{data: body}
+		for i := 0; i < count && d.err == nil; i++ {
+			length := d.varint()
+			r := decoder{data: d.next(int(length))}
+			r.int8()
+			r.varint()
+			r.varint()
+			rec := entity.Record{Key: r.varBytes(), Value: r.varBytes()}
+			if headers := r.varint(); headers > 0 {
+				rec.Headers = make(map[string]string)
+				for j := int64(0); j < headers && r.err == nil; j++ {
+					key := r.varBytes()
+					rec.Headers[string(key)] = string(r.varBytes())
+				}
+			}
+			if r.err != nil {
+				d.err = r.err
+			}
+			records = append(records, rec)
+		}
+		if d.err != nil {
+			return nil, fmt.Errorf("%w: %s", errCorruptBatch, d.err)
+		}
+	}
+	return records, nil
+}
+
+func appendVarBytes(raw, b []byte) []byte {
+	if b == nil {
+		return binary.AppendVarint(raw, -1)
+	}
+	raw = binary.AppendVarint(raw, int64(len(b)))
+	return append(raw, b...)
+}
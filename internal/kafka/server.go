@@ -0,0 +1,325 @@
+// Package kafka serves a subset of the Kafka wire protocol over the broker
+// storage, so off-the-shelf Kafka clients can publish and consume in local
+// and test environments. The broker presents itself as a single node
+// cluster leading every partition. Only the non-flexible versions of
+// ApiVersions, Metadata, Produce, Fetch, ListOffsets, OffsetCommit,
+// OffsetFetch and FindCoordinator are served: consumers assign their
+// partitions themselves, as there is no group membership, idempotent or
+// transactional producing.
+package kafka
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// Api keys of the requests served.
+const (
+	apiProduce         = 0
+	apiFetch           = 1
+	apiListOffsets     = 2
+	apiMetadata        = 3
+	apiOffsetCommit    = 8
+	apiOffsetFetch     = 9
+	apiFindCoordinator = 10
+	apiVersions        = 18
+)
+
+// apiVersion is the range of versions of a request served.
+type apiVersion struct {
+	key      int16
+	min, max int16
+}
+
+// versions are the requests served, up to their last version before flexible
+// encoding.
+var versions = []apiVersion{
+	{apiProduce, 3, 8},
+	{apiFetch, 4, 11},
+	{apiListOffsets, 1, 5},
+	{apiMetadata, 0, 8},
+	{apiOffsetCommit, 2, 7},
+	{apiOffsetFetch, 1, 5},
+	{apiFindCoordinator, 0, 2},
+	{apiVersions, 0, 2},
+}
+
+// maxRequestSize bounds the requests read, as Kafka brokers do with
+// socket.request.max.bytes.
+const maxRequestSize = 100 << 20
+
+// nodeID is the id of the single broker of the cluster.
+const nodeID = 0
+
+// Server answers Kafka requests with the topics and offsets of Storage,
+// advertising itself at Host and Port.
+type Server struct {
+	Storage entity.Storage
+	Host    string
+	Port    int32
+}
+
+// request is a decoded request header with the rest of the request.
+type request struct {
+	key           int16
+	version       int16
+	correlationID int32
+	clientID      *string
+	body          decoder
+}
+
+// Serve accepts connections on listen until stop is closed.
+func (s *Server) Serve(listen *net.TCPListener, stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		listen.SetDeadline(time.Now().Add(200 * time.Millisecond))
+		conn, err := listen.AcceptTCP()
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+				continue
+			}
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
+			}
+			log.Printf("unable to accept kafka connection: %s\n", err)
+			continue
+		}
+		go s.handleConnection(conn, stop)
+	}
+}
+
+// handleConnection answers the requests of conn one after the other, so
+// responses are sent in the order of their requests as clients expect.
+func (s *Server) handleConnection(conn net.Conn, stop chan bool) {
+	done := make(chan struct{})
+	defer close(done)
+	defer conn.Close()
+	go func() {
+		select {
+		case <-stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(reader, size[:]); err != nil {
+			return
+		}
+		n := int32(binary.BigEndian.Uint32(size[:]))
+		if n < 8 || n > maxRequestSize {
+			log.Printf("kafka: invalid request size %d from %s\n", n, conn.RemoteAddr())
+			return
+		}
+		raw := make([]byte, n)
+		if _, err := io.ReadFull(reader, raw); err != nil {
+			return
+		}
+
+		d := decoder{data: raw}
+		req := request{key: d.int16(), version: d.int16(), correlationID: d.int32()}
+		req.clientID = d.nullableString()
+		req.body = d
+
+		body, err := s.handle(req)
+		if err != nil {
+			log.Printf("kafka: cannot handle request %d v%d: %s\n", req.key, req.version, err)
+			return
+		}
+		if body == nil {
+			// produce requests with acks=0 have no response
+			continue
+		}
+		response := binary.BigEndian.AppendUint32(make([]byte, 0, 8+len(body)), uint32(4+len(body)))
+		response = binary.BigEndian.AppendUint32(response, uint32(req.correlationID))
+		if _, err = conn.Write(append(response, body...)); err != nil {
+			return
+		}
+	}
+}
+
+// errUnsupportedVersion ends connections sending a request version that is
+// not served, as its response cannot be encoded.
+var errUnsupportedVersion = errors.New("unsupported version")
+
+// handle returns the response body to req, nil when there is none.
+func (s *Server) handle(req request) ([]byte, error) {
+	if req.key == apiVersions {
+		// answered in version 0 when not supported, so clients learn the
+		// versions to use
+		return s.apiVersions(req), nil
+	}
+	if !supported(req.key, req.version) {
+		return nil, errUnsupportedVersion
+	}
+
+	var e encoder
+	var err error
+	switch req.key {
+	case apiProduce:
+		if !s.produce(req, &e) {
+			return nil, nil
+		}
+	case apiFetch:
+		s.fetch(req, &e)
+	case apiListOffsets:
+		s.listOffsets(req, &e)
+	case apiMetadata:
+		s.metadata(req, &e)
+	case apiOffsetCommit:
+		s.offsetCommit(req, &e)
+	case apiOffsetFetch:
+		s.offsetFetch(req, &e)
+	case apiFindCoordinator:
+		s.findCoordinator(req, &e)
+	}
+	if req.body.err != nil {
+		err = fmt.Errorf("cannot decode request: %w", req.body.err)
+	}
+	return e.buf, err
+}
+
+func supported(key, version int16) bool {
+	for _, v := range versions {
+		if v.key == key {
+			return version >= v.min && version <= v.max
+		}
+	}
+	return false
+}
+
+func (s *Server) apiVersions(req request) []byte {
+	var e encoder
+	if supported(req.key, req.version) {
+		e.int16(codeNone)
+	} else {
+		e.int16(codeUnsupportedVersion)
+		req.version = 0
+	}
+	e.arrayLength(len(versions))
+	for _, v := range versions {
+		e.int16(v.key)
+		e.int16(v.min)
+		e.int16(v.max)
+	}
+	if req.version >= 1 {
+		e.int32(0) // throttle time
+	}
+	return e.buf
+}
+
+func (s *Server) findCoordinator(req request, e *encoder) {
+	req.body.string()
+	if req.version >= 1 {
+		req.body.int8()
+		e.int32(0)
+	}
+	e.int16(codeNone)
+	if req.version >= 1 {
+		e.nullableString(nil)
+	}
+	e.int32(nodeID)
+	e.string(s.Host)
+	e.int32(s.Port)
+}
+
+func (s *Server) metadata(req request, e *encoder) {
+	d := &req.body
+	var topics []string
+	all := false
+	n := d.arrayLength()
+	if n < 0 || (n == 0 && req.version == 0) {
+		all = true
+	}
+	for i := 0; i < n; i++ {
+		topics = append(topics, d.string())
+	}
+	autoCreate := true
+	if req.version >= 4 {
+		autoCreate = d.bool()
+	}
+	if req.version >= 8 {
+		d.bool()
+		d.bool()
+	}
+	if all {
+		topics = s.Storage.Topics()
+	}
+
+	if req.version >= 3 {
+		e.int32(0)
+	}
+	e.arrayLength(1)
+	e.int32(nodeID)
+	e.string(s.Host)
+	e.int32(s.Port)
+	if req.version >= 1 {
+		e.nullableString(nil)
+	}
+	if req.version >= 2 {
+		e.nullableString(nil)
+	}
+	if req.version >= 1 {
+		e.int32(nodeID)
+	}
+
+	e.arrayLength(len(topics))
+	for _, topic := range topics {
+		var partitions []entity.Log
+		var err error
+		if autoCreate || contains(s.Storage.Topics(), topic) {
+			partitions, err = s.Storage.Topic(topic)
+		} else {
+			err = entity.ErrUnknownPartition
+		}
+		e.int16(errorCode(err))
+		e.string(topic)
+		if req.version >= 1 {
+			e.bool(false)
+		}
+		e.arrayLength(len(partitions))
+		for p := range partitions {
+			e.int16(codeNone)
+			e.int32(int32(p))
+			e.int32(nodeID)
+			if req.version >= 7 {
+				e.int32(0)
+			}
+			e.int32Array([]int32{nodeID})
+			e.int32Array([]int32{nodeID})
+			if req.version >= 5 {
+				e.int32Array(nil)
+			}
+		}
+		if req.version >= 8 {
+			e.int32(-2147483648)
+		}
+	}
+	if req.version >= 8 {
+		e.int32(-2147483648)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,470 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// The binary protocol sends every command and response as a frame, all
+// integers being big endian:
+//
+//	frame:    length int32 | header | payload
+//	request:  type int16 | version int16 | correlationID int64
+//	response: correlationID int64 | version int16
+//
+// The request type is the command type and its version one of Versions,
+// negotiated with an api versions command. Payloads of version 0 follow;
+// consume commands of version 1 append credit int32, of version 2 also
+// manualCommit int8, of version 3 also queue int8 | visibilityTimeout int64
+// and of version 4 also maxAttempts int32 | retryBackoff int64:
+//
+//	publish:     topic string | partition int32 | message
+//	consume:     topic string | group string | assignment string |
+//	             offsetReset string | timestamp int64
+//	metadata:    topic string
+//	apiVersions: empty
+//	fetch:       topic string | partition int32 | offset int64 |
+//	             maxMessages int32 | maxBytes int32 | maxWait int64
+//	credit:      credit int32
+//	commit:      topic string | group string | partition int32 | offset int64
+//	ack:         topic string | group string | partition int32 | offset int64
+//	nack:        topic string | group string | partition int32 | offset int64 |
+//	             reason string
+//	response:    errorCode string | errorMessage string | topic string |
+//	             partition int32 | offset int64 | timestamp int64 | body bytes |
+//	             hasMessage int8 | message
+//	message:     key bytes | headerCount int32 | (key string | value string)... |
+//	             value bytes
+//
+// Strings have an int16 length, bytes an int32 length where -1 stands for
+// nil. A publish partition of -1 lets the broker choose it. Frames are
+// limited to maxFrameSize, so the first byte of a connection speaking the
+// binary protocol is always zero.
+const (
+	responseVersion = 0
+	maxFrameSize    = 1<<24 - 1
+)
+
+// ErrFrameTooLarge is returned when a frame exceeds maxFrameSize.
+var ErrFrameTooLarge = errors.New("frame is too large")
+
+type binaryCodec struct {
+	reader *bufio.Reader
+	mu     sync.Mutex
+	w      io.Writer
+}
+
+func newBinaryCodec(reader *bufio.Reader, w io.Writer) *binaryCodec {
+	return &binaryCodec{reader: reader, w: w}
+}
+
+func (b *binaryCodec) ReadCommand() (entity.Command, error) {
+	frame, err := b.readFrame()
+	if err != nil {
+		return entity.Command{}, err
+	}
+	d := decoder{data: frame}
+	c := entity.Command{Type: int(d.int16()), Version: d.int16()}
+	c.CorrelationID = d.uint64()
+	if d.err != nil {
+		return entity.Command{}, invalidRequest(d.err)
+	}
+	// api versions commands are answered whatever their version, so
+	// clients learn the versions they can use
+	if c.Type != entity.TypeApiVersions {
+		if err := CheckVersion(c.Type, c.Version); err != nil {
+			return c, err
+		}
+	}
+
+	switch c.Type {
+	case entity.TypePublish:
+		c.Topic = d.string()
+		if partition := int(d.int32()); partition >= 0 {
+			c.Partition = &partition
+		}
+		message := d.message()
+		c.Message = &message
+	case entity.TypeConsume:
+		c.Topic = d.string()
+		c.ConsumerName = d.string()
+		c.Assignment = d.string()
+		c.OffsetReset = d.string()
+		c.Timestamp = int64(d.uint64())
+		if c.Version >= 1 {
+			c.Credit = int(d.int32())
+		}
+		if c.Version >= 2 {
+			c.ManualCommit = d.int8() != 0
+		}
+		if c.Version >= 3 {
+			c.Queue = d.int8() != 0
+			c.VisibilityTimeout = int64(d.uint64())
+		}
+		if c.Version >= 4 {
+			c.MaxAttempts = int(d.int32())
+			c.RetryBackoff = int64(d.uint64())
+		}
+	case entity.TypeMetadata:
+		c.Topic = d.string()
+	case entity.TypeApiVersions:
+	case entity.TypeFetch:
+		c.Topic = d.string()
+		partition := int(d.int32())
+		c.Partition = &partition
+		c.Offset = uint(d.uint64())
+		c.MaxMessages = int(d.int32())
+		c.MaxBytes = int(d.int32())
+		c.MaxWait = int64(d.uint64())
+	case entity.TypeCredit:
+		c.Credit = int(d.int32())
+	case entity.TypeCommit, entity.TypeAck, entity.TypeNack:
+		c.Topic = d.string()
+		c.ConsumerName = d.string()
+		partition := int(d.int32())
+		c.Partition = &partition
+		c.Offset = uint(d.uint64())
+		if c.Type == entity.TypeNack {
+			c.Reason = d.string()
+		}
+	default:
+		return c, invalidRequest(fmt.Errorf("no expected command type: %d", c.Type))
+	}
+	if d.err != nil {
+		return c, invalidRequest(d.err)
+	}
+	return c, nil
+}
+
+func (b *binaryCodec) WriteCommand(c entity.Command) error {
+	if err := checkStrings(c.Topic, c.ConsumerName, c.Assignment, c.OffsetReset, c.Reason); err != nil {
+		return err
+	}
+	if err := checkMessage(c.Message); err != nil {
+		return err
+	}
+	raw := make([]byte, 4, 64)
+	raw = binary.BigEndian.AppendUint16(raw, uint16(c.Type))
+	raw = binary.BigEndian.AppendUint16(raw, uint16(c.Version))
+	raw = binary.BigEndian.AppendUint64(raw, c.CorrelationID)
+
+	switch c.Type {
+	case entity.TypePublish:
+		if c.Message == nil {
+			return errors.New("publish command without message")
+		}
+		raw = appendString(raw, c.Topic)
+		partition := -1
+		if c.Partition != nil {
+			partition = *c.Partition
+		}
+		raw = binary.BigEndian.AppendUint32(raw, uint32(int32(partition)))
+		raw = appendMessage(raw, *c.Message)
+	case entity.TypeConsume:
+		raw = appendString(raw, c.Topic)
+		raw = appendString(raw, c.ConsumerName)
+		raw = appendString(raw, c.Assignment)
+		raw = appendString(raw, c.OffsetReset)
+		raw = binary.BigEndian.AppendUint64(raw, uint64(c.Timestamp))
+		if c.Version >= 1 {
+			raw = binary.BigEndian.AppendUint32(raw, uint32(int32(c.Credit)))
+		}
+		if c.Version >= 2 {
+			manualCommit := byte(0)
+			if c.ManualCommit {
+				manualCommit = 1
+			}
+			raw = append(raw, manualCommit)
+		}
+		if c.Version >= 3 {
+			queue := byte(0)
+			if c.Queue {
+				queue = 1
+			}
+			raw = append(raw, queue)
+			raw = binary.BigEndian.AppendUint64(raw, uint64(c.VisibilityTimeout))
+		}
+		if c.Version >= 4 {
+			raw = binary.BigEndian.AppendUint32(raw, uint32(int32(c.MaxAttempts)))
+			raw = binary.BigEndian.AppendUint64(raw, uint64(c.RetryBackoff))
+		}
+	case entity.TypeMetadata:
+		raw = appendString(raw, c.Topic)
+	case entity.TypeApiVersions:
+	case entity.TypeFetch:
+		raw = appendString(raw, c.Topic)
+		partition := 0
+		if c.Partition != nil {
+			partition = *c.Partition
+		}
+		raw = binary.BigEndian.AppendUint32(raw, uint32(int32(partition)))
+		raw = binary.BigEndian.AppendUint64(raw, uint64(c.Offset))
+		raw = binary.BigEndian.AppendUint32(raw, uint32(int32(c.MaxMessages)))
+		raw = binary.BigEndian.AppendUint32(raw, uint32(int32(c.MaxBytes)))
+		raw = binary.BigEndian.AppendUint64(raw, uint64(c.MaxWait))
+	case entity.TypeCredit:
+		raw = binary.BigEndian.AppendUint32(raw, uint32(int32(c.Credit)))
+	case entity.TypeCommit, entity.TypeAck, entity.TypeNack:
+		raw = appendString(raw, c.Topic)
+		raw = appendString(raw, c.ConsumerName)
+		partition := 0
+		if c.Partition != nil {
+			partition = *c.Partition
+		}
+		raw = binary.BigEndian.AppendUint32(raw, uint32(int32(partition)))
+		raw = binary.BigEndian.AppendUint64(raw, uint64(c.Offset))
+		if c.Type == entity.TypeNack {
+			raw = appendString(raw, c.Reason)
+		}
+	default:
+		return fmt.Errorf("no expected command type: %d", c.Type)
+	}
+	return b.writeFrame(raw)
+}
+
+func (b *binaryCodec) ReadResponse() (entity.Response, error) {
+	frame, err := b.readFrame()
+	if err != nil {
+		return entity.Response{}, err
+	}
+	d := decoder{data: frame}
+	response := entity.Response{CorrelationID: d.uint64()}
+	if version := d.int16(); d.err == nil && version != responseVersion {
+		return entity.Response{}, fmt.Errorf("unsupported response version %d", version)
+	}
+	code, message := d.string(), d.string()
+	if code != "" {
+		response.Error = &entity.ResponseError{Code: entity.ErrorCode(code), Message: message}
+	}
+	response.Topic = d.string()
+	response.Partition = int(d.int32())
+	response.Offset = uint(d.uint64())
+	response.Timestamp = int64(d.uint64())
+	response.Body = string(d.nullableBytes())
+	if d.int8() == 1 {
+		message := d.message()
+		response.Message = &message
+	}
+	if d.err != nil {
+		return entity.Response{}, fmt.Errorf("invalid response: %w", d.err)
+	}
+	return response, nil
+}
+
+func (b *binaryCodec) WriteResponse(response entity.Response) error {
+	if err := checkStrings(response.Topic); err != nil {
+		return err
+	}
+	if response.Error != nil {
+		if err := checkStrings(string(response.Error.Code), response.Error.Message); err != nil {
+			return err
+		}
+	}
+	if err := checkMessage(response.Message); err != nil {
+		return err
+	}
+	raw := make([]byte, 4, 64)
+	raw = binary.BigEndian.AppendUint64(raw, response.CorrelationID)
+	raw = binary.BigEndian.AppendUint16(raw, responseVersion)
+	if response.Error != nil {
+		code := response.Error.Code
+		if code == "" {
+			code = entity.ErrCodeUnknown
+		}
+		raw = appendString(raw, string(code))
+		raw = appendString(raw, response.Error.Message)
+	} else {
+		raw = appendString(raw, "")
+		raw = appendString(raw, "")
+	}
+	raw = appendString(raw, response.Topic)
+	raw = binary.BigEndian.AppendUint32(raw, uint32(int32(response.Partition)))
+	raw = binary.BigEndian.AppendUint64(raw, uint64(response.Offset))
+	raw = binary.BigEndian.AppendUint64(raw, uint64(response.Timestamp))
+	raw = appendNullableBytes(raw, []byte(response.Body))
+	if response.Message != nil {
+		raw = append(raw, 1)
+		raw = appendMessage(raw, *response.Message)
+	} else {
+		raw = append(raw, 0)
+	}
+	return b.writeFrame(raw)
+}
+
+// readFrame reads the next frame, without its length.
+func (b *binaryCodec) readFrame() ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(b.reader, length[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > maxFrameSize {
+		// the stream cannot be resynchronized
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(b.reader, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// writeFrame writes raw, which starts with 4 bytes left for its length.
+func (b *binaryCodec) writeFrame(raw []byte) error {
+	if len(raw)-4 > maxFrameSize {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(raw)-4)
+	}
+	binary.BigEndian.PutUint32(raw, uint32(len(raw)-4))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.w.Write(raw)
+	return err
+}
+
+func invalidRequest(err error) error {
+	return entity.NewError(entity.ErrCodeInvalidRequest, fmt.Errorf("invalid command: %w", err))
+}
+
+// checkStrings returns an entity.ErrTooLarge error when a string is too long
+// for its int16 length.
+func checkStrings(strs ...string) error {
+	for _, s := range strs {
+		if len(s) > math.MaxUint16 {
+			return fmt.Errorf("%w: string of %d bytes", entity.ErrTooLarge, len(s))
+		}
+	}
+	return nil
+}
+
+// checkMessage checks the header strings of message, which may be nil.
+func checkMessage(message *entity.Message) error {
+	if message == nil {
+		return nil
+	}
+	for key, value := range message.Headers {
+		if err := checkStrings(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendString(raw []byte, s string) []byte {
+	raw = binary.BigEndian.AppendUint16(raw, uint16(len(s)))
+	return append(raw, s...)
+}
+
+func appendNullableBytes(raw, b []byte) []byte {
+	if b == nil {
+		return binary.BigEndian.AppendUint32(raw, 0xffffffff)
+	}
+	raw = binary.BigEndian.AppendUint32(raw, uint32(len(b)))
+	return append(raw, b...)
+}
+
+func appendMessage(raw []byte, message entity.Message) []byte {
+	var key []byte
+	if message.Key != "" {
+		key = []byte(message.Key)
+	}
+	raw = appendNullableBytes(raw, key)
+
+	keys := make([]string, 0, len(message.Headers))
+	for key := range message.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	raw = binary.BigEndian.AppendUint32(raw, uint32(len(keys)))
+	for _, key := range keys {
+		raw = appendString(raw, key)
+		raw = appendString(raw, message.Headers[key])
+	}
+
+	var value []byte
+	if !message.Tombstone {
+		value = []byte(message.Body)
+	}
+	return appendNullableBytes(raw, value)
+}
+
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.data[:n:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) nullableBytes() []byte {
+	n := d.int32()
+	if n == -1 {
+		return nil
+	}
+	return d.bytes(int(n))
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes(int(uint16(d.int16()))))
+}
+
+func (d *decoder) message() entity.Message {
+	message := entity.Message{Key: string(d.nullableBytes())}
+	if headers := d.int32(); headers > 0 && d.err == nil {
+		message.Headers = make(map[string]string, headers)
+		for i := int32(0); i < headers && d.err == nil; i++ {
+			key := d.string()
+			message.Headers[key] = d.string()
+		}
+	}
+	value := d.nullableBytes()
+	message.Body = string(value)
+	message.Tombstone = value == nil && d.err == nil
+	return message
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.bytes(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.bytes(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.bytes(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
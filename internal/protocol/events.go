@@ -0,0 +1,29 @@
+package protocol
+
+import (
+	"io"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// EventStream returns a writer of responses as server-sent events, each the
+// JSON object the JSON protocol writes.
+func EventStream(w io.Writer) entity.ResponseWriter {
+	return newJSONCodec(nil, eventWriter{w: w})
+}
+
+// eventWriter writes every line as the data of an event.
+type eventWriter struct {
+	w io.Writer
+}
+
+func (e eventWriter) Write(line []byte) (int, error) {
+	event := make([]byte, 0, len(line)+7)
+	event = append(event, "data: "...)
+	event = append(event, line...)
+	event = append(event, '\n')
+	if _, err := e.w.Write(event); err != nil {
+		return 0, err
+	}
+	return len(line), nil
+}
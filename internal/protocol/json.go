@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// jsonCodec encodes every command and response as a JSON object on its own
+// line. Messages are JSON encoded in the body, so their key and value must
+// be valid UTF-8.
+type jsonCodec struct {
+	reader *bufio.Reader
+	mu     sync.Mutex
+	w      io.Writer
+}
+
+func newJSONCodec(reader *bufio.Reader, w io.Writer) *jsonCodec {
+	return &jsonCodec{reader: reader, w: w}
+}
+
+func (j *jsonCodec) ReadCommand() (entity.Command, error) {
+	line, err := j.readLine()
+	if err != nil {
+		return entity.Command{}, err
+	}
+	var c entity.Command
+	if err = json.Unmarshal(line, &c); err != nil {
+		return entity.Command{}, entity.NewError(entity.ErrCodeInvalidRequest, fmt.Errorf("invalid command: %w", err))
+	}
+	if c.Type != entity.TypeApiVersions {
+		if err = CheckVersion(c.Type, c.Version); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+func (j *jsonCodec) WriteCommand(c entity.Command) error {
+	if c.Message != nil && c.Body == "" {
+		body, err := json.Marshal(c.Message)
+		if err != nil {
+			return err
+		}
+		c.Body = string(body)
+	}
+	return j.writeLine(c)
+}
+
+func (j *jsonCodec) ReadResponse() (entity.Response, error) {
+	line, err := j.readLine()
+	if err != nil {
+		return entity.Response{}, err
+	}
+	var response entity.Response
+	if err = json.Unmarshal(line, &response); err != nil {
+		return entity.Response{}, fmt.Errorf("invalid response: %w", err)
+	}
+	return response, nil
+}
+
+func (j *jsonCodec) WriteResponse(response entity.Response) error {
+	if response.Message != nil {
+		body, err := json.Marshal(response.Message)
+		if err != nil {
+			return err
+		}
+		response.Body = string(body)
+	}
+	return j.writeLine(response)
+}
+
+// readLine reads a whole line, however long.
+func (j *jsonCodec) readLine() ([]byte, error) {
+	line, err := j.reader.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	return line, err
+}
+
+func (j *jsonCodec) writeLine(v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	raw = append(raw, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = j.w.Write(raw)
+	return err
+}
@@ -0,0 +1,55 @@
+// Package protocol encodes the commands and responses exchanged with the
+// broker. A connection speaks either the JSON line protocol, one JSON object
+// per line, handy for debugging and used by the CLI, or the binary protocol
+// of length-prefixed frames, which carries message keys and values as raw
+// bytes. The server tells them apart by the first byte of the connection.
+// Responses are also streamed to HTTP clients as server-sent events or
+// WebSocket messages, in the JSON of the JSON protocol.
+package protocol
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// Codec reads and writes the commands and responses of a connection. The
+// server reads commands and writes responses, clients do the opposite. Reads
+// must not be concurrent, writes may be.
+type Codec interface {
+	// ReadCommand returns the next command. A command that cannot be
+	// decoded is returned with an *entity.Error, coded
+	// entity.ErrCodeInvalidRequest or entity.ErrCodeUnsupportedVersion,
+	// and its correlation id when known; the next command can still be
+	// read. Any other error ends the connection.
+	ReadCommand() (entity.Command, error)
+	WriteCommand(c entity.Command) error
+	ReadResponse() (entity.Response, error)
+	WriteResponse(response entity.Response) error
+}
+
+// Detect waits for the first byte sent over conn and returns the codec of
+// the protocol it starts: binary frames start with the zero high byte of
+// their length, JSON commands with anything else.
+func Detect(conn io.ReadWriter) (Codec, error) {
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] == 0 {
+		return newBinaryCodec(reader, conn), nil
+	}
+	return newJSONCodec(reader, conn), nil
+}
+
+// JSON returns the codec of the JSON line protocol.
+func JSON(conn io.ReadWriter) Codec {
+	return newJSONCodec(bufio.NewReader(conn), conn)
+}
+
+// Binary returns the codec of the binary protocol.
+func Binary(conn io.ReadWriter) Codec {
+	return newBinaryCodec(bufio.NewReader(conn), conn)
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// Versions are the versions of every command type this build encodes and
+// decodes. A change to the encoding of a command adds a version, keeping the
+// older ones for the clients that still use them.
+var Versions = []entity.ApiVersion{
+	{Type: entity.TypePublish, MinVersion: 0, MaxVersion: 0},
+	{Type: entity.TypeConsume, MinVersion: 0, MaxVersion: 4},
+	{Type: entity.TypeMetadata, MinVersion: 0, MaxVersion: 0},
+	{Type: entity.TypeApiVersions, MinVersion: 0, MaxVersion: 0},
+	{Type: entity.TypeFetch, MinVersion: 0, MaxVersion: 0},
+	{Type: entity.TypeCredit, MinVersion: 0, MaxVersion: 0},
+	{Type: entity.TypeCommit, MinVersion: 0, MaxVersion: 0},
+	{Type: entity.TypeAck, MinVersion: 0, MaxVersion: 0},
+	{Type: entity.TypeNack, MinVersion: 0, MaxVersion: 0},
+}
+
+// CheckVersion returns an entity.ErrCodeUnsupportedVersion error unless
+// version of commandType is in Versions. Command types missing from Versions
+// are left to the caller to reject.
+func CheckVersion(commandType int, version int16) error {
+	for _, v := range Versions {
+		if v.Type != commandType {
+			continue
+		}
+		if version < v.MinVersion || version > v.MaxVersion {
+			err := fmt.Errorf("version %d of command type %d is not supported, only %d to %d", version, commandType, v.MinVersion, v.MaxVersion)
+			return entity.NewError(entity.ErrCodeUnsupportedVersion, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// Negotiate returns the highest version of commandType in both ours and
+// theirs, or an entity.ErrCodeUnsupportedVersion error when they have no
+// version in common.
+func Negotiate(ours, theirs []entity.ApiVersion, commandType int) (int16, error) {
+	mine, ok := findVersion(ours, commandType)
+	if !ok {
+		return 0, entity.NewError(entity.ErrCodeUnsupportedVersion, fmt.Errorf("command type %d is not supported by the client", commandType))
+	}
+	other, ok := findVersion(theirs, commandType)
+	if !ok {
+		return 0, entity.NewError(entity.ErrCodeUnsupportedVersion, fmt.Errorf("command type %d is not supported by the broker", commandType))
+	}
+	min, max := mine.MinVersion, mine.MaxVersion
+	if other.MinVersion > min {
+		min = other.MinVersion
+	}
+	if other.MaxVersion < max {
+		max = other.MaxVersion
+	}
+	if min > max {
+		err := fmt.Errorf("command type %d: the client supports versions %d to %d, the broker %d to %d", commandType, mine.MinVersion, mine.MaxVersion, other.MinVersion, other.MaxVersion)
+		return 0, entity.NewError(entity.ErrCodeUnsupportedVersion, err)
+	}
+	return max, nil
+}
+
+func findVersion(versions []entity.ApiVersion, commandType int) (entity.ApiVersion, bool) {
+	for _, v := range versions {
+		if v.Type == commandType {
+			return v, true
+		}
+	}
+	return entity.ApiVersion{}, false
+}
@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// Opcodes of WebSocket frames.
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xa
+)
+
+// websocketGUID is appended to the key of a handshake to compute its accept
+// key.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxControlPayload is the largest payload of a control frame.
+const maxControlPayload = 125
+
+// WebSocketAccept returns the Sec-WebSocket-Accept header answering the
+// Sec-WebSocket-Key of a handshake.
+func WebSocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// WebSocket is the server side of a WebSocket connection (RFC 6455) after
+// its handshake, writing every response in a text message holding the JSON
+// object the JSON protocol writes. Messages sent by the client are ignored.
+type WebSocket struct {
+	reader *bufio.Reader
+	mu     sync.Mutex
+	w      io.Writer
+	codec  *jsonCodec
+}
+
+func NewWebSocket(reader *bufio.Reader, w io.Writer) *WebSocket {
+	ws := &WebSocket{reader: reader, w: w}
+	ws.codec = newJSONCodec(nil, websocketText{ws: ws})
+	return ws
+}
+
+func (ws *WebSocket) WriteResponse(response entity.Response) error {
+	return ws.codec.WriteResponse(response)
+}
+
+// Wait reads the frames of the client, answering pings, until it closes the
+// connection. It returns nil after a close frame was answered.
+func (ws *WebSocket) Wait() error {
+	for {
+		opcode, length, mask, err := ws.readHeader()
+		if err != nil {
+			return err
+		}
+		if opcode < opClose {
+			// data frames are not used by the client
+			if _, err = io.CopyN(io.Discard, ws.reader, int64(length)); err != nil {
+				return err
+			}
+			continue
+		}
+		if length > maxControlPayload {
+			return fmt.Errorf("control frame of %d bytes", length)
+		}
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(ws.reader, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch opcode {
+		case opClose:
+			return ws.writeFrame(opClose, payload)
+		case opPing:
+			if err = ws.writeFrame(opPong, payload); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (ws *WebSocket) readHeader() (byte, uint64, [4]byte, error) {
+	var mask [4]byte
+	var header [2]byte
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return 0, 0, mask, err
+	}
+	opcode := header[0] & 0x0f
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return 0, 0, mask, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return 0, 0, mask, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if header[1]&0x80 != 0 {
+		if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+			return 0, 0, mask, err
+		}
+	}
+	return opcode, length, mask, nil
+}
+
+// writeFrame writes payload in a single unmasked frame, as servers do.
+func (ws *WebSocket) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	_, err := ws.w.Write(frame)
+	return err
+}
+
+// websocketText writes every line in a text message.
+type websocketText struct {
+	ws *WebSocket
+}
+
+func (t websocketText) Write(line []byte) (int, error) {
+	if err := t.ws.writeFrame(opText, bytes.TrimSuffix(line, []byte("\n"))); err != nil {
+		return 0, err
+	}
+	return len(line), nil
+}
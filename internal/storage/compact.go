@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+var ErrMissingKey = entity.ErrMissingKey
+
+// cleaningDir is where compacted segments are written before replacing the
+// original ones.
+const cleaningDir = ".cleaning"
+
+// Compact rewrites the segments before the active one keeping only the
+// latest record of each key, and drops tombstones older than the delete
+// retention. Offsets are preserved, so compacted segments have gaps. It
+// returns how many records were removed.
+func (l *Log) Compact(now time.Time) (int, error) {
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return 0, ErrClosed
+	}
+	active := l.active()
+	if !l.config.Compact || active.baseOffset == l.compactedOffset && !l.tombstones {
+		l.mu.RUnlock()
+		return 0, nil
+	}
+	sealed := append([]*segment(nil), l.segments[:len(l.segments)-1]...)
+	activeSize := active.size
+	l.mu.RUnlock()
+
+	// records appended from now on only make more records obsolete, so the
+	// latest offsets seen so far are safe to compact against
+	latest := make(map[string]uint64)
+	collect := func(rec Record) {
+		if rec.Key != nil {
+			latest[string(rec.Key)] = rec.Offset
+		}
+	}
+	for _, s := range sealed {
+		if err := s.scan(s.size, collect); err != nil {
+			return 0, err
+		}
+	}
+	if err := active.scan(activeSize, collect); err != nil {
+		return 0, err
+	}
+
+	tmp := filepath.Join(l.dir, cleaningDir)
+	if err := os.RemoveAll(tmp); err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmp)
+
+	removed := 0
+	tombstones := false
+	for _, s := range sealed {
+		cleaned, err := newSegment(tmp, s.baseOffset)
+		if err != nil {
+			return removed, err
+		}
+		err = s.scanBatches(s.size, func(records []Record) error {
+			var keep []Record
+			for _, rec := range records {
+				switch {
+				case rec.Key != nil && latest[string(rec.Key)] != rec.Offset:
+				case rec.Value == nil && now.Sub(time.UnixMilli(rec.Timestamp)) > l.config.DeleteRetention:
+				default:
+					if rec.Value == nil {
+						tombstones = true
+					}
+					keep = append(keep, rec)
+					continue
+				}
+				removed++
+			}
+			if len(keep) == 0 {
+				return nil
+			}
+			return cleaned.append(keep)
+		})
+		if err == nil {
+			err = cleaned.sync()
+		}
+		if e := cleaned.close(); e != nil && err == nil {
+			err = e
+		}
+		if err != nil {
+			return removed, fmt.Errorf("cannot compact segment %d: %w", s.baseOffset, err)
+		}
+	}
+	if err := syncDir(tmp); err != nil {
+		return removed, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+	// retention or a truncation may have removed segments meanwhile
+	for i, s := range sealed {
+		if i >= len(l.segments) || l.segments[i] != s {
+			return 0, fmt.Errorf("segments of %s changed while compacting", l.dir)
+		}
+	}
+	// a failed replacement leaves its segment and the next ones as they
+	// were, the ones before compacted
+	for i, s := range sealed {
+		cleaned, err := l.replace(s, tmp)
+		if err != nil {
+			return removed, fmt.Errorf("cannot replace segment %d: %w", s.baseOffset, err)
+		}
+		l.segments[i] = cleaned
+	}
+	if err := syncDir(l.dir); err != nil {
+		return removed, err
+	}
+	l.compactedOffset = active.baseOffset
+	l.tombstones = tombstones
+
+	if removed > 0 {
+		log.Printf("%s: compaction removed %d records\n", l.dir, removed)
+	}
+	return removed, nil
+}
+
+// replace swaps the files of s with the compacted ones written to tmp. The
+// indexes are removed first so a crash leaves either segment file with
+// indexes that can be rebuilt. s is closed only once the compacted segment
+// is loaded, so it keeps serving its records when replace fails. It must be
+// called with l.mu held.
+func (l *Log) replace(s *segment, tmp string) (*segment, error) {
+	for _, suffix := range []string{indexSuffix, timeIndexSuffix} {
+		if err := os.Remove(segmentFileName(l.dir, s.baseOffset, suffix)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	for _, suffix := range []string{segmentSuffix, indexSuffix, timeIndexSuffix} {
+		if err := os.Rename(segmentFileName(tmp, s.baseOffset, suffix), segmentFileName(l.dir, s.baseOffset, suffix)); err != nil {
+			return nil, err
+		}
+	}
+
+	cleaned, err := newSegment(l.dir, s.baseOffset)
+	if err != nil {
+		return nil, err
+	}
+	if err = cleaned.load(); err != nil {
+		cleaned.close()
+		return nil, err
+	}
+	// the offsets after the last kept record still belong to this segment,
+	// and its timestamps still bound the ones of the next segments
+	cleaned.nextOffset = s.nextOffset
+	if cleaned.maxTimestamp < s.maxTimestamp {
+		cleaned.maxTimestamp = s.maxTimestamp
+	}
+	s.deleted = true
+	if err = s.close(); err != nil {
+		log.Printf("%s: cannot close compacted segment %d: %s\n", l.dir, s.baseOffset, err)
+	}
+	return cleaned, nil
+}
+
+// syncDir fsyncs the directory at path, making the files created, renamed
+// or removed in it durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if e := dir.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// scan calls fn with every record stored before the size byte position.
+func (s *segment) scan(size int64, fn func(Record)) error {
+	return s.scanBatches(size, func(records []Record) error {
+		for _, rec := range records {
+			fn(rec)
+		}
+		return nil
+	})
+}
+
+// scanBatches calls fn with every batch stored before the size byte
+// position.
+func (s *segment) scanBatches(size int64, fn func([]Record) error) error {
+	var pos int64
+	for pos < size {
+		records, next, err := readBatch(s.file, pos)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(records); err != nil {
+			return err
+		}
+		pos = next
+	}
+	return nil
+}
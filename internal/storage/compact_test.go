@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// appendKeyed appends records written as key=value, in order, - being
+// the value of tombstones.
+func appendKeyed(t *testing.T, l *Log, records ...string) {
+	t.Helper()
+	for _, record := range records {
+		key, v, _ := strings.Cut(record, "=")
+		rec := Record{Key: []byte(key)}
+		if v != "-" {
+			rec.Value = []byte(v)
+		}
+		if _, err := l.Append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// describe lists records as offset:key=value.
+func describe(records []Record) string {
+	var s []string
+	for _, rec := range records {
+		v := "-"
+		if rec.Value != nil {
+			v = string(rec.Value)
+		}
+		s = append(s, fmt.Sprintf("%d:%s=%s", rec.Offset, rec.Key, v))
+	}
+	return fmt.Sprint(s)
+}
+
+func TestCompactionKeepsTheLatestValueOfEveryKey(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{Compact: true, SegmentBytes: 1, DeleteRetention: time.Hour}
+	l := openLog(t, dir, config)
+	appendKeyed(t, l, "a=1", "b=1", "a=2", "c=1", "b=2", "a=3")
+
+	removed, err := l.Compact(time.Now())
+	if err != nil || removed != 3 {
+		t.Fatalf("expected 3 records removed, found %d, %v", removed, err)
+	}
+	// the records kept keep their offsets
+	expected := "[3:c=1 4:b=2 5:a=3]"
+	if found := describe(readFrom(t, l, 0)); found != expected {
+		t.Errorf("expected %s, found %s", expected, found)
+	}
+	if found := describe(readFrom(t, l, 1)); found != expected {
+		t.Errorf("expected a reader of a removed offset to read %s, found %s", expected, found)
+	}
+
+	// the compacted segments are stored
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l = openLog(t, dir, config)
+	if found := describe(readFrom(t, l, 0)); found != expected {
+		t.Errorf("expected %s once reopened, found %s", expected, found)
+	}
+	appendKeyed(t, l, "c=2")
+	if found := describe(readFrom(t, l, 5)); found != "[5:a=3 6:c=2]" {
+		t.Errorf("expected appends to continue at offset 6, found %s", found)
+	}
+}
+
+func TestCompactionRemovesTombstonesAfterTheDeleteRetention(t *testing.T) {
+	l := openLog(t, t.TempDir(), Config{Compact: true, SegmentBytes: 1, DeleteRetention: time.Hour})
+	appendKeyed(t, l, "a=1", "b=1", "a=-", "c=1")
+
+	// the tombstone replaces the value of its key until the delete
+	// retention elapsed
+	if removed, err := l.Compact(time.Now()); err != nil || removed != 1 {
+		t.Fatalf("expected 1 record removed, found %d, %v", removed, err)
+	}
+	if found := describe(readFrom(t, l, 0)); found != "[1:b=1 2:a=- 3:c=1]" {
+		t.Errorf("expected the tombstone of a kept, found %s", found)
+	}
+
+	if removed, err := l.Compact(time.Now().Add(2 * time.Hour)); err != nil || removed != 1 {
+		t.Fatalf("expected the tombstone removed, found %d removed, %v", removed, err)
+	}
+	if found := describe(readFrom(t, l, 0)); found != "[1:b=1 3:c=1]" {
+		t.Errorf("expected the key of the tombstone removed, found %s", found)
+	}
+}
+
+func TestCompactedLogsRejectRecordsWithoutKey(t *testing.T) {
+	l := openLog(t, t.TempDir(), Config{Compact: true})
+	if _, err := l.Append(Record{Value: []byte("anonymous")}); !errors.Is(err, ErrMissingKey) {
+		t.Errorf("expected the append to fail with %s, found %v", ErrMissingKey, err)
+	}
+}
+
+func TestCompactionKeepsTheOffsetsAndTimestampsOfEmptiedSegments(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{Compact: true, SegmentBytes: 1, DeleteRetention: time.Hour}
+	l := openLog(t, dir, config)
+	for _, record := range []string{"a=1", "b=1", "b=2", "c=1"} {
+		time.Sleep(2 * time.Millisecond)
+		appendKeyed(t, l, record)
+	}
+	var timestamps []int64
+	for _, rec := range readFrom(t, l, 0) {
+		timestamps = append(timestamps, rec.Timestamp)
+	}
+	// the segment of b=1 is left without records
+	if removed, err := l.Compact(time.Now()); err != nil || removed != 1 {
+		t.Fatalf("expected 1 record removed, found %d, %v", removed, err)
+	}
+
+	check := func(state string) {
+		t.Helper()
+		if next := l.segments[1].nextOffset; next != 2 {
+			t.Errorf("expected the emptied segment to end at offset 2 %s, found %d", state, next)
+		}
+		for i, offset := range []uint64{0, 2, 2, 3} {
+			found, err := l.OffsetForTime(timestamps[i])
+			if err != nil || found != offset {
+				t.Errorf("expected offset %d for the timestamp of offset %d %s, found %d, %v", offset, i, state, found, err)
+			}
+		}
+	}
+	check("once compacted")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l = openLog(t, dir, config)
+	check("once reopened")
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	indexSuffix    = ".index"
+	indexEntrySize = 8
+	// indexIntervalBytes is how many bytes of records are appended to a
+	// segment between two index entries.
+	indexIntervalBytes = 4096
+)
+
+// indexEntry maps the offset of a record, relative to the segment base
+// offset, to its byte position in the segment file.
+type indexEntry struct {
+	offset   uint32
+	position uint32
+}
+
+// index is a sparse offset index of a segment. Entries are kept in memory
+// and appended to the index file as the segment grows.
+type index struct {
+	file    *os.File
+	entries []indexEntry
+}
+
+func openIndex(path string) (*index, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open index file: %w", err)
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot read index file: %w", err)
+	}
+
+	idx := &index{file: file}
+	for i := 0; i+indexEntrySize <= len(data); i += indexEntrySize {
+		idx.entries = append(idx.entries, indexEntry{
+			offset:   binary.BigEndian.Uint32(data[i:]),
+			position: binary.BigEndian.Uint32(data[i+4:]),
+		})
+	}
+	return idx, nil
+}
+
+func (i *index) append(entry indexEntry) error {
+	var raw [indexEntrySize]byte
+	binary.BigEndian.PutUint32(raw[:], entry.offset)
+	binary.BigEndian.PutUint32(raw[4:], entry.position)
+	if _, err := i.file.Write(raw[:]); err != nil {
+		return err
+	}
+	i.entries = append(i.entries, entry)
+	return nil
+}
+
+// lookup returns the last entry whose offset is not greater than offset, or
+// the start of the segment when there is none.
+func (i *index) lookup(offset uint32) indexEntry {
+	n := sort.Search(len(i.entries), func(n int) bool {
+		return i.entries[n].offset > offset
+	})
+	if n == 0 {
+		return indexEntry{}
+	}
+	return i.entries[n-1]
+}
+
+func (i *index) last() indexEntry {
+	if len(i.entries) == 0 {
+		return indexEntry{}
+	}
+	return i.entries[len(i.entries)-1]
+}
+
+// reset removes every entry of the index.
+func (i *index) reset() error {
+	i.entries = nil
+	return i.file.Truncate(0)
+}
+
+// truncate keeps the first n entries of the index.
+func (i *index) truncate(n int) error {
+	i.entries = i.entries[:n]
+	return i.file.Truncate(int64(n) * indexEntrySize)
+}
+
+func (i *index) close() error {
+	return i.file.Close()
+}
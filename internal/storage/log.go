@@ -0,0 +1,520 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+var ErrClosed = entity.ErrClosed
+
+// cleanShutdownFile is written to the log directory when the log is closed.
+const cleanShutdownFile = ".clean_shutdown"
+
+type Config struct {
+	// SegmentBytes is the size after which the active segment is rolled, at
+	// most 4 GiB, which is also the size segments roll at when it is unset.
+	SegmentBytes int64
+	// SegmentAge is the age after which the active segment is rolled.
+	SegmentAge time.Duration
+	// Sync is the durability policy of appends.
+	Sync SyncPolicy
+	// RetentionAge is how long records are kept and RetentionBytes how large
+	// the log may grow before its oldest segments are deleted; zero keeps
+	// records forever.
+	RetentionAge   time.Duration
+	RetentionBytes int64
+	// Compact makes the log keep only the latest record of each key instead
+	// of deleting old segments. Tombstones are kept for DeleteRetention.
+	Compact         bool
+	DeleteRetention time.Duration
+}
+
+// Log is an append-only sequence of records stored as rolled segments in a
+// directory. Each segment file is named after the offset of its first record.
+type Log struct {
+	mu       sync.RWMutex
+	dir      string
+	config   Config
+	segments []*segment
+	closed   bool
+	done     chan struct{}
+	// appended is closed and replaced whenever records become visible,
+	// waking up the readers waiting at the end of the log
+	appended chan struct{}
+
+	// synced is the offset up to which records were fsynced, which readers
+	// do not read past, and unsynced the number of records appended since
+	synced   uint64
+	unsynced int
+	waiters  []syncWaiter
+
+	// compactedOffset is the base offset of the active segment at the last
+	// compaction and tombstones whether that compaction kept any
+	compactedOffset uint64
+	tombstones      bool
+
+	// truncations counts the truncations of the log, which invalidate the
+	// positions of readers
+	truncations int
+}
+
+func Open(dir string, config Config) (*Log, error) {
+	if config.SegmentBytes > maxSegmentBytes {
+		return nil, fmt.Errorf("cannot open log with segments of %d bytes: segments are at most %d bytes", config.SegmentBytes, int64(maxSegmentBytes))
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create log directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read log directory: %w", err)
+	}
+
+	var baseOffsets []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		baseOffsets = append(baseOffsets, base)
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool { return baseOffsets[i] < baseOffsets[j] })
+	if len(baseOffsets) == 0 {
+		baseOffsets = append(baseOffsets, 0)
+	}
+
+	// the marker is only present when the log was closed cleanly; remove it
+	// while the log is open so a crash is noticed on the next start
+	marker := filepath.Join(dir, cleanShutdownFile)
+	_, err = os.Stat(marker)
+	clean := err == nil
+	if clean {
+		if err = os.Remove(marker); err != nil {
+			return nil, fmt.Errorf("cannot remove clean shutdown marker: %w", err)
+		}
+	}
+
+	l := &Log{dir: dir, config: config, done: make(chan struct{}), appended: make(chan struct{})}
+	for i, base := range baseOffsets {
+		s, err := newSegment(dir, base)
+		if err != nil {
+			l.close(false)
+			return nil, err
+		}
+		l.segments = append(l.segments, s)
+
+		err = s.load()
+		if i < len(baseOffsets)-1 {
+			if err != nil {
+				l.close(false)
+				return nil, err
+			}
+			continue
+		}
+		if err != nil || !clean {
+			// the active segment may end with a torn write
+			if err = l.recover(s); err != nil {
+				l.close(false)
+				return nil, err
+			}
+		}
+	}
+
+	// compaction may have removed every record of sealed segments, whose
+	// offsets and timestamps still extend up to the next segment
+	for i, s := range l.segments[:len(l.segments)-1] {
+		s.nextOffset = l.segments[i+1].baseOffset
+		if i > 0 && s.maxTimestamp < l.segments[i-1].maxTimestamp {
+			s.maxTimestamp = l.segments[i-1].maxTimestamp
+		}
+	}
+
+	l.synced = l.active().nextOffset
+	if interval := config.Sync.interval(); interval > 0 {
+		go l.syncPeriodically(interval)
+	}
+	return l, nil
+}
+
+func (l *Log) recover(s *segment) error {
+	truncated, err := s.recover()
+	if err != nil {
+		return fmt.Errorf("cannot recover segment %d: %w", s.baseOffset, err)
+	}
+	if truncated > 0 {
+		log.Printf("%s: truncated %d bytes of incomplete or corrupt records after offset %d\n", l.dir, truncated, s.nextOffset)
+	}
+	if s.size > 0 {
+		log.Printf("%s: rebuilt indexes of segment %d up to offset %d\n", l.dir, s.baseOffset, s.nextOffset)
+	}
+	return nil
+}
+
+// Append writes records as a single batch, stamping them with consecutive
+// offsets and the current time. Timestamps never go backwards within a log,
+// even if the wall clock does. It returns once the batch is synced according
+// to the log sync policy, without holding the log meanwhile so concurrent
+// appends are synced together.
+func (l *Log) Append(records ...Record) ([]Record, error) {
+	if len(records) == 0 {
+		return nil, nil
+	}
+	stamped, synced, err := l.append(records)
+	if err != nil {
+		return nil, err
+	}
+	if err = <-synced; err != nil {
+		return nil, err
+	}
+	return stamped, nil
+}
+
+// append writes records as a single batch, returning the stamped records and
+// the channel receiving the result of their fsync.
+func (l *Log) append(records []Record) ([]Record, chan error, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil, nil, ErrClosed
+	}
+
+	if l.config.Compact {
+		for _, rec := range records {
+			if rec.Key == nil {
+				return nil, nil, ErrMissingKey
+			}
+		}
+	}
+
+	active := l.active()
+	timestamp := time.Now().UnixMilli()
+	if timestamp < active.maxTimestamp {
+		timestamp = active.maxTimestamp
+	}
+	stamped := make([]Record, len(records))
+	for i, rec := range records {
+		rec.Offset = active.nextOffset + uint64(i)
+		rec.Timestamp = timestamp
+		stamped[i] = rec
+	}
+	raw, err := encodeBatch(stamped)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	segmentBytes := l.config.SegmentBytes
+	if segmentBytes <= 0 {
+		segmentBytes = maxSegmentBytes
+	}
+	if active.size > 0 && (active.size+int64(len(raw)) > segmentBytes || active.expired(l.config.SegmentAge)) {
+		if active, err = l.roll(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err = active.write(stamped, raw); err != nil {
+		return nil, nil, err
+	}
+	l.unsynced += len(stamped)
+	return stamped, l.wait(stamped[len(stamped)-1].Offset), nil
+}
+
+// notifyAppended wakes up the readers waiting for records. It must be called
+// with l.mu held.
+func (l *Log) notifyAppended() {
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// roll starts a new active segment. It must be called with l.mu held.
+func (l *Log) roll() (*segment, error) {
+	if l.unsynced > 0 {
+		if err := l.sync(); err != nil {
+			return nil, err
+		}
+	}
+	s, err := newSegment(l.dir, l.active().nextOffset)
+	if err != nil {
+		return nil, err
+	}
+	l.segments = append(l.segments, s)
+	return s, nil
+}
+
+// StartOffset returns the offset of the first record still stored in the
+// log.
+func (l *Log) StartOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.segments[0].baseOffset
+}
+
+// NextOffset returns the high watermark, the offset after the last synced
+// record, which is the offset the next appended record gets once the records
+// being synced are.
+func (l *Log) NextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.synced
+}
+
+// Appended returns a channel closed when the next appended records become
+// visible to readers, or when the log is closed.
+func (l *Log) Appended() <-chan struct{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.appended
+}
+
+// OffsetForTime returns the offset of the first record appended at or after
+// timestamp, in unix milliseconds, or the next offset if there is none.
+func (l *Log) OffsetForTime(timestamp int64) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return 0, ErrClosed
+	}
+
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].maxTimestamp >= timestamp
+	})
+	if i == len(l.segments) {
+		return l.synced, nil
+	}
+	return l.segments[i].offsetForTime(timestamp)
+}
+
+// Truncate removes the records at and after offset.
+func (l *Log) Truncate(offset uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	if offset >= l.active().nextOffset {
+		return nil
+	}
+	if offset < l.segments[0].baseOffset {
+		offset = l.segments[0].baseOffset
+	}
+
+	i := l.segmentIndex(offset)
+	for _, s := range l.segments[i+1:] {
+		if err := s.remove(); err != nil {
+			return fmt.Errorf("cannot remove segment %d: %w", s.baseOffset, err)
+		}
+	}
+	l.segments = l.segments[:i+1]
+	if err := l.segments[i].truncate(offset); err != nil {
+		return fmt.Errorf("cannot truncate segment %d: %w", l.segments[i].baseOffset, err)
+	}
+	if l.synced > offset {
+		l.synced = offset
+	}
+	l.unsynced = int(offset - l.synced)
+	waiting := l.waiters[:0]
+	for _, w := range l.waiters {
+		if w.offset >= offset {
+			w.done <- fmt.Errorf("cannot sync records: log truncated at offset %d", offset)
+		} else {
+			waiting = append(waiting, w)
+		}
+	}
+	l.waiters = waiting
+	l.truncations++
+	log.Printf("%s: truncated at offset %d\n", l.dir, offset)
+	return nil
+}
+
+// Reader returns a reader positioned at the given offset.
+func (l *Log) Reader(offset uint64) entity.LogReader {
+	return &Reader{log: l, offset: offset}
+}
+
+// Close closes the log and marks it as cleanly shut down, so the next Open
+// can skip recovery.
+func (l *Log) Close() error {
+	return l.close(true)
+}
+
+func (l *Log) close(markClean bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+
+	var err error
+	if markClean && l.unsynced > 0 {
+		err = l.sync()
+	}
+	l.closed = true
+	close(l.done)
+	close(l.appended)
+	l.release(math.MaxUint64, ErrClosed)
+
+	for _, s := range l.segments {
+		if e := s.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if err == nil && markClean {
+		err = os.WriteFile(filepath.Join(l.dir, cleanShutdownFile), nil, 0644)
+	}
+	return err
+}
+
+func (l *Log) active() *segment {
+	return l.segments[len(l.segments)-1]
+}
+
+// segmentIndex returns the index of the segment holding offset, which must
+// not be before the start of the log.
+func (l *Log) segmentIndex(offset uint64) int {
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].baseOffset > offset
+	})
+	if i == 0 {
+		return 0
+	}
+	return i - 1
+}
+
+// Reader reads records sequentially from a Log, moving across segment
+// boundaries transparently.
+type Reader struct {
+	log     *Log
+	segment *segment
+	offset  uint64
+	pos     int64
+	pending []Record
+	// truncations is the number of truncations of the log when the reader
+	// was positioned
+	truncations int
+}
+
+// Offset returns the offset of the next record to be read.
+func (r *Reader) Offset() uint64 {
+	return r.offset
+}
+
+// Seek moves the reader to offset.
+func (r *Reader) Seek(offset uint64) {
+	r.offset = offset
+	r.segment = nil
+	r.pending = nil
+}
+
+// Next returns the next record. It returns io.EOF when the reader has caught
+// up with the end of the log and ErrOffsetOutOfRange when its offset was
+// removed by retention.
+func (r *Reader) Next() (Record, error) {
+	r.log.mu.RLock()
+	if r.truncations != r.log.truncations {
+		// the records read ahead may have been removed
+		r.truncations = r.log.truncations
+		r.segment = nil
+		r.pending = nil
+	}
+	r.log.mu.RUnlock()
+
+	for {
+		for len(r.pending) > 0 {
+			rec := r.pending[0]
+			r.pending = r.pending[1:]
+			if rec.Offset >= r.offset {
+				r.offset = rec.Offset + 1
+				return rec, nil
+			}
+		}
+
+		records, err := r.nextBatch()
+		if err != nil {
+			return Record{}, err
+		}
+		r.pending = records
+	}
+}
+
+func (r *Reader) nextBatch() ([]Record, error) {
+	r.log.mu.RLock()
+	if r.log.closed {
+		r.log.mu.RUnlock()
+		return nil, ErrClosed
+	}
+	if r.offset < r.log.segments[0].baseOffset {
+		r.log.mu.RUnlock()
+		return nil, ErrOffsetOutOfRange
+	}
+	active := r.log.active()
+	for {
+		if r.segment == nil || r.segment.deleted || r.offset >= r.segment.nextOffset && r.segment != active {
+			// start from the closest indexed batch of the segment holding
+			// the offset; records before the offset are skipped by Next
+			i := r.log.segmentIndex(r.offset)
+			r.segment = r.log.segments[i]
+			r.pos = r.segment.position(r.offset)
+			if r.offset >= r.segment.nextOffset && r.segment != active {
+				// compaction removed the last records of the segment
+				r.offset = r.log.segments[i+1].baseOffset
+				continue
+			}
+		}
+		if r.pos >= r.segment.size && r.segment != active {
+			// compaction removed the records after the reader position
+			r.offset = r.segment.nextOffset
+			continue
+		}
+		break
+	}
+	if r.offset > r.segment.nextOffset {
+		// the reader is ahead of the log; position it again once the
+		// records up to its offset have been written
+		r.segment = nil
+		r.log.mu.RUnlock()
+		return nil, io.EOF
+	}
+	s := r.segment
+	end := s.nextOffset
+	if end > r.log.synced {
+		end = r.log.synced
+	}
+	r.log.mu.RUnlock()
+
+	if r.offset >= end {
+		return nil, io.EOF
+	}
+
+	records, pos, err := s.readAt(r.pos)
+	if err != nil {
+		r.log.mu.RLock()
+		deleted := s.deleted
+		r.log.mu.RUnlock()
+		if deleted {
+			// the segment was removed by retention while being read
+			return r.nextBatch()
+		}
+		return nil, err
+	}
+	r.pos = pos
+	return records, nil
+}
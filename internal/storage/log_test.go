@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+// openLog opens the log stored in dir, closing it once the test ends.
+func openLog(t *testing.T, dir string, config Config) *Log {
+	t.Helper()
+	l, err := Open(dir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// appendValues appends every value as a batch of its own, returning the
+// records appended.
+func appendValues(t *testing.T, l *Log, values ...string) []Record {
+	t.Helper()
+	var records []Record
+	for _, value := range values {
+		appended, err := l.Append(Record{Value: []byte(value)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, appended...)
+	}
+	return records
+}
+
+// readFrom reads the records of l from offset up to its end.
+func readFrom(t *testing.T, l *Log, offset uint64) []Record {
+	t.Helper()
+	var records []Record
+	reader := l.Reader(offset)
+	for {
+		rec, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("cannot read offset %d: %s", reader.Offset(), err)
+		}
+		records = append(records, rec)
+	}
+}
+
+// checkValues checks records are values at consecutive offsets from offset.
+func checkValues(t *testing.T, records []Record, offset uint64, values ...string) {
+	t.Helper()
+	if len(records) != len(values) {
+		t.Fatalf("expected %d records, found %d", len(values), len(records))
+	}
+	for i, rec := range records {
+		if rec.Offset != offset+uint64(i) || string(rec.Value) != values[i] {
+			t.Errorf("expected %.10s at offset %d, found %.10s at offset %d", values[i], offset+uint64(i), rec.Value, rec.Offset)
+		}
+	}
+}
+
+func TestLogRollsSegmentsAtSegmentBytes(t *testing.T) {
+	dir := t.TempDir()
+	value := strings.Repeat("v", 40)
+	// a batch of a single record is under 100 bytes, so two fit in a
+	// segment
+	l := openLog(t, dir, Config{SegmentBytes: 200})
+	appendValues(t, l, value, value, value, value, value)
+
+	var bases []uint64
+	for _, s := range l.segments {
+		bases = append(bases, s.baseOffset)
+		if _, err := os.Stat(segmentFileName(dir, s.baseOffset, segmentSuffix)); err != nil {
+			t.Error(err)
+		}
+	}
+	if fmt.Sprint(bases) != "[0 2 4]" {
+		t.Errorf("expected segments at offsets [0 2 4], found %v", bases)
+	}
+
+	// records are read across segments, from the log reopened too
+	checkValues(t, readFrom(t, l, 1), 1, value, value, value, value)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l = openLog(t, dir, Config{SegmentBytes: 200})
+	if len(l.segments) != 3 || l.NextOffset() != 5 {
+		t.Errorf("expected 3 segments up to offset 5, found %d up to %d", len(l.segments), l.NextOffset())
+	}
+	checkValues(t, readFrom(t, l, 0), 0, value, value, value, value, value)
+}
+
+func TestLogRollsSegmentsAtTheSizeOfTheirBatches(t *testing.T) {
+	// records without value still fill segments with their headers
+	l := openLog(t, t.TempDir(), Config{SegmentBytes: 200})
+	for i := 0; i < 5; i++ {
+		if _, err := l.Append(Record{Headers: map[string]string{"trace": strings.Repeat("t", 60)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(l.segments) < 3 {
+		t.Errorf("expected the records to be rolled over segments, found %d segments", len(l.segments))
+	}
+	for _, s := range l.segments {
+		if s.size > 200 {
+			t.Errorf("expected segments of at most 200 bytes, found %d bytes in segment %d", s.size, s.baseOffset)
+		}
+	}
+
+	// index positions do not address larger segments
+	if _, err := Open(t.TempDir(), Config{SegmentBytes: math.MaxUint32 + 1}); err == nil {
+		t.Error("expected segments over 4 GiB to be rejected")
+	}
+}
+
+func TestReaderSeeksThroughTheSparseIndex(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, Config{})
+	var values []string
+	for i := 0; i < 200; i++ {
+		values = append(values, fmt.Sprintf("%03d%s", i, strings.Repeat("v", 250)))
+	}
+	appendValues(t, l, values...)
+
+	s := l.active()
+	if len(s.index.entries) < 10 {
+		t.Fatalf("expected an index entry every %d bytes, found %d entries for %d bytes", indexIntervalBytes, len(s.index.entries), s.size)
+	}
+	for _, offset := range []uint64{0, 1, 15, 16, 17, 99, 150, 199} {
+		// the reader starts from the closest indexed batch
+		entry := s.index.lookup(uint32(offset))
+		if uint64(entry.offset) > offset || s.position(offset) != int64(entry.position) {
+			t.Errorf("expected the position of an indexed batch before offset %d, found offset %d at %d", offset, entry.offset, entry.position)
+		}
+		rec, err := l.Reader(offset).Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Offset != offset || string(rec.Value) != values[offset] {
+			t.Errorf("expected %.3s at offset %d, found %.3s at offset %d", values[offset], offset, rec.Value, rec.Offset)
+		}
+	}
+
+	// the index is stored with the segment
+	entries := len(s.index.entries)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l = openLog(t, dir, Config{})
+	if found := len(l.active().index.entries); found != entries {
+		t.Errorf("expected %d index entries once reopened, found %d", entries, found)
+	}
+	checkValues(t, readFrom(t, l, 150), 150, values[150:]...)
+}
+
+func TestOpenTruncatesATornTailAfterAnUncleanShutdown(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for i := 0; i < 50; i++ {
+		values = append(values, fmt.Sprintf("%02d%s", i, strings.Repeat("v", 250)))
+	}
+	appendValues(t, l, values...)
+	complete := l.active().size
+	entries := len(l.active().index.entries)
+	appendValues(t, l, "torn")
+	// the server dies without closing the log
+	l.close(false)
+
+	// only part of the last batch reached the disk
+	name := segmentFileName(dir, 0, segmentSuffix)
+	if err = os.Truncate(name, complete+10); err != nil {
+		t.Fatal(err)
+	}
+
+	l = openLog(t, dir, Config{})
+	if l.NextOffset() != 50 || l.active().size != complete {
+		t.Errorf("expected the log to end at offset 50 and position %d, found %d and %d", complete, l.NextOffset(), l.active().size)
+	}
+	if info, err := os.Stat(name); err != nil || info.Size() != complete {
+		t.Errorf("expected the segment file to be truncated to %d bytes, found %v", complete, err)
+	}
+	if found := len(l.active().index.entries); found != entries {
+		t.Errorf("expected %d index entries rebuilt, found %d", entries, found)
+	}
+	checkValues(t, readFrom(t, l, 45), 45, values[45:]...)
+
+	// appends continue from the last complete batch
+	appendValues(t, l, "appended")
+	checkValues(t, readFrom(t, l, 50), 50, "appended")
+}
+
+func TestOpenTruncatesACorruptTailAfterAnUncleanShutdown(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendValues(t, l, "first", "second")
+	complete := l.active().size
+	appendValues(t, l, "third")
+	size := l.active().size
+	l.close(false)
+
+	// the last batch was written with garbage
+	flipByte(t, dir, 0, size-1)
+
+	l = openLog(t, dir, Config{})
+	if l.NextOffset() != 2 || l.active().size != complete {
+		t.Errorf("expected the log to end at offset 2 and position %d, found %d and %d", complete, l.NextOffset(), l.active().size)
+	}
+	checkValues(t, readFrom(t, l, 0), 0, "first", "second")
+}
+
+func TestFailedWritesAreRemovedWithTheirIndexEntries(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, Config{})
+	value := strings.Repeat("v", 300)
+	// append up to the batch that gets index entries
+	s := l.active()
+	for s.size-s.indexedSize < indexIntervalBytes {
+		appendValues(t, l, value)
+	}
+	size, entries := s.size, len(s.index.entries)
+
+	failure := errors.New("disk full")
+	writeFile = func(file *os.File, raw []byte) (int, error) {
+		n, _ := file.Write(raw[:len(raw)/2])
+		return n, failure
+	}
+	defer func() { writeFile = (*os.File).Write }()
+	if _, err := l.Append(Record{Value: []byte("torn")}); !errors.Is(err, failure) {
+		t.Fatalf("expected the append to fail with %s, found %v", failure, err)
+	}
+	info, err := os.Stat(segmentFileName(dir, 0, segmentSuffix))
+	if err != nil || info.Size() != size || s.size != size {
+		t.Errorf("expected the segment truncated back to %d bytes, found %d, %v", size, s.size, err)
+	}
+	if found := len(s.index.entries); found != entries || len(s.timeIndex.entries) != entries {
+		t.Errorf("expected %d index entries, found %d and %d time index entries", entries, found, len(s.timeIndex.entries))
+	}
+
+	// the next append is written in place of the failed one
+	writeFile = (*os.File).Write
+	next := l.NextOffset()
+	appendValues(t, l, "appended")
+	checkValues(t, readFrom(t, l, next), next, "appended")
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l = openLog(t, dir, Config{})
+	checkValues(t, readFrom(t, l, next), next, "appended")
+}
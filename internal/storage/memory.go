@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// MemoryLog is a Log kept in memory, for tests and embedded brokers that do
+// not need records to outlive the process.
+type MemoryLog struct {
+	mu          sync.RWMutex
+	records     []Record
+	startOffset uint64
+	closed      bool
+	appended    chan struct{}
+}
+
+func NewMemoryLog() *MemoryLog {
+	return &MemoryLog{appended: make(chan struct{})}
+}
+
+// Append stamps records with consecutive offsets and the current time.
+// Timestamps never go backwards within a log.
+func (l *MemoryLog) Append(records ...Record) ([]Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil, ErrClosed
+	}
+	timestamp := time.Now().UnixMilli()
+	if n := len(l.records); n > 0 && timestamp < l.records[n-1].Timestamp {
+		timestamp = l.records[n-1].Timestamp
+	}
+	stamped := make([]Record, len(records))
+	for i, rec := range records {
+		rec.Offset = l.nextOffset() + uint64(i)
+		rec.Timestamp = timestamp
+		stamped[i] = rec
+	}
+	l.records = append(l.records, stamped...)
+	close(l.appended)
+	l.appended = make(chan struct{})
+	return stamped, nil
+}
+
+// Appended returns a channel closed on the next append to the log, or when
+// the log is closed.
+func (l *MemoryLog) Appended() <-chan struct{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.appended
+}
+
+func (l *MemoryLog) Reader(offset uint64) entity.LogReader {
+	return &memoryReader{log: l, offset: offset}
+}
+
+func (l *MemoryLog) StartOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.startOffset
+}
+
+func (l *MemoryLog) NextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.nextOffset()
+}
+
+func (l *MemoryLog) nextOffset() uint64 {
+	return l.startOffset + uint64(len(l.records))
+}
+
+func (l *MemoryLog) OffsetForTime(timestamp int64) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return 0, ErrClosed
+	}
+	i := sort.Search(len(l.records), func(i int) bool {
+		return l.records[i].Timestamp >= timestamp
+	})
+	return l.startOffset + uint64(i), nil
+}
+
+// Truncate removes the records at and after offset.
+func (l *MemoryLog) Truncate(offset uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	if offset < l.startOffset {
+		offset = l.startOffset
+	}
+	if offset < l.nextOffset() {
+		l.records = l.records[:offset-l.startOffset]
+	}
+	return nil
+}
+
+func (l *MemoryLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.appended)
+	}
+	return nil
+}
+
+type memoryReader struct {
+	log    *MemoryLog
+	offset uint64
+}
+
+func (r *memoryReader) Next() (Record, error) {
+	r.log.mu.RLock()
+	defer r.log.mu.RUnlock()
+
+	if r.log.closed {
+		return Record{}, ErrClosed
+	}
+	if r.offset < r.log.startOffset {
+		return Record{}, ErrOffsetOutOfRange
+	}
+	if r.offset >= r.log.nextOffset() {
+		return Record{}, io.EOF
+	}
+	rec := r.log.records[r.offset-r.log.startOffset]
+	r.offset++
+	return rec, nil
+}
+
+func (r *memoryReader) Offset() uint64 {
+	return r.offset
+}
+
+func (r *memoryReader) Seek(offset uint64) {
+	r.offset = offset
+}
+
+// MemoryStorage keeps topics and consumer offsets in memory.
+type MemoryStorage struct {
+	mu         sync.Mutex
+	partitions func(topic string) int
+	logs       map[string][]entity.Log
+	offsets    map[string]uint64
+}
+
+// NewMemoryStorage creates an empty memory storage, partitions returning how
+// many partitions new topics are created with.
+func NewMemoryStorage(partitions func(topic string) int) *MemoryStorage {
+	return &MemoryStorage{
+		partitions: partitions,
+		logs:       make(map[string][]entity.Log),
+		offsets:    make(map[string]uint64),
+	}
+}
+
+func (m *MemoryStorage) Topic(topic string) ([]entity.Log, error) {
+	if err := validTopic(topic); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if logs, ok := m.logs[topic]; ok {
+		return logs, nil
+	}
+	n := m.partitions(topic)
+	if n < 1 {
+		n = 1
+	}
+	logs := make([]entity.Log, n)
+	for i := range logs {
+		logs[i] = NewMemoryLog()
+	}
+	m.logs[topic] = logs
+	return logs, nil
+}
+
+func (m *MemoryStorage) Partition(topic string, partition int) (entity.Log, error) {
+	logs, err := m.Topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	if partition < 0 || partition >= len(logs) {
+		return nil, fmt.Errorf("%w: %s-%d", ErrUnknownPartition, topic, partition)
+	}
+	return logs[partition], nil
+}
+
+func (m *MemoryStorage) Logs() []entity.Log {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var logs []entity.Log
+	for _, partitions := range m.logs {
+		logs = append(logs, partitions...)
+	}
+	return logs
+}
+
+func (m *MemoryStorage) Topics() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	topics := make([]string, 0, len(m.logs))
+	for topic := range m.logs {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func (m *MemoryStorage) Offsets(group, topic string, partition int) (entity.Offsets, error) {
+	return memoryOffsets{storage: m, key: offsetKey(group, topic, partition)}, nil
+}
+
+// Close closes every log; the stored records and offsets are dropped.
+func (m *MemoryStorage) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for topic, partitions := range m.logs {
+		for _, l := range partitions {
+			l.Close()
+		}
+		delete(m.logs, topic)
+	}
+	return nil
+}
+
+func offsetKey(group, topic string, partition int) string {
+	return fmt.Sprintf("%s.%s-%d", group, topic, partition)
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// fileOffsets stores a consumer offset as JSON in a file kept open while the
+// consumer runs.
+type fileOffsets struct {
+	file *os.File
+}
+
+func (o *fileOffsets) Load() (uint64, error) {
+	if _, err := o.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	data, err := io.ReadAll(o.file)
+	if err != nil {
+		return 0, fmt.Errorf("consumer file is corrupted: %w", err)
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	var meta entity.MetaConsumer
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return 0, fmt.Errorf("consumer file is corrupted: %w", err)
+	}
+	return uint64(meta.Offset), nil
+}
+
+func (o *fileOffsets) Store(offset uint64) error {
+	data, err := json.Marshal(entity.MetaConsumer{Offset: uint(offset)})
+	if err != nil {
+		return err
+	}
+	if err = o.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = o.file.WriteAt(data, 0)
+	return err
+}
+
+func (o *fileOffsets) Close() error {
+	return o.file.Close()
+}
+
+// memoryOffsets stores a consumer offset in a MemoryStorage.
+type memoryOffsets struct {
+	storage *MemoryStorage
+	key     string
+}
+
+func (o memoryOffsets) Load() (uint64, error) {
+	o.storage.mu.Lock()
+	defer o.storage.mu.Unlock()
+	return o.storage.offsets[o.key], nil
+}
+
+func (o memoryOffsets) Store(offset uint64) error {
+	o.storage.mu.Lock()
+	defer o.storage.mu.Unlock()
+	o.storage.offsets[o.key] = offset
+	return nil
+}
+
+func (o memoryOffsets) Close() error {
+	return nil
+}
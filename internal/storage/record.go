@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// ErrCorrupt is returned when a stored batch or record fails its checksum or
+// cannot be decoded.
+var ErrCorrupt = entity.ErrCorrupt
+
+var ErrTooLarge = entity.ErrTooLarge
+
+// Records are appended in batches. Every batch and every record inside it is
+// length prefixed and carries a CRC32C of the bytes that follow its checksum,
+// all integers being big endian:
+//
+//	batch:  length uint32 | crc uint32 | magic uint8 | baseOffset uint64 | count uint32 | records
+//	record: length uint32 | crc uint32 | offsetDelta uint32 | timestamp int64 |
+//	        keyLength int32 | key |
+//	        headerCount uint32 | (keyLength uint16 | key | valueLength uint32 | value)... |
+//	        valueLength int32 | value
+//
+// A length of -1 stands for a nil key or value. Batches written with magic 1
+// have no record key and an unsigned value length.
+const (
+	batchMagic       = 2
+	batchHeaderSize  = 21
+	recordHeaderSize = 8
+	maxBatchSize     = 64 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type Record = entity.Record
+
+// encodeBatch encodes records, which must be sorted by offset.
+func encodeBatch(records []Record) ([]byte, error) {
+	raw := make([]byte, batchHeaderSize, batchHeaderSize+64*len(records))
+	raw[8] = batchMagic
+	binary.BigEndian.PutUint64(raw[9:], records[0].Offset)
+	binary.BigEndian.PutUint32(raw[17:], uint32(len(records)))
+
+	for _, rec := range records {
+		start := len(raw)
+		raw = append(raw, make([]byte, recordHeaderSize)...)
+		raw = binary.BigEndian.AppendUint32(raw, uint32(rec.Offset-records[0].Offset))
+		raw = binary.BigEndian.AppendUint64(raw, uint64(rec.Timestamp))
+		raw = appendNullableBytes(raw, rec.Key)
+
+		keys := make([]string, 0, len(rec.Headers))
+		for key := range rec.Headers {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		raw = binary.BigEndian.AppendUint32(raw, uint32(len(keys)))
+		for _, key := range keys {
+			if len(key) > math.MaxUint16 {
+				return nil, fmt.Errorf("%w: header key of %d bytes", ErrTooLarge, len(key))
+			}
+			raw = binary.BigEndian.AppendUint16(raw, uint16(len(key)))
+			raw = append(raw, key...)
+			raw = binary.BigEndian.AppendUint32(raw, uint32(len(rec.Headers[key])))
+			raw = append(raw, rec.Headers[key]...)
+		}
+		raw = appendNullableBytes(raw, rec.Value)
+
+		binary.BigEndian.PutUint32(raw[start:], uint32(len(raw)-start-4))
+		binary.BigEndian.PutUint32(raw[start+4:], crc32.Checksum(raw[start+recordHeaderSize:], crcTable))
+	}
+
+	if len(raw) > maxBatchSize {
+		return nil, ErrTooLarge
+	}
+	binary.BigEndian.PutUint32(raw, uint32(len(raw)-4))
+	binary.BigEndian.PutUint32(raw[4:], crc32.Checksum(raw[8:], crcTable))
+	return raw, nil
+}
+
+// readBatch decodes the batch stored at pos and returns its records along
+// with the position of the next batch. It returns io.EOF when pos is the end
+// of r and io.ErrUnexpectedEOF when the batch is incomplete.
+func readBatch(r io.ReaderAt, pos int64) ([]Record, int64, error) {
+	var size [4]byte
+	n, err := r.ReadAt(size[:], pos)
+	if n == 0 && err == io.EOF {
+		return nil, pos, io.EOF
+	}
+	if n < len(size) {
+		return nil, pos, io.ErrUnexpectedEOF
+	}
+
+	length := binary.BigEndian.Uint32(size[:])
+	if length < batchHeaderSize-4 || length > maxBatchSize {
+		return nil, pos, fmt.Errorf("%w: invalid batch length %d at position %d", ErrCorrupt, length, pos)
+	}
+
+	raw := make([]byte, 4+length)
+	if n, _ = r.ReadAt(raw, pos); n < len(raw) {
+		return nil, pos, io.ErrUnexpectedEOF
+	}
+	if crc := binary.BigEndian.Uint32(raw[4:]); crc != crc32.Checksum(raw[8:], crcTable) {
+		return nil, pos, fmt.Errorf("%w: batch checksum mismatch at position %d", ErrCorrupt, pos)
+	}
+	magic := raw[8]
+	if magic != 1 && magic != batchMagic {
+		return nil, pos, fmt.Errorf("%w: unknown batch magic %d at position %d", ErrCorrupt, raw[8], pos)
+	}
+
+	baseOffset := binary.BigEndian.Uint64(raw[9:])
+	count := binary.BigEndian.Uint32(raw[17:])
+	records := make([]Record, 0, count)
+	data := raw[batchHeaderSize:]
+	for i := uint32(0); i < count; i++ {
+		rec, rest, err := decodeRecord(data, baseOffset, magic)
+		if err != nil {
+			return nil, pos, fmt.Errorf("%w at position %d", err, pos)
+		}
+		records = append(records, rec)
+		data = rest
+	}
+	return records, pos + int64(len(raw)), nil
+}
+
+func decodeRecord(data []byte, baseOffset uint64, magic byte) (Record, []byte, error) {
+	if len(data) < recordHeaderSize {
+		return Record{}, nil, fmt.Errorf("%w: truncated record", ErrCorrupt)
+	}
+	length := binary.BigEndian.Uint32(data)
+	if uint64(length) > uint64(len(data)-4) || length < 4 {
+		return Record{}, nil, fmt.Errorf("%w: invalid record length %d", ErrCorrupt, length)
+	}
+	body, rest := data[recordHeaderSize:4+length], data[4+length:]
+	if crc := binary.BigEndian.Uint32(data[4:]); crc != crc32.Checksum(body, crcTable) {
+		return Record{}, nil, fmt.Errorf("%w: record checksum mismatch", ErrCorrupt)
+	}
+
+	d := decoder{data: body}
+	rec := Record{
+		Offset:    baseOffset + uint64(d.uint32()),
+		Timestamp: int64(d.uint64()),
+	}
+	if magic >= 2 {
+		rec.Key = d.nullableBytes()
+	}
+	if headers := d.uint32(); headers > 0 && d.err == nil {
+		rec.Headers = make(map[string]string, headers)
+		for i := uint32(0); i < headers && d.err == nil; i++ {
+			key := d.bytes(int(d.uint16()))
+			rec.Headers[string(key)] = string(d.bytes(int(d.uint32())))
+		}
+	}
+	if magic >= 2 {
+		rec.Value = d.nullableBytes()
+	} else {
+		rec.Value = d.bytes(int(d.uint32()))
+	}
+	if d.err != nil {
+		return Record{}, nil, d.err
+	}
+	return rec, rest, nil
+}
+
+func appendNullableBytes(raw, b []byte) []byte {
+	if b == nil {
+		return binary.BigEndian.AppendUint32(raw, 0xffffffff)
+	}
+	raw = binary.BigEndian.AppendUint32(raw, uint32(len(b)))
+	return append(raw, b...)
+}
+
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.err = fmt.Errorf("%w: truncated record", ErrCorrupt)
+		return nil
+	}
+	b := d.data[:n:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) nullableBytes() []byte {
+	n := int32(d.uint32())
+	if n == -1 {
+		return nil
+	}
+	return d.bytes(int(n))
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
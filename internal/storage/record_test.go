@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+// flipByte corrupts the byte at pos of the file of the segment at base.
+func flipByte(t *testing.T, dir string, base uint64, pos int64) {
+	t.Helper()
+	file, err := os.OpenFile(segmentFileName(dir, base, segmentSuffix), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	b := make([]byte, 1)
+	if _, err = file.ReadAt(b, pos); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err = file.WriteAt(b, pos); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatchesRoundTrip(t *testing.T) {
+	records := []Record{
+		{Offset: 7, Timestamp: 1000, Key: []byte("id"), Headers: map[string]string{"trace": "abc"}, Value: []byte("raw \x00\n bytes")},
+		{Offset: 8, Timestamp: 1001, Value: nil},
+	}
+	raw, err := encodeBatch(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, next, err := readBatch(bytes.NewReader(raw), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != int64(len(raw)) || len(decoded) != 2 {
+		t.Fatalf("expected 2 records up to %d, found %d up to %d", len(raw), len(decoded), next)
+	}
+	first := decoded[0]
+	if first.Offset != 7 || first.Timestamp != 1000 || string(first.Key) != "id" || first.Headers["trace"] != "abc" || string(first.Value) != "raw \x00\n bytes" {
+		t.Errorf("expected %+v, found %+v", records[0], first)
+	}
+	if decoded[1].Offset != 8 || decoded[1].Timestamp != 1001 || decoded[1].Key != nil || decoded[1].Value != nil {
+		t.Errorf("expected a tombstone without key at offset 8, found %+v", decoded[1])
+	}
+}
+
+func TestReaderDetectsCorruptBatches(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, Config{})
+	appendValues(t, l, "first")
+	first := l.active().size
+	appendValues(t, l, "second", "third")
+
+	// the last byte of the first batch belongs to its value
+	flipByte(t, dir, 0, first-1)
+
+	reader := l.Reader(0)
+	if _, err := reader.Next(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected reading the first batch to fail with %s, found %v", ErrCorrupt, err)
+	}
+	// the reader does not move past the corrupt batch
+	if _, err := reader.Next(); !errors.Is(err, ErrCorrupt) || reader.Offset() != 0 {
+		t.Errorf("expected reading offset 0 to fail again with %s, found %v at offset %d", ErrCorrupt, err, reader.Offset())
+	}
+}
+
+func TestOpenDetectsCorruptSealedSegments(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, Config{SegmentBytes: 1})
+	appendValues(t, l, "first", "second")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the checksum of the batch of the sealed segment
+	flipByte(t, dir, 0, 4)
+
+	if _, err := Open(dir, Config{SegmentBytes: 1}); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected opening the log to fail with %s, found %v", ErrCorrupt, err)
+	}
+}
@@ -0,0 +1,363 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// ErrUnknownPartition is returned for a partition a topic does not have.
+var ErrUnknownPartition = entity.ErrUnknownPartition
+
+const (
+	// legacySuffix names the files topics were stored in, one JSON message
+	// per line, before segmented logs.
+	legacySuffix = ".topic"
+	// migratingSuffix names the partition a legacy topic file is loaded
+	// into, or the unpartitioned topic moved to its first partition, until
+	// the migration is complete.
+	migratingSuffix = ".migrating"
+	// migrateBatch is how many legacy messages are appended per batch.
+	migrateBatch = 1000
+)
+
+// Registry keeps the open partition logs of every topic under a data
+// directory. Partition n of a topic is stored in <path>/<topic>/<n>.
+type Registry struct {
+	mu         sync.Mutex
+	path       string
+	config     func(topic string) Config
+	partitions func(topic string) int
+	logs       map[string][]*Log
+}
+
+// NewRegistry creates a registry of the topics stored under path, config
+// returning the configuration of each topic log and partitions how many
+// partitions new topics are created with.
+func NewRegistry(path string, config func(topic string) Config, partitions func(topic string) int) *Registry {
+	return &Registry{
+		path:       path,
+		config:     config,
+		partitions: partitions,
+		logs:       make(map[string][]*Log),
+	}
+}
+
+// Topic returns the partition logs of a topic, opening them on first use.
+// A topic keeps the partitions found on disk when it was created with more
+// than currently configured.
+func (r *Registry) Topic(topic string) ([]entity.Log, error) {
+	if err := validTopic(topic); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	partitions, err := r.open(topic)
+	if err != nil {
+		return nil, err
+	}
+	logs := make([]entity.Log, len(partitions))
+	for i, l := range partitions {
+		logs[i] = l
+	}
+	return logs, nil
+}
+
+// open returns the partition logs of a topic, opening them if needed. It
+// must be called with r.mu held.
+func (r *Registry) open(topic string) ([]*Log, error) {
+	if partitions, ok := r.logs[topic]; ok {
+		return partitions, nil
+	}
+	if err := r.migrate(topic); err != nil {
+		return nil, err
+	}
+	n := r.partitions(topic)
+	if n < 1 {
+		n = 1
+	}
+	for ; ; n++ {
+		if _, err := os.Stat(r.partitionDir(topic, n)); err != nil {
+			break
+		}
+	}
+
+	partitions := make([]*Log, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := Open(r.partitionDir(topic, i), r.config(topic))
+		if err != nil {
+			for _, l := range partitions {
+				l.Close()
+			}
+			return nil, fmt.Errorf("cannot open partition %d: %w", i, err)
+		}
+		partitions = append(partitions, l)
+	}
+	r.logs[topic] = partitions
+	return partitions, nil
+}
+
+// Partition returns the log of a single partition of a topic.
+func (r *Registry) Partition(topic string, partition int) (entity.Log, error) {
+	partitions, err := r.Topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	if partition < 0 || partition >= len(partitions) {
+		return nil, fmt.Errorf("%w: %s-%d", ErrUnknownPartition, topic, partition)
+	}
+	return partitions[partition], nil
+}
+
+// Logs returns the partition logs opened so far.
+func (r *Registry) Logs() []entity.Log {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var logs []entity.Log
+	for _, partitions := range r.logs {
+		for _, l := range partitions {
+			logs = append(logs, l)
+		}
+	}
+	return logs
+}
+
+func (r *Registry) Topics() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	topics := make([]string, 0, len(r.logs))
+	for topic := range r.logs {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Offsets opens the offset of a consumer group partition, stored in
+// <path>/<group>.<topic>-<partition>.consumer.
+func (r *Registry) Offsets(group, topic string, partition int) (entity.Offsets, error) {
+	name := r.offsetFile(group, topic, partition)
+	if partition == 0 {
+		if err := r.migrateOffsets(group, topic, name); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open consumer file: %w", err)
+	}
+	return &fileOffsets{file: file}, nil
+}
+
+// migrateOffsets moves the offset stored before topics had partitions, in
+// <path>/<group>.<topic>.consumer, to the first partition once the messages
+// it counts were migrated to it.
+func (r *Registry) migrateOffsets(group, topic, name string) error {
+	legacy := filepath.Join(r.path, fmt.Sprintf("%s.%s.consumer", group, topic))
+	if _, err := os.Stat(legacy); err != nil {
+		return nil
+	}
+	if _, err := r.Topic(topic); err != nil {
+		return err
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.Rename(legacy, name); err != nil {
+		return fmt.Errorf("cannot move consumer file: %w", err)
+	}
+	return nil
+}
+
+func (r *Registry) offsetFile(group, topic string, partition int) string {
+	return filepath.Join(r.path, offsetKey(group, topic, partition)+".consumer")
+}
+
+// OpenAll opens the logs of every topic stored under the data directory,
+// recovering the ones that were not closed cleanly.
+func (r *Registry) OpenAll() error {
+	if err := os.MkdirAll(r.path, 0755); err != nil {
+		return fmt.Errorf("cannot create data directory: %w", err)
+	}
+	entries, err := os.ReadDir(r.path)
+	if err != nil {
+		return fmt.Errorf("cannot read data directory: %w", err)
+	}
+	for _, entry := range entries {
+		topic := entry.Name()
+		if !entry.IsDir() {
+			if !strings.HasSuffix(topic, legacySuffix) {
+				continue
+			}
+			topic = strings.TrimSuffix(topic, legacySuffix)
+		} else if strings.HasSuffix(topic, migratingSuffix) {
+			topic = strings.TrimSuffix(topic, migratingSuffix)
+		}
+		if _, err := r.Topic(topic); err != nil {
+			return fmt.Errorf("cannot open topic %s: %w", topic, err)
+		}
+	}
+	return nil
+}
+
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err error
+	for topic, partitions := range r.logs {
+		for _, l := range partitions {
+			if e := l.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+		delete(r.logs, topic)
+	}
+	return err
+}
+
+// migrate moves a topic stored before partitions were introduced, with the
+// segments of its log in <path>/<topic>, to its first partition, and loads a
+// topic stored before segmented logs into it.
+func (r *Registry) migrate(topic string) error {
+	dir := filepath.Join(r.path, topic)
+	migrating := dir + migratingSuffix
+	if _, err := os.Stat(migrating); err == nil {
+		// the move was interrupted after the log left its directory
+		return r.partition(topic, migrating)
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return r.migrateLegacy(topic)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read topic directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), segmentSuffix) {
+			if err = os.Rename(dir, migrating); err != nil {
+				return fmt.Errorf("cannot move topic %s: %w", topic, err)
+			}
+			return r.partition(topic, migrating)
+		}
+	}
+	return r.migrateLegacy(topic)
+}
+
+// partition moves the log of an unpartitioned topic, moved aside to
+// migrating, to the first partition of the topic.
+func (r *Registry) partition(topic, migrating string) error {
+	if err := os.MkdirAll(filepath.Join(r.path, topic), 0755); err != nil {
+		return fmt.Errorf("cannot create topic directory: %w", err)
+	}
+	if err := os.Rename(migrating, r.partitionDir(topic, 0)); err != nil {
+		return fmt.Errorf("cannot move topic %s to partition 0: %w", topic, err)
+	}
+	log.Printf("%s: moved to partition 0\n", filepath.Join(r.path, topic))
+	return nil
+}
+
+// migrateLegacy appends the messages of <path>/<topic>.topic, one JSON
+// message per line, to the first partition of the topic, at the offsets of
+// their lines so the offsets consumers stored for them stay valid. The file
+// is then renamed to <topic>.topic.migrated.
+func (r *Registry) migrateLegacy(topic string) error {
+	name := filepath.Join(r.path, topic+legacySuffix)
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot open topic file: %w", err)
+	}
+	defer file.Close()
+
+	dir := r.partitionDir(topic, 0)
+	if _, err := os.Stat(dir); err == nil {
+		log.Printf("%s: not migrated, %s already exists\n", name, dir)
+		return nil
+	}
+	// a migration interrupted before completing starts over
+	migrating := dir + migratingSuffix
+	if err := os.RemoveAll(migrating); err != nil {
+		return fmt.Errorf("cannot remove incomplete migration: %w", err)
+	}
+	l, err := Open(migrating, Config{})
+	if err != nil {
+		return err
+	}
+	count, err := appendLegacy(l, bufio.NewReader(file))
+	if e := l.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return fmt.Errorf("cannot migrate topic file %s: %w", name, err)
+	}
+	if err = os.Rename(migrating, dir); err != nil {
+		return fmt.Errorf("cannot move migrated topic %s to partition 0: %w", topic, err)
+	}
+	if err = os.Rename(name, name+".migrated"); err != nil {
+		return fmt.Errorf("cannot rename migrated topic file: %w", err)
+	}
+	log.Printf("%s: migrated %d messages to partition 0\n", name, count)
+	return nil
+}
+
+// appendLegacy appends a record for every line of a legacy topic file,
+// keeping lines that are not valid messages as their value.
+func appendLegacy(l *Log, reader *bufio.Reader) (int, error) {
+	count := 0
+	var batch []Record
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return count, err
+		}
+		if len(line) > 0 {
+			line = bytes.TrimSuffix(line, []byte("\n"))
+			record := Record{Value: line}
+			var message entity.Message
+			if json.Unmarshal(line, &message) == nil {
+				record = Record{Headers: message.Headers, Value: []byte(message.Body)}
+			}
+			batch = append(batch, record)
+		}
+		if len(batch) == migrateBatch || err == io.EOF && len(batch) > 0 {
+			if _, err := l.Append(batch...); err != nil {
+				return count, err
+			}
+			count += len(batch)
+			batch = batch[:0]
+		}
+		if err == io.EOF {
+			return count, nil
+		}
+	}
+}
+
+func (r *Registry) partitionDir(topic string, partition int) string {
+	return filepath.Join(r.path, topic, strconv.Itoa(partition))
+}
+
+func validTopic(topic string) error {
+	if topic == "" || topic == "." || topic == ".." || strings.ContainsAny(topic, `/\`) {
+		return fmt.Errorf("%w: %q", entity.ErrInvalidTopic, topic)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openRegistry opens the topics stored in dir, with two partitions for new
+// topics, closing them once the test ends.
+func openRegistry(t *testing.T, dir string) *Registry {
+	t.Helper()
+	r := NewRegistry(dir, func(string) Config { return Config{} }, func(string) int { return 2 })
+	if err := r.OpenAll(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// partitionValues returns the values stored in a partition of topic.
+func partitionValues(t *testing.T, r *Registry, topic string, partition int) []string {
+	t.Helper()
+	l, err := r.Partition(topic, partition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, rec := range readFrom(t, l.(*Log), 0) {
+		values = append(values, string(rec.Value))
+	}
+	return values
+}
+
+func TestRegistryKeepsTopicsNamedLikePartitionsApart(t *testing.T) {
+	dir := t.TempDir()
+	r := openRegistry(t, dir)
+	if _, err := r.Topic("events"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, partition := range []string{"0", "1"} {
+		if _, err := os.Stat(filepath.Join(dir, "events", partition)); err != nil {
+			t.Errorf("expected partition %s stored in the topic directory: %s", partition, err)
+		}
+	}
+
+	// a topic stored before segmented logs under the name of a partition
+	legacy := filepath.Join(dir, "events-1"+legacySuffix)
+	if err := os.WriteFile(legacy, []byte("{\"body\":\"legacy\"}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r = openRegistry(t, dir)
+	if topics := fmt.Sprint(r.Topics()); topics != "[events events-1]" {
+		t.Errorf("expected topics [events events-1], found %s", topics)
+	}
+	if values := fmt.Sprint(partitionValues(t, r, "events-1", 0)); values != "[legacy]" {
+		t.Errorf("expected the legacy topic migrated to its own partition, found %s", values)
+	}
+}
+
+func TestRegistryMovesUnpartitionedTopicsToTheirFirstPartition(t *testing.T) {
+	dir := t.TempDir()
+	// a topic stored before partitions, its log in the topic directory
+	l := openLog(t, filepath.Join(dir, "events"), Config{})
+	appendValues(t, l, "first", "second")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := openRegistry(t, dir)
+	if values := fmt.Sprint(partitionValues(t, r, "events", 0)); values != "[first second]" {
+		t.Errorf("expected the records in partition 0, found %s", values)
+	}
+	if _, err := os.Stat(segmentFileName(filepath.Join(dir, "events", "0"), 0, segmentSuffix)); err != nil {
+		t.Errorf("expected the segment moved to the partition directory: %s", err)
+	}
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// ErrOffsetOutOfRange is returned when reading from an offset that was
+// removed by retention.
+var ErrOffsetOutOfRange = entity.ErrOffsetOutOfRange
+
+// DeleteExpiredSegments removes the oldest segments whose records are older
+// than the retention age or that make the log exceed its retention size,
+// advancing the start offset of the log. It returns how many segments were
+// removed.
+func (l *Log) DeleteExpiredSegments(now time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, ErrClosed
+	}
+	if l.config.Compact {
+		return 0, nil
+	}
+
+	var size int64
+	for _, s := range l.segments {
+		size += s.size
+	}
+
+	deleted := 0
+	for {
+		s := l.segments[0]
+		if s.size == 0 {
+			break
+		}
+		expired := l.config.RetentionAge > 0 && now.Sub(time.UnixMilli(s.maxTimestamp)) > l.config.RetentionAge
+		oversized := l.config.RetentionBytes > 0 && size-s.size >= l.config.RetentionBytes
+		if !expired && !oversized {
+			break
+		}
+		if s == l.active() {
+			// every record of the log expired; keep an empty segment to
+			// append to
+			if _, err := l.roll(); err != nil {
+				return deleted, err
+			}
+		}
+		if err := s.remove(); err != nil {
+			return deleted, fmt.Errorf("cannot remove segment %d: %w", s.baseOffset, err)
+		}
+		l.segments = l.segments[1:]
+		size -= s.size
+		deleted++
+	}
+
+	if deleted > 0 {
+		log.Printf("%s: removed %d expired segments, log starts at offset %d\n", l.dir, deleted, l.segments[0].baseOffset)
+	}
+	return deleted, nil
+}
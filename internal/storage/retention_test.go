@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+// responses collects the responses of a consumer.
+type responses chan entity.Response
+
+func (r responses) WriteResponse(response entity.Response) error {
+	r <- response
+	return nil
+}
+
+// consume starts a consumer of l from offset 0 with the reset policy.
+func consume(t *testing.T, l *Log, policy string) responses {
+	t.Helper()
+	consumer, err := entity.NewConsumer("readers", nil, "events", 0, l, 0, NewMemoryStorage(func(string) int { return 1 }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := make(responses, 10)
+	consumer.OffsetReset = policy
+	consumer.Writer = written
+	go consumer.Start()
+	t.Cleanup(consumer.Stop)
+	return written
+}
+
+func (r responses) next(t *testing.T) entity.Response {
+	t.Helper()
+	select {
+	case response := <-r:
+		return response
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a response")
+	}
+	return entity.Response{}
+}
+
+// expiredLog returns a log of a record per segment whose offsets 0 to 2
+// were removed by retention, keeping offset 3.
+func expiredLog(t *testing.T) *Log {
+	t.Helper()
+	l := openLog(t, t.TempDir(), Config{SegmentBytes: 1, RetentionBytes: 1})
+	appendValues(t, l, "a", "b", "c", "d")
+	if deleted, err := l.DeleteExpiredSegments(time.Now()); err != nil || deleted != 3 {
+		t.Fatalf("expected 3 segments deleted, found %d, %v", deleted, err)
+	}
+	return l
+}
+
+func TestRetentionDeletesTheOldestSegmentsOverRetentionBytes(t *testing.T) {
+	l := expiredLog(t)
+	if l.StartOffset() != 3 || l.NextOffset() != 4 || len(l.segments) != 1 {
+		t.Errorf("expected a segment from offset 3 to 4, found %d segments from %d to %d", len(l.segments), l.StartOffset(), l.NextOffset())
+	}
+	if _, err := l.Reader(2).Next(); !errors.Is(err, ErrOffsetOutOfRange) {
+		t.Errorf("expected reading a removed offset to fail with %s, found %v", ErrOffsetOutOfRange, err)
+	}
+	checkValues(t, readFrom(t, l, 3), 3, "d")
+}
+
+func TestRetentionDeletesSegmentsOlderThanRetentionAge(t *testing.T) {
+	l := openLog(t, t.TempDir(), Config{SegmentBytes: 1, RetentionAge: time.Hour})
+	appendValues(t, l, "a", "b")
+	if deleted, err := l.DeleteExpiredSegments(time.Now()); err != nil || deleted != 0 {
+		t.Errorf("expected no segment deleted within the retention age, found %d, %v", deleted, err)
+	}
+
+	// every record expired, so an empty segment is left to append to
+	if deleted, err := l.DeleteExpiredSegments(time.Now().Add(2 * time.Hour)); err != nil || deleted != 2 {
+		t.Errorf("expected 2 segments deleted, found %d, %v", deleted, err)
+	}
+	if l.StartOffset() != 2 || l.NextOffset() != 2 {
+		t.Errorf("expected an empty log at offset 2, found offsets %d to %d", l.StartOffset(), l.NextOffset())
+	}
+	appendValues(t, l, "c")
+	checkValues(t, readFrom(t, l, 2), 2, "c")
+}
+
+func TestConsumersResetRemovedOffsetsToTheEarliest(t *testing.T) {
+	l := expiredLog(t)
+	written := consume(t, l, entity.OffsetResetEarliest)
+	if response := written.next(t); response.Error != nil || response.Offset != 3 || response.Message.Body != "d" {
+		t.Errorf("expected d at offset 3, found %+v", response)
+	}
+}
+
+func TestConsumersResetRemovedOffsetsToTheLatest(t *testing.T) {
+	l := expiredLog(t)
+	written := consume(t, l, entity.OffsetResetLatest)
+	// let the consumer reset to the end of the log before appending
+	time.Sleep(100 * time.Millisecond)
+	appendValues(t, l, "e")
+	if response := written.next(t); response.Error != nil || response.Offset != 4 || response.Message.Body != "e" {
+		t.Errorf("expected e at offset 4, found %+v", response)
+	}
+}
+
+func TestConsumersFailOnRemovedOffsetsUnderTheErrorPolicy(t *testing.T) {
+	l := expiredLog(t)
+	written := consume(t, l, entity.OffsetResetError)
+	response := written.next(t)
+	if response.Error == nil || response.Error.Code != entity.ErrCodeOffsetOutOfRange {
+		t.Errorf("expected an offset out of range error, found %+v", response)
+	}
+}
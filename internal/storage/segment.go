@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const segmentSuffix = ".log"
+
+// maxSegmentBytes is the size of the largest segment, whose positions index
+// entries hold in 32 bits.
+const maxSegmentBytes = math.MaxUint32
+
+// writeFile writes to a segment file, replaced by tests to make writes fail.
+var writeFile = (*os.File).Write
+
+type segment struct {
+	baseOffset uint64
+	nextOffset uint64
+	size       int64
+	created    time.Time
+	// maxTimestamp is the timestamp of the last record of the segment
+	maxTimestamp int64
+	file         *os.File
+	index        *index
+	timeIndex    *timeIndex
+	// indexedSize is the segment size at the time of the last index entry
+	indexedSize int64
+	deleted     bool
+}
+
+func segmentFileName(dir string, baseOffset uint64, suffix string) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", baseOffset, suffix))
+}
+
+func newSegment(dir string, baseOffset uint64) (*segment, error) {
+	file, err := os.OpenFile(segmentFileName(dir, baseOffset, segmentSuffix), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open segment file: %w", err)
+	}
+
+	s := &segment{
+		baseOffset: baseOffset,
+		nextOffset: baseOffset,
+		created:    time.Now(),
+		file:       file,
+	}
+	if s.index, err = openIndex(segmentFileName(dir, baseOffset, indexSuffix)); err != nil {
+		s.close()
+		return nil, err
+	}
+	if s.timeIndex, err = openTimeIndex(segmentFileName(dir, baseOffset, timeIndexSuffix)); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the batches stored after the last index entry so appends
+// continue from the right offset without scanning the whole segment.
+func (s *segment) load() error {
+	first, _, err := readBatch(s.file, 0)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read segment file: %w", err)
+	}
+	s.created = time.UnixMilli(first[0].Timestamp)
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	entry := s.index.last()
+	if int64(entry.position) > info.Size() {
+		return fmt.Errorf("%w: index points past the end of segment %d", ErrCorrupt, s.baseOffset)
+	}
+	s.nextOffset = s.baseOffset + uint64(entry.offset)
+	s.size = int64(entry.position)
+	s.indexedSize = s.size
+	for {
+		records, pos, err := readBatch(s.file, s.size)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read segment file: %w", err)
+		}
+		last := records[len(records)-1]
+		s.size = pos
+		s.nextOffset = last.Offset + 1
+		s.maxTimestamp = last.Timestamp
+	}
+}
+
+// append writes records, which must start at the segment next offset, as a
+// single batch.
+func (s *segment) append(records []Record) error {
+	raw, err := encodeBatch(records)
+	if err != nil {
+		return err
+	}
+	return s.write(records, raw)
+}
+
+// write writes raw, the encoded batch of records. A failed write is removed
+// along with its index entries, so the next batch is written in its place.
+func (s *segment) write(records []Record, raw []byte) error {
+	entries, timeEntries, indexedSize := len(s.index.entries), len(s.timeIndex.entries), s.indexedSize
+	err := s.indexBatch(records[0])
+	if err == nil {
+		_, err = writeFile(s.file, raw)
+	}
+	if err != nil {
+		if e := s.rollback(entries, timeEntries); e != nil {
+			return fmt.Errorf("%w, then cannot remove the failed write: %s", err, e)
+		}
+		s.indexedSize = indexedSize
+		return err
+	}
+	s.size += int64(len(raw))
+	s.appended(records)
+	return nil
+}
+
+// rollback truncates the segment file back to the segment size and its
+// indexes back to the given number of entries.
+func (s *segment) rollback(entries, timeEntries int) error {
+	if err := s.file.Truncate(s.size); err != nil {
+		return err
+	}
+	if err := s.index.truncate(entries); err != nil {
+		return err
+	}
+	return s.timeIndex.truncate(timeEntries)
+}
+
+// recover validates every batch of the segment, truncates it at the first
+// incomplete or corrupt one and rebuilds its indexes. It returns the number
+// of bytes removed.
+func (s *segment) recover() (int64, error) {
+	info, err := s.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err = s.index.reset(); err != nil {
+		return 0, err
+	}
+	if err = s.timeIndex.reset(); err != nil {
+		return 0, err
+	}
+
+	s.nextOffset = s.baseOffset
+	s.size = 0
+	s.indexedSize = 0
+	for {
+		records, pos, err := readBatch(s.file, s.size)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrCorrupt) || err == nil && records[0].Offset < s.nextOffset {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("cannot read segment file: %w", err)
+		}
+		if err = s.indexBatch(records[0]); err != nil {
+			return 0, err
+		}
+		s.size = pos
+		s.appended(records)
+	}
+
+	truncated := info.Size() - s.size
+	if truncated > 0 {
+		if err = s.file.Truncate(s.size); err != nil {
+			return 0, fmt.Errorf("cannot truncate segment file: %w", err)
+		}
+	}
+	return truncated, nil
+}
+
+// truncate removes the records of the segment at and after offset and
+// rebuilds its indexes.
+func (s *segment) truncate(offset uint64) error {
+	pos := int64(0)
+	if offset > s.baseOffset {
+		pos = s.position(offset)
+	}
+	var keep []Record
+	for pos < s.size {
+		records, next, err := readBatch(s.file, pos)
+		if err != nil {
+			return err
+		}
+		if records[len(records)-1].Offset >= offset {
+			// keep the records of the batch before offset
+			for _, rec := range records {
+				if rec.Offset < offset {
+					keep = append(keep, rec)
+				}
+			}
+			break
+		}
+		pos = next
+	}
+
+	if err := s.file.Truncate(pos); err != nil {
+		return err
+	}
+	s.maxTimestamp = 0
+	if _, err := s.recover(); err != nil {
+		return err
+	}
+	if len(keep) > 0 {
+		return s.append(keep)
+	}
+	return nil
+}
+
+// indexBatch adds index entries for a batch starting with first when enough
+// bytes were written since the last entries.
+func (s *segment) indexBatch(first Record) error {
+	if s.size-s.indexedSize < indexIntervalBytes {
+		return nil
+	}
+	relative := uint32(first.Offset - s.baseOffset)
+	if err := s.index.append(indexEntry{offset: relative, position: uint32(s.size)}); err != nil {
+		return err
+	}
+	if err := s.timeIndex.append(timeIndexEntry{timestamp: first.Timestamp, offset: relative}); err != nil {
+		return err
+	}
+	s.indexedSize = s.size
+	return nil
+}
+
+func (s *segment) appended(records []Record) {
+	if s.nextOffset == s.baseOffset {
+		s.created = time.UnixMilli(records[0].Timestamp)
+	}
+	last := records[len(records)-1]
+	s.nextOffset = last.Offset + 1
+	s.maxTimestamp = last.Timestamp
+}
+
+// position returns the byte position of the closest indexed batch at or
+// before offset.
+func (s *segment) position(offset uint64) int64 {
+	return int64(s.index.lookup(uint32(offset - s.baseOffset)).position)
+}
+
+// offsetForTime returns the offset of the first record of the segment
+// appended at or after timestamp, or the segment next offset if there is
+// none.
+func (s *segment) offsetForTime(timestamp int64) (uint64, error) {
+	if s.maxTimestamp < timestamp {
+		return s.nextOffset, nil
+	}
+	pos := s.position(s.baseOffset + uint64(s.timeIndex.lookup(timestamp).offset))
+	for pos < s.size {
+		records, next, err := readBatch(s.file, pos)
+		if err != nil {
+			return 0, err
+		}
+		for _, rec := range records {
+			if rec.Timestamp >= timestamp {
+				return rec.Offset, nil
+			}
+		}
+		pos = next
+	}
+	return s.nextOffset, nil
+}
+
+// readAt returns the batch starting at the given byte position along with
+// the position of the next batch.
+func (s *segment) readAt(pos int64) ([]Record, int64, error) {
+	records, next, err := readBatch(s.file, pos)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return records, next, err
+}
+
+func (s *segment) expired(maxAge time.Duration) bool {
+	return maxAge > 0 && time.Since(s.created) >= maxAge
+}
+
+// remove closes the segment and deletes its files.
+func (s *segment) remove() error {
+	s.deleted = true
+	err := s.close()
+	for _, suffix := range []string{segmentSuffix, indexSuffix, timeIndexSuffix} {
+		name := filepath.Join(filepath.Dir(s.file.Name()), fmt.Sprintf("%020d%s", s.baseOffset, suffix))
+		if e := os.Remove(name); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// sync fsyncs the segment file and its indexes.
+func (s *segment) sync() error {
+	for _, file := range []*os.File{s.file, s.index.file, s.timeIndex.file} {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("cannot sync %s: %w", file.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (s *segment) close() error {
+	err := s.file.Close()
+	if s.index != nil {
+		if e := s.index.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if s.timeIndex != nil {
+		if e := s.timeIndex.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultSyncInterval bounds how long appends wait for a message count
+// policy to be reached when no interval is configured.
+const defaultSyncInterval = time.Second
+
+// syncFile fsyncs a segment file, replaced by tests to make fsyncs fail.
+var syncFile = (*os.File).Sync
+
+// SyncPolicy controls when appended records are fsynced to disk. Appends
+// return only once their records are synced, unless the policy is never.
+// Readers only see records once they are synced.
+type SyncPolicy struct {
+	// Messages is how many pending records trigger an fsync; 1 syncs every
+	// append.
+	Messages int
+	// Interval is how often pending records are fsynced.
+	Interval time.Duration
+}
+
+var (
+	SyncAlways = SyncPolicy{Messages: 1}
+	SyncNever  = SyncPolicy{}
+)
+
+// ParseSyncPolicy parses "always", "never", a message count such as "100"
+// or an interval such as "200ms".
+func ParseSyncPolicy(value string) (SyncPolicy, error) {
+	switch value {
+	case "always":
+		return SyncAlways, nil
+	case "never", "":
+		return SyncNever, nil
+	}
+	if n, err := strconv.Atoi(value); err == nil && n > 0 {
+		return SyncPolicy{Messages: n}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return SyncPolicy{Interval: d}, nil
+	}
+	return SyncPolicy{}, fmt.Errorf("invalid sync policy: %q", value)
+}
+
+func (p SyncPolicy) enabled() bool {
+	return p.Messages > 0 || p.Interval > 0
+}
+
+func (p SyncPolicy) interval() time.Duration {
+	if p.Interval == 0 && p.Messages > 1 {
+		return defaultSyncInterval
+	}
+	return p.Interval
+}
+
+// syncWaiter is an append waiting for its records up to offset to be
+// synced.
+type syncWaiter struct {
+	offset uint64
+	done   chan error
+}
+
+// wait returns a channel receiving the result of the fsync of the records up
+// to offset, fsyncing the active segment once the policy message count of
+// records is pending. Under the never policy the records are visible at
+// once. It must be called with l.mu held.
+func (l *Log) wait(offset uint64) chan error {
+	done := make(chan error, 1)
+	policy := l.config.Sync
+	if !policy.enabled() {
+		l.synced = l.active().nextOffset
+		l.notifyAppended()
+		done <- nil
+		return done
+	}
+	l.waiters = append(l.waiters, syncWaiter{offset: offset, done: done})
+	if policy.Messages > 0 && l.unsynced >= policy.Messages {
+		// the waiters receive the error
+		l.sync()
+	}
+	return done
+}
+
+// sync fsyncs the active segment, making its records visible and returning
+// the appends waiting for them. When the fsync fails the unsynced records are
+// removed and their appends fail, so records are never read by consumers when
+// their producer was told they were not stored. It must be called with l.mu
+// held.
+func (l *Log) sync() error {
+	active := l.active()
+	if err := syncFile(active.file); err != nil {
+		err = fmt.Errorf("cannot sync segment file: %w", err)
+		end := active.nextOffset
+		if l.synced < end {
+			if e := active.truncate(l.synced); e != nil {
+				log.Printf("%s: cannot remove unsynced records: %s\n", l.dir, e)
+			}
+		}
+		l.unsynced = 0
+		l.release(end, err)
+		return err
+	}
+	l.unsynced = 0
+	if l.synced < active.nextOffset {
+		l.synced = active.nextOffset
+		l.notifyAppended()
+	}
+	l.release(l.synced, nil)
+	return nil
+}
+
+// release sends err to the appends waiting for offsets before end. It must
+// be called with l.mu held.
+func (l *Log) release(end uint64, err error) {
+	waiting := l.waiters[:0]
+	for _, w := range l.waiters {
+		if w.offset < end {
+			w.done <- err
+		} else {
+			waiting = append(waiting, w)
+		}
+	}
+	l.waiters = waiting
+}
+
+// syncPeriodically fsyncs pending records at the policy interval until the
+// log is closed.
+func (l *Log) syncPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			if !l.closed && l.unsynced > 0 {
+				if err := l.sync(); err != nil {
+					log.Printf("%s: %s\n", l.dir, err)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
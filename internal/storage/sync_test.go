@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// unsynced returns how many records of l are not fsynced yet.
+func unsynced(l *Log) int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.unsynced
+}
+
+// appendAsync appends value in the background, returning the channel the
+// append error is sent to.
+func appendAsync(l *Log, value string) chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.Append(Record{Value: []byte(value)})
+		done <- err
+	}()
+	return done
+}
+
+// checkBlocked checks the appends of done are still waiting for an fsync.
+func checkBlocked(t *testing.T, done ...chan error) {
+	t.Helper()
+	time.Sleep(50 * time.Millisecond)
+	for i, d := range done {
+		select {
+		case err := <-d:
+			t.Fatalf("expected append %d to wait for the fsync, found it returned %v", i, err)
+		default:
+		}
+	}
+}
+
+// checkReturned checks the appends of done returned err.
+func checkReturned(t *testing.T, err error, done ...chan error) {
+	t.Helper()
+	for i, d := range done {
+		select {
+		case found := <-d:
+			if !errors.Is(found, err) {
+				t.Errorf("expected append %d to return %v, found %v", i, err, found)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected append %d to return once synced", i)
+		}
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for value, expected := range map[string]SyncPolicy{
+		"always": SyncAlways,
+		"never":  SyncNever,
+		"":       SyncNever,
+		"100":    {Messages: 100},
+		"200ms":  {Interval: 200 * time.Millisecond},
+	} {
+		policy, err := ParseSyncPolicy(value)
+		if err != nil || policy != expected {
+			t.Errorf("expected %q to parse as %+v, found %+v, %v", value, expected, policy, err)
+		}
+	}
+	for _, value := range []string{"0", "-1", "sometimes", "-5s"} {
+		if _, err := ParseSyncPolicy(value); err == nil {
+			t.Errorf("expected %q to be invalid", value)
+		}
+	}
+}
+
+func TestSyncAlwaysSyncsEveryAppend(t *testing.T) {
+	l := openLog(t, t.TempDir(), Config{Sync: SyncAlways})
+	for i := 0; i < 3; i++ {
+		appendValues(t, l, "synced")
+		if n := unsynced(l); n != 0 {
+			t.Errorf("expected append %d to be synced, found %d records unsynced", i, n)
+		}
+	}
+}
+
+func TestSyncMessagesMakesAppendsWaitForTheCountOfRecords(t *testing.T) {
+	// the interval is long enough for the count to trigger the fsync
+	l := openLog(t, t.TempDir(), Config{Sync: SyncPolicy{Messages: 3, Interval: time.Hour}})
+	first, second := appendAsync(l, "first"), appendAsync(l, "second")
+	checkBlocked(t, first, second)
+	// records are not read before they are synced
+	if l.NextOffset() != 0 || len(readFrom(t, l, 0)) != 0 {
+		t.Errorf("expected no record visible before the fsync, found the log up to offset %d", l.NextOffset())
+	}
+
+	appendValues(t, l, "third")
+	checkReturned(t, nil, first, second)
+	if n := unsynced(l); n != 0 {
+		t.Errorf("expected the records to be synced, found %d unsynced", n)
+	}
+	if found := readFrom(t, l, 0); l.NextOffset() != 3 || len(found) != 3 {
+		t.Errorf("expected the 3 records visible once synced, found %d up to offset %d", len(found), l.NextOffset())
+	}
+}
+
+func TestSyncIntervalMakesAppendsWaitForTheNextFsync(t *testing.T) {
+	l := openLog(t, t.TempDir(), Config{Sync: SyncPolicy{Interval: 200 * time.Millisecond}})
+	done := appendAsync(l, "first")
+	checkBlocked(t, done)
+	checkReturned(t, nil, done)
+	if n := unsynced(l); n != 0 {
+		t.Errorf("expected the record to be synced, found %d unsynced", n)
+	}
+}
+
+func TestFailedSyncsFailTheirAppendsAndRemoveTheirRecords(t *testing.T) {
+	l := openLog(t, t.TempDir(), Config{Sync: SyncPolicy{Messages: 2, Interval: time.Hour}})
+	first := appendAsync(l, "first")
+	checkBlocked(t, first)
+	appendValues(t, l, "second")
+	checkReturned(t, nil, first)
+
+	failure := errors.New("disk failure")
+	syncFile = func(*os.File) error { return failure }
+	defer func() { syncFile = (*os.File).Sync }()
+	done := appendAsync(l, "lost")
+	checkBlocked(t, done)
+	if _, err := l.Append(Record{Value: []byte("lost too")}); !errors.Is(err, failure) {
+		t.Errorf("expected the append to fail with %s, found %v", failure, err)
+	}
+	checkReturned(t, failure, done)
+	checkValues(t, readFrom(t, l, 0), 0, "first", "second")
+
+	// appends continue after the last synced record
+	syncFile = (*os.File).Sync
+	checkReturned(t, nil, appendAsync(l, "third"), appendAsync(l, "fourth"))
+	if found := readFrom(t, l, 2); len(found) != 2 || found[0].Offset != 2 || found[1].Offset != 3 {
+		t.Errorf("expected the appends at offsets 2 and 3, found %d records", len(found))
+	}
+}
+
+func TestSyncNeverLeavesRecordsToTheOS(t *testing.T) {
+	l := openLog(t, t.TempDir(), Config{Sync: SyncNever})
+	appendValues(t, l, "first", "second", "third")
+	time.Sleep(50 * time.Millisecond)
+	if n := unsynced(l); n != 3 {
+		t.Errorf("expected 3 records unsynced, found %d", n)
+	}
+
+	// rolling a segment syncs the records of the previous one
+	l = openLog(t, t.TempDir(), Config{Sync: SyncNever, SegmentBytes: 1})
+	appendValues(t, l, "first", "second")
+	if n := unsynced(l); n != 1 {
+		t.Errorf("expected the record of the active segment only unsynced, found %d", n)
+	}
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	timeIndexSuffix    = ".timeindex"
+	timeIndexEntrySize = 12
+)
+
+// timeIndexEntry maps the timestamp of a record to its offset, relative to
+// the segment base offset.
+type timeIndexEntry struct {
+	timestamp int64
+	offset    uint32
+}
+
+// timeIndex is a sparse time index of a segment, written alongside the
+// offset index. Timestamps never decrease within a log, so entries are
+// sorted by both timestamp and offset.
+type timeIndex struct {
+	file    *os.File
+	entries []timeIndexEntry
+}
+
+func openTimeIndex(path string) (*timeIndex, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open time index file: %w", err)
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot read time index file: %w", err)
+	}
+
+	idx := &timeIndex{file: file}
+	for i := 0; i+timeIndexEntrySize <= len(data); i += timeIndexEntrySize {
+		idx.entries = append(idx.entries, timeIndexEntry{
+			timestamp: int64(binary.BigEndian.Uint64(data[i:])),
+			offset:    binary.BigEndian.Uint32(data[i+8:]),
+		})
+	}
+	return idx, nil
+}
+
+func (i *timeIndex) append(entry timeIndexEntry) error {
+	var raw [timeIndexEntrySize]byte
+	binary.BigEndian.PutUint64(raw[:], uint64(entry.timestamp))
+	binary.BigEndian.PutUint32(raw[8:], entry.offset)
+	if _, err := i.file.Write(raw[:]); err != nil {
+		return err
+	}
+	i.entries = append(i.entries, entry)
+	return nil
+}
+
+// lookup returns the last entry whose timestamp is before timestamp, or the
+// start of the segment when there is none.
+func (i *timeIndex) lookup(timestamp int64) timeIndexEntry {
+	n := sort.Search(len(i.entries), func(n int) bool {
+		return i.entries[n].timestamp >= timestamp
+	})
+	if n == 0 {
+		return timeIndexEntry{}
+	}
+	return i.entries[n-1]
+}
+
+// reset removes every entry of the index.
+func (i *timeIndex) reset() error {
+	i.entries = nil
+	return i.file.Truncate(0)
+}
+
+// truncate keeps the first n entries of the index.
+func (i *timeIndex) truncate(n int) error {
+	i.entries = i.entries[:n]
+	return i.file.Truncate(int64(n) * timeIndexEntrySize)
+}
+
+func (i *timeIndex) close() error {
+	return i.file.Close()
+}
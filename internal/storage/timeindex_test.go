@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// appendSpaced appends values at least 2ms apart, so consecutive records
+// have timestamps with a gap between them.
+func appendSpaced(t *testing.T, l *Log, values ...string) []int64 {
+	t.Helper()
+	var timestamps []int64
+	for _, value := range values {
+		time.Sleep(2 * time.Millisecond)
+		for _, rec := range appendValues(t, l, value) {
+			timestamps = append(timestamps, rec.Timestamp)
+		}
+	}
+	return timestamps
+}
+
+// checkOffsetsForTime checks the offset for the timestamp of every record,
+// the timestamps between them, before the first and after the last.
+func checkOffsetsForTime(t *testing.T, l *Log, timestamps []int64) {
+	t.Helper()
+	expected := map[int64]uint64{
+		timestamps[0] - 1000:              0,
+		timestamps[len(timestamps)-1] + 1: uint64(len(timestamps)),
+	}
+	for i, timestamp := range timestamps {
+		expected[timestamp] = uint64(i)
+		expected[timestamp+1] = uint64(i + 1)
+	}
+	for timestamp, offset := range expected {
+		found, err := l.OffsetForTime(timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != offset {
+			t.Errorf("expected offset %d for timestamp %d, found %d", offset, timestamp, found)
+		}
+	}
+}
+
+func TestTimeIndexLookup(t *testing.T) {
+	idx := timeIndex{entries: []timeIndexEntry{
+		{timestamp: 100, offset: 10},
+		{timestamp: 200, offset: 20},
+		{timestamp: 300, offset: 30},
+	}}
+	for timestamp, offset := range map[int64]uint32{
+		50:  0,
+		100: 0,
+		150: 10,
+		200: 10,
+		250: 20,
+		300: 20,
+		350: 30,
+	} {
+		if found := idx.lookup(timestamp).offset; found != offset {
+			t.Errorf("expected the entry at offset %d for timestamp %d, found %d", offset, timestamp, found)
+		}
+	}
+}
+
+func TestOffsetForTimeAcrossSegments(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{SegmentBytes: 200}
+	l := openLog(t, dir, config)
+	timestamps := appendSpaced(t, l, "a", "b", "c", "d", "e", "f")
+	if len(l.segments) < 2 {
+		t.Fatalf("expected the log to roll, found %d segments", len(l.segments))
+	}
+	checkOffsetsForTime(t, l, timestamps)
+
+	// the timestamps are read back from the segments
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l = openLog(t, dir, config)
+	checkOffsetsForTime(t, l, timestamps)
+}
+
+func TestOffsetForTimeThroughTheTimeIndex(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, Config{})
+	values := make([]string, 40)
+	for i := range values {
+		values[i] = strings.Repeat("v", 1000)
+	}
+	timestamps := appendSpaced(t, l, values...)
+	s := l.active()
+	if len(s.timeIndex.entries) < 5 {
+		t.Fatalf("expected a time index entry every %d bytes, found %d entries", indexIntervalBytes, len(s.timeIndex.entries))
+	}
+	for i, timestamp := range timestamps {
+		offset, err := s.offsetForTime(timestamp)
+		if err != nil || offset != uint64(i) {
+			t.Errorf("expected offset %d for timestamp %d, found %d, %v", i, timestamp, offset, err)
+		}
+	}
+	checkOffsetsForTime(t, l, timestamps)
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l = openLog(t, dir, Config{})
+	checkOffsetsForTime(t, l, timestamps)
+}
@@ -1,14 +1,20 @@
 package integration_test
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/rafaelmgr12/kafka-clone/client"
 	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+	"github.com/rafaelmgr12/kafka-clone/internal/protocol"
+	"github.com/rafaelmgr12/kafka-clone/internal/storage"
 )
 
 type CommunicationStage struct {
@@ -16,6 +22,10 @@ type CommunicationStage struct {
 
 	messages            map[string]chan entity.Message
 	consumerConnections map[string]net.Conn
+	// websockets are the consumers streaming over a WebSocket.
+	websockets map[string]bool
+	// clients are the consumers running on a client.Client.
+	clients map[string]*client.Client
 }
 
 func NewCommunicationStage(t *testing.T) (*CommunicationStage, *CommunicationStage, *CommunicationStage) {
@@ -23,8 +33,16 @@ func NewCommunicationStage(t *testing.T) (*CommunicationStage, *CommunicationSta
 		t:                   t,
 		messages:            make(map[string]chan entity.Message),
 		consumerConnections: make(map[string]net.Conn),
+		websockets:          make(map[string]bool),
+		clients:             make(map[string]*client.Client),
 	}
 	cleanUpFiles("data")
+	t.Cleanup(func() {
+		// leave the consumer groups before the next test joins them
+		for _, conn := range stage.consumerConnections {
+			conn.Close()
+		}
+	})
 
 	return &stage, &stage, &stage
 }
@@ -42,17 +60,30 @@ func newConnection() (net.Conn, error) {
 	return conn, nil
 }
 
+// connect opens the connection of a consumer, replacing the one it was
+// running on so the previous connection leaves its consumer group.
+func (s *CommunicationStage) connect(consumer string) (net.Conn, error) {
+	if conn, ok := s.consumerConnections[consumer]; ok {
+		conn.Close()
+	}
+	conn, err := newConnection()
+	if err != nil {
+		return nil, err
+	}
+	s.consumerConnections[consumer] = conn
+	return conn, nil
+}
+
 func (s *CommunicationStage) and() *CommunicationStage {
 	return s
 }
 
 func (s *CommunicationStage) a_consumer_is_running(consumer, topic string) *CommunicationStage {
-	conn, err := newConnection()
+	conn, err := s.connect(consumer)
 	if err != nil {
 		s.t.Error(err)
 		return s
 	}
-	s.consumerConnections[consumer] = conn
 	messages, err := client.Consume(conn, topic, consumer)
 	if err != nil {
 		s.t.Error(err)
@@ -64,6 +95,53 @@ func (s *CommunicationStage) a_consumer_is_running(consumer, topic string) *Comm
 	return s
 }
 
+func (s *CommunicationStage) a_group_member_is_running(member, group, topic, strategy string) *CommunicationStage {
+	conn, err := s.connect(member)
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	messages, err := client.ConsumeWithAssignment(conn, topic, group, strategy)
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+
+	s.messages[member] = messages
+	time.Sleep(100 * time.Millisecond)
+
+	return s
+}
+
+func (s *CommunicationStage) joining_the_group_fails(member, group, topic, strategy string, expected error) *CommunicationStage {
+	conn, err := s.connect(member)
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	if _, err = client.ConsumeWithAssignment(conn, topic, group, strategy); !errors.Is(err, expected) {
+		s.t.Errorf("expected joining group %s to fail with %s, found %v", group, expected, err)
+	}
+	return s
+}
+
+func (s *CommunicationStage) a_consumer_is_running_from(consumer, topic string, since time.Time) *CommunicationStage {
+	conn, err := s.connect(consumer)
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	messages, err := client.ConsumeFrom(conn, topic, consumer, since)
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+
+	s.messages[consumer] = messages
+
+	return s
+}
+
 func (s *CommunicationStage) consumer_is_down(consumer string) *CommunicationStage {
 	conn, ok := s.consumerConnections[consumer]
 	if !ok {
@@ -85,11 +163,50 @@ func (s *CommunicationStage) server_is_down() *CommunicationStage {
 }
 
 func (s *CommunicationStage) server_is_up() *CommunicationStage {
-	serverStartUp <- struct{}{}
+	return s.server_is_up_with(nil)
+}
+
+// server_is_up_with starts the server with storage instead of the files of
+// registry.
+func (s *CommunicationStage) server_is_up_with(storage entity.Storage) *CommunicationStage {
+	serverStartUp <- storage
 	time.Sleep(1 * time.Second)
 	return s
 }
 
+// unavailableTopics is a storage failing to open its topics in failing once.
+type unavailableTopics struct {
+	entity.Storage
+
+	mu      sync.Mutex
+	failing map[string]bool
+}
+
+func (s *unavailableTopics) Topic(topic string) ([]entity.Log, error) {
+	s.mu.Lock()
+	failing := s.failing[topic]
+	delete(s.failing, topic)
+	s.mu.Unlock()
+	if failing {
+		return nil, fmt.Errorf("cannot open topic %s: unavailable", topic)
+	}
+	return s.Storage.Topic(topic)
+}
+
+// no_files_are_stored checks the server stored nothing in the data
+// directory.
+func (s *CommunicationStage) no_files_are_stored() *CommunicationStage {
+	entries, err := os.ReadDir("data")
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	for _, entry := range entries {
+		s.t.Errorf("expected no files stored, found %s", entry.Name())
+	}
+	return s
+}
+
 func (s *CommunicationStage) publish_message(message string, topic string) *CommunicationStage {
 	conn, err := newConnection()
 	if err != nil {
@@ -105,6 +222,79 @@ func (s *CommunicationStage) publish_message(message string, topic string) *Comm
 	return s
 }
 
+func (s *CommunicationStage) publish_is_acknowledged(message, topic string, partition int, offset uint) *CommunicationStage {
+	conn, err := newConnection()
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	defer conn.Close()
+	response, err := client.PublishMessage(conn, topic, entity.Message{Body: message})
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	if response.Topic != topic || response.Partition != partition || response.Offset != offset {
+		s.t.Errorf("expected ack for %s partition %d offset %d, found %s partition %d offset %d", topic, partition, offset, response.Topic, response.Partition, response.Offset)
+	}
+	if response.Timestamp == 0 {
+		s.t.Error("expected ack with the append timestamp")
+	}
+	return s
+}
+
+// message_with_headers_is_published publishes with client.PublishMessage, or
+// with a Client when multiplexed.
+func (s *CommunicationStage) message_with_headers_is_published(message string, headers map[string]string, topic string, multiplexed bool) *CommunicationStage {
+	conn, err := newConnection()
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	defer conn.Close()
+	if multiplexed {
+		_, err = client.NewClient(conn).Publish(topic, entity.Message{Headers: headers, Body: message})
+	} else {
+		_, err = client.PublishMessage(conn, topic, entity.Message{Headers: headers, Body: message})
+	}
+	if err != nil {
+		s.t.Error(err)
+	}
+	return s
+}
+
+// consumer_receives_headers checks the next message of the consumer carries
+// the expected headers and an id.
+func (s *CommunicationStage) consumer_receives_headers(consumer string, expected map[string]string) *CommunicationStage {
+	select {
+	case m := <-s.messages[consumer]:
+		for key, value := range expected {
+			if m.Headers[key] != value {
+				s.t.Errorf("expected header %s=%s, found %v", key, value, m.Headers)
+			}
+		}
+		if m.Headers["id"] == "" {
+			s.t.Errorf("expected an id header, found %v", m.Headers)
+		}
+	case <-time.After(time.Second):
+		s.t.Errorf("consumer %s did not receive a message", consumer)
+	}
+	return s
+}
+
+func (s *CommunicationStage) publish_fails(message, topic string, expected error) *CommunicationStage {
+	conn, err := newConnection()
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	defer conn.Close()
+	if err = client.Publish(conn, message, topic); !errors.Is(err, expected) {
+		s.t.Errorf("expected publishing to %q to fail with %s, found %v", topic, expected, err)
+	}
+	return s
+}
+
 func (s *CommunicationStage) publish_concurrent_messages(count int, topic string) *CommunicationStage {
 	tasks := make(chan string, 1000)
 	var wg sync.WaitGroup
@@ -135,6 +325,522 @@ func (s *CommunicationStage) publish_concurrent_messages(count int, topic string
 	return s
 }
 
+func (s *CommunicationStage) a_fetch_returns(topic string, offset uint, options client.FetchOptions, expected []entity.Message) *CommunicationStage {
+	conn, err := newConnection()
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	c := client.NewClient(conn)
+	defer c.Close()
+	fetched, err := c.Fetch(topic, 0, offset, options)
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	if len(fetched.Messages) != len(expected) {
+		s.t.Errorf("expected %d messages, found %d", len(expected), len(fetched.Messages))
+		return s
+	}
+	for i, m := range fetched.Messages {
+		if m.Body != expected[i].Body || m.Offset != offset+uint(i) {
+			s.t.Errorf("expected message %q at offset %d, found %q at offset %d", expected[i].Body, offset+uint(i), m.Body, m.Offset)
+		}
+	}
+	return s
+}
+
+// a_fetch_is_waiting long polls a partition of topic from offset, delivering
+// the messages it returns as those of consumer.
+func (s *CommunicationStage) a_fetch_is_waiting(consumer, topic string, offset uint, wait time.Duration) *CommunicationStage {
+	conn, err := s.connect(consumer)
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	messages := make(chan entity.Message, 100)
+	s.messages[consumer] = messages
+	go func() {
+		fetched, err := client.NewClient(conn).Fetch(topic, 0, offset, client.FetchOptions{MaxWait: wait})
+		if err != nil {
+			s.t.Error(err)
+			return
+		}
+		for _, m := range fetched.Messages {
+			messages <- m
+		}
+	}()
+	return s
+}
+
+// a_consumer_with_credit_is_held_back consumes topic over the JSON protocol
+// with credit for that many messages, checking no more are sent until one is
+// granted back, and leaves the group with the credit of a single message
+// returned.
+func (s *CommunicationStage) a_consumer_with_credit_is_held_back(consumer, topic string, credit int) *CommunicationStage {
+	conn, err := newConnection()
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	defer conn.Close()
+	codec := protocol.JSON(conn)
+	consume := entity.Command{Type: entity.TypeConsume, Topic: topic, ConsumerName: consumer, Credit: credit, CorrelationID: 1}
+	if err = codec.WriteCommand(consume); err != nil {
+		s.t.Error(err)
+		return s
+	}
+	received := func() int {
+		n := 0
+		for {
+			conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+			response, err := codec.ReadResponse()
+			if err != nil {
+				return n
+			}
+			if response.Body != "" {
+				n++
+			}
+		}
+	}
+	if n := received(); n != credit {
+		s.t.Errorf("expected %d messages sent ahead, found %d", credit, n)
+	}
+	if err = codec.WriteCommand(entity.Command{Type: entity.TypeCredit, Credit: 1, CorrelationID: 1}); err != nil {
+		s.t.Error(err)
+		return s
+	}
+	if n := received(); n != 1 {
+		s.t.Errorf("expected a message per credit granted, found %d", n)
+	}
+	return s
+}
+
+// a_stalled_member_is_running joins group over the JSON protocol without
+// credit and never reads the messages sent to it.
+func (s *CommunicationStage) a_stalled_member_is_running(member, group, topic string) *CommunicationStage {
+	conn, err := s.connect(member)
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	conn.(*net.TCPConn).SetReadBuffer(4096)
+	consume := entity.Command{Type: entity.TypeConsume, Topic: topic, ConsumerName: group, CorrelationID: 1}
+	if err = protocol.JSON(conn).WriteCommand(consume); err != nil {
+		s.t.Error(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	return s
+}
+
+// large_messages_are_published publishes count messages of size bytes, more
+// than the connection of a stalled member buffers.
+func (s *CommunicationStage) large_messages_are_published(count, size int, topic string) *CommunicationStage {
+	conn, err := newConnection()
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	c := client.NewClient(conn)
+	defer c.Close()
+	body := strings.Repeat("x", size)
+	for i := 0; i < count; i++ {
+		if _, err = c.Publish(topic, entity.Message{Body: body}); err != nil {
+			s.t.Error(err)
+			return s
+		}
+	}
+	// let the consumers block writing to the stalled connections
+	time.Sleep(200 * time.Millisecond)
+	return s
+}
+
+// a_consumer_joins_within runs a consumer, checking the broker acknowledges
+// its consume command within latency.
+func (s *CommunicationStage) a_consumer_joins_within(consumer, topic string, latency time.Duration) *CommunicationStage {
+	joined := make(chan struct{})
+	go func() {
+		defer close(joined)
+		s.a_consumer_is_running(consumer, topic)
+	}()
+	select {
+	case <-joined:
+	case <-time.After(latency):
+		s.t.Fatalf("consumer %s did not join %s within %s", consumer, topic, latency)
+	}
+	return s
+}
+
+// a_client_consumer_is_running joins the group consumer of topic with a
+// client.Client, which the commit stages commit with.
+func (s *CommunicationStage) a_client_consumer_is_running(consumer, topic string, options client.ConsumeOptions) *CommunicationStage {
+	conn, err := s.connect(consumer)
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	c := client.NewClient(conn)
+	messages, err := c.Consume(topic, consumer, options)
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	s.messages[consumer] = messages
+	s.clients[consumer] = c
+	return s
+}
+
+// expired_messages_are_removed applies the retention of the partitions of
+// topic, as the broker does periodically.
+func (s *CommunicationStage) expired_messages_are_removed(topic string) *CommunicationStage {
+	partitions, err := registry.Topic(topic)
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	for _, partition := range partitions {
+		if _, err = partition.(*storage.Log).DeleteExpiredSegments(time.Now()); err != nil {
+			s.t.Error(err)
+		}
+	}
+	return s
+}
+
+// a_client_consumer_fails joins the group with a Client and checks its
+// channel is closed after a message carrying the expected error.
+func (s *CommunicationStage) a_client_consumer_fails(consumer, topic string, options client.ConsumeOptions, expected error) *CommunicationStage {
+	conn, err := s.connect(consumer)
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	messages, err := client.NewClient(conn).Consume(topic, consumer, options)
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	select {
+	case m := <-messages:
+		if !errors.Is(m.Err, expected) {
+			s.t.Errorf("expected consumer %s to fail with %s, found %v", consumer, expected, m.Err)
+		}
+	case <-time.After(time.Second):
+		s.t.Errorf("consumer %s did not fail", consumer)
+		return s
+	}
+	select {
+	case m, ok := <-messages:
+		if ok {
+			s.t.Errorf("expected the channel of consumer %s closed, found %v", consumer, m)
+		}
+	case <-time.After(time.Second):
+		s.t.Errorf("expected the channel of consumer %s closed", consumer)
+	}
+	return s
+}
+
+func (s *CommunicationStage) offset_is_committed(consumer, topic string, partition int, offset uint, async bool) *CommunicationStage {
+	c, ok := s.clients[consumer]
+	if !ok {
+		s.t.Errorf("no client consumer %s running", consumer)
+		return s
+	}
+	var err error
+	if async {
+		err = <-c.CommitAsync(topic, consumer, partition, offset)
+	} else {
+		err = c.Commit(topic, consumer, partition, offset)
+	}
+	if err != nil {
+		s.t.Error(err)
+	}
+	return s
+}
+
+func (s *CommunicationStage) commit_fails(consumer, topic string, partition int, offset uint, expected error) *CommunicationStage {
+	c, ok := s.clients[consumer]
+	if !ok {
+		s.t.Errorf("no client consumer %s running", consumer)
+		return s
+	}
+	if err := c.Commit(topic, consumer, partition, offset); !errors.Is(err, expected) {
+		s.t.Errorf("expected commit to fail with %s, found %v", expected, err)
+	}
+	return s
+}
+
+// a_queue_member_is_running joins the queue group of topic as member, with
+// a client.Client the ack stages ack with.
+func (s *CommunicationStage) a_queue_member_is_running(member, group, topic string, options client.QueueOptions) *CommunicationStage {
+	conn, err := s.connect(member)
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	c := client.NewClient(conn)
+	messages, err := c.Queue(topic, group, options)
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	s.messages[member] = messages
+	s.clients[member] = c
+	return s
+}
+
+// queue_member_receives receives the next message of member, checking its
+// body, and acks it when ack is set.
+func (s *CommunicationStage) queue_member_receives(member, group, topic, body string, ack bool) *CommunicationStage {
+	select {
+	case m := <-s.messages[member]:
+		if m.Body != body {
+			s.t.Errorf("expected %s to receive %s, found %s", member, body, m.Body)
+		}
+		if !ack {
+			return s
+		}
+		if err := s.clients[member].Ack(topic, group, m); err != nil {
+			s.t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		s.t.Errorf("%s did not receive %s", member, body)
+	}
+	return s
+}
+
+// queue_member_nacks receives the next message of member, checking its body
+// and delivery attempt, and nacks it for reason.
+func (s *CommunicationStage) queue_member_nacks(member, group, topic, body string, attempt int, reason string) *CommunicationStage {
+	select {
+	case m := <-s.messages[member]:
+		if m.Body != body {
+			s.t.Errorf("expected %s to receive %s, found %s", member, body, m.Body)
+		}
+		if found := m.Headers[entity.HeaderDeliveryAttempt]; found != strconv.Itoa(attempt) {
+			s.t.Errorf("expected delivery attempt %d of %s, found %q", attempt, body, found)
+		}
+		if err := s.clients[member].Nack(topic, group, m, reason); err != nil {
+			s.t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		s.t.Errorf("%s did not receive %s", member, body)
+	}
+	return s
+}
+
+// queue_member_nack_fails nacks the next message of member for reason,
+// checking the nack fails.
+func (s *CommunicationStage) queue_member_nack_fails(member, group, topic, body string, reason string) *CommunicationStage {
+	select {
+	case m := <-s.messages[member]:
+		if m.Body != body {
+			s.t.Errorf("expected %s to receive %s, found %s", member, body, m.Body)
+		}
+		if err := s.clients[member].Nack(topic, group, m, reason); err == nil {
+			s.t.Errorf("expected nack of %s to fail", body)
+		}
+	case <-time.After(2 * time.Second):
+		s.t.Errorf("%s did not receive %s", member, body)
+	}
+	return s
+}
+
+// backoff_elapses waits for the messages nacked with backoff to be retried.
+func (s *CommunicationStage) backoff_elapses(backoff time.Duration) *CommunicationStage {
+	time.Sleep(backoff + 500*time.Millisecond)
+	return s
+}
+
+func (s *CommunicationStage) ack_fails(member, group, topic string, partition int, offset uint, expected error) *CommunicationStage {
+	message := entity.Message{Partition: partition, Offset: offset}
+	if err := s.clients[member].Ack(topic, group, message); !errors.Is(err, expected) {
+		s.t.Errorf("expected ack to fail with %s, found %v", expected, err)
+	}
+	return s
+}
+
+// queue_members_ack_messages_once acks the messages the queue members
+// receive, checking every message is delivered once and every member gets
+// some of the count messages.
+func (s *CommunicationStage) queue_members_ack_messages_once(group, topic string, count int, members ...string) *CommunicationStage {
+	received := make(map[string]string)
+	perMember := make(map[string]int)
+	done := make(chan struct{})
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, member := range members {
+		messages, ok := s.messages[member]
+		if !ok {
+			s.t.Errorf("no queue member %s running", member)
+			return s
+		}
+		wg.Add(1)
+		go func(member string, messages chan entity.Message) {
+			defer wg.Done()
+			for {
+				select {
+				case m := <-messages:
+					mu.Lock()
+					if other, ok := received[m.Body]; ok {
+						s.t.Errorf("message %s delivered to %s and %s", m.Body, other, member)
+					}
+					received[m.Body] = member
+					perMember[member]++
+					mu.Unlock()
+					// take a while, so the other members get messages
+					time.Sleep(20 * time.Millisecond)
+					if err := s.clients[member].Ack(topic, group, m); err != nil {
+						s.t.Error(err)
+					}
+				case <-done:
+					return
+				}
+			}
+		}(member, messages)
+	}
+	time.Sleep(600 * time.Millisecond)
+	close(done)
+	wg.Wait()
+
+	if len(received) != count {
+		s.t.Errorf("expected %d messages, found %d", count, len(received))
+	}
+	for _, member := range members {
+		if perMember[member] == 0 {
+			s.t.Errorf("expected %s to receive messages", member)
+		}
+	}
+	return s
+}
+
+// a_client_consumes_and_publishes consumes topic and concurrently publishes
+// count messages to it, all over the single connection of a client.
+func (s *CommunicationStage) a_client_consumes_and_publishes(consumer, topic string, count int) *CommunicationStage {
+	conn, err := s.connect(consumer)
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	c := client.NewClient(conn)
+	messages, err := c.Consume(topic, consumer, client.ConsumeOptions{})
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	// keep receiving while publishing, as the acks share the connection
+	received := make(chan entity.Message, count)
+	go func() {
+		for m := range messages {
+			received <- m
+		}
+	}()
+	s.messages[consumer] = received
+
+	var wg sync.WaitGroup
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			defer wg.Done()
+			message := entity.Message{Body: fmt.Sprintf("concurrent message %d", i)}
+			if _, err := c.Publish(topic, message); err != nil {
+				s.t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return s
+}
+
+// a_client_publishes_raw_bytes publishes a message whose key and body are
+// not valid UTF-8, which only the binary protocol can carry.
+func (s *CommunicationStage) a_client_publishes_raw_bytes(consumer, topic, key, body string) *CommunicationStage {
+	conn, err := s.connect(consumer)
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	c := client.NewClient(conn)
+	messages, err := c.Consume(topic, consumer, client.ConsumeOptions{})
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	received := make(chan entity.Message, 1)
+	go func() {
+		for m := range messages {
+			received <- m
+		}
+	}()
+	s.messages[consumer] = received
+
+	if _, err = c.Publish(topic, entity.Message{Key: key, Body: body}); err != nil {
+		s.t.Error(err)
+	}
+	return s
+}
+
+func (s *CommunicationStage) consumer_receives_raw_bytes(consumer, key, body string) *CommunicationStage {
+	select {
+	case m := <-s.messages[consumer]:
+		if m.Key != key || m.Body != body {
+			s.t.Errorf("expected key %q and body %q, found key %q and body %q", key, body, m.Key, m.Body)
+		}
+	case <-time.After(time.Second):
+		s.t.Errorf("consumer %s did not receive the message", consumer)
+	}
+	return s
+}
+
+func (s *CommunicationStage) broker_supports_versions(commandType int, min, max int16) *CommunicationStage {
+	conn, err := newConnection()
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	defer conn.Close()
+	versions, err := client.NewClient(conn).ApiVersions()
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	for _, v := range versions {
+		if v.Type == commandType {
+			if v.MinVersion != min || v.MaxVersion != max {
+				s.t.Errorf("expected versions %d to %d of command type %d, found %d to %d", min, max, commandType, v.MinVersion, v.MaxVersion)
+			}
+			return s
+		}
+	}
+	s.t.Errorf("command type %d is not supported", commandType)
+	return s
+}
+
+// a_command_with_version_fails sends a command encoded with version, as a
+// client newer than the broker would.
+func (s *CommunicationStage) a_command_with_version_fails(commandType int, version int16, expected entity.ErrorCode) *CommunicationStage {
+	conn, err := newConnection()
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	defer conn.Close()
+	codec := protocol.JSON(conn)
+	err = codec.WriteCommand(entity.Command{Type: commandType, Topic: "versions", Version: version, CorrelationID: 1})
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	response, err := codec.ReadResponse()
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	if response.Error == nil || response.Error.Code != expected {
+		s.t.Errorf("expected command to fail with %s, found %+v", expected, response.Error)
+	}
+	return s
+}
+
 func (s *CommunicationStage) consumer_receives_messages(consumer string, expectedMessages []entity.Message) *CommunicationStage {
 	i := 0
 
@@ -169,6 +875,37 @@ FOR:
 	return s
 }
 
+// message_is_consumed_within publishes a message to a consumer idle at the
+// end of the topic and checks it is received within the given latency.
+func (s *CommunicationStage) message_is_consumed_within(consumer, topic, message string, latency time.Duration) *CommunicationStage {
+	conn, err := newConnection()
+	if err != nil {
+		s.t.Error(err)
+		return s
+	}
+	defer conn.Close()
+	// let the consumer catch up and wait at the end of the topic
+	time.Sleep(200 * time.Millisecond)
+
+	published := time.Now()
+	if _, err = client.PublishMessage(conn, topic, entity.Message{Body: message}); err != nil {
+		s.t.Error(err)
+		return s
+	}
+	select {
+	case m := <-s.messages[consumer]:
+		if m.Body != message {
+			s.t.Errorf("expected message %s, found %s", message, m.Body)
+		}
+		if elapsed := time.Since(published); elapsed > latency {
+			s.t.Errorf("expected message within %s, received after %s", latency, elapsed)
+		}
+	case <-time.After(time.Second):
+		s.t.Errorf("consumer %s did not receive %s", consumer, message)
+	}
+	return s
+}
+
 func (s *CommunicationStage) consumer_receives_concurrent_messages(count int, consumer string) *CommunicationStage {
 	expectedMessages := make(map[string]bool)
 
@@ -217,3 +954,71 @@ FOR:
 
 	return s
 }
+
+func (s *CommunicationStage) consumer_receives_messages_from_partitions(count, partitions int, consumer string) *CommunicationStage {
+	if _, ok := s.messages[consumer]; !ok {
+		s.t.Errorf("no consumer %s running", consumer)
+		return s
+	}
+
+	found := make(map[int]bool)
+	i := 0
+	timer := time.NewTimer(600 * time.Millisecond)
+FOR:
+	for {
+		select {
+		case m := <-s.messages[consumer]:
+			found[m.Partition] = true
+			i++
+		case <-timer.C:
+			break FOR
+		}
+	}
+
+	if i != count {
+		s.t.Errorf("expected %d messages, found %d", count, i)
+	}
+	if len(found) != partitions {
+		s.t.Errorf("expected messages from %d partitions, found %d", partitions, len(found))
+	}
+	return s
+}
+
+func (s *CommunicationStage) members_receive_messages_once(count int, members ...string) *CommunicationStage {
+	received := make(map[string]string)
+	done := make(chan struct{})
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, member := range members {
+		messages, ok := s.messages[member]
+		if !ok {
+			s.t.Errorf("no consumer %s running", member)
+			return s
+		}
+		wg.Add(1)
+		go func(member string, messages chan entity.Message) {
+			defer wg.Done()
+			for {
+				select {
+				case m := <-messages:
+					mu.Lock()
+					if other, ok := received[m.Body]; ok {
+						s.t.Errorf("message %s received by %s and %s", m.Body, other, member)
+					}
+					received[m.Body] = member
+					mu.Unlock()
+				case <-done:
+					return
+				}
+			}
+		}(member, messages)
+	}
+	time.Sleep(600 * time.Millisecond)
+	close(done)
+	wg.Wait()
+
+	if len(received) != count {
+		s.t.Errorf("expected %d messages, found %d", count, len(received))
+	}
+	return s
+}
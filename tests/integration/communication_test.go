@@ -1,10 +1,15 @@
 package integration_test
 
 import (
+	"fmt"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/rafaelmgr12/kafka-clone/client"
 	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+	"github.com/rafaelmgr12/kafka-clone/internal/storage"
 )
 
 func TestSendOneMessage(t *testing.T) {
@@ -241,3 +246,429 @@ func TestConsumerRestartsFromOffsetWhenServerWentDown(t *testing.T) {
 	}
 	then.consumer_receives_messages(consumer, messages)
 }
+
+func TestConsumerStartsFromTimestamp(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	consumer := "audit"
+	topic := "customers"
+
+	id := uuid.NewString()
+	given.publish_message("messagem com id"+id, topic)
+
+	since := time.Now()
+	when.publish_message("messagem2 com id"+id, topic).and().
+		publish_message("messagem3 com id"+id, topic).and().
+		a_consumer_is_running_from(consumer, topic, since)
+
+	messages := []entity.Message{
+		{
+			Body: "messagem2 com id" + id,
+		},
+		{
+			Body: "messagem3 com id" + id,
+		},
+	}
+	then.consumer_receives_messages(consumer, messages)
+}
+
+func TestConsumerReadsEveryPartition(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	consumer := "billing"
+	topic := "orders"
+	given.a_consumer_is_running(consumer, topic)
+
+	when.publish_concurrent_messages(9, topic)
+
+	then.consumer_receives_messages_from_partitions(9, 3, consumer)
+}
+
+func TestGroupMembersShareTheTopicPartitions(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	topic := "orders"
+	given.a_group_member_is_running("worker1", "workers", topic, entity.AssignRange).
+		and().a_group_member_is_running("worker2", "workers", topic, entity.AssignRange)
+
+	when.publish_concurrent_messages(9, topic)
+
+	then.members_receive_messages_once(9, "worker1", "worker2")
+
+	when.consumer_is_down("worker1").
+		and().publish_concurrent_messages(9, topic)
+
+	then.consumer_receives_concurrent_messages(9, "worker2")
+}
+
+func TestGroupRejectsAnotherAssignmentStrategy(t *testing.T) {
+	given, _, then := NewCommunicationStage(t)
+
+	topic := "orders"
+	given.a_group_member_is_running("worker1", "pickers", topic, entity.AssignRange)
+
+	then.joining_the_group_fails("worker2", "pickers", topic, entity.AssignRoundRobin, client.ErrInconsistentGroupProtocol).
+		and().joining_the_group_fails("worker3", "packers", topic, "sticky", client.ErrInvalidRequest)
+}
+
+func TestPublishIsAcknowledged(t *testing.T) {
+	_, when, then := NewCommunicationStage(t)
+
+	topic := "payments"
+	when.publish_is_acknowledged("first payment", topic, 0, 0)
+	then.publish_is_acknowledged("second payment", topic, 0, 1)
+
+	when.publish_fails("invalid topic", "payments/refunds", client.ErrInvalidTopic)
+}
+
+func TestPublishKeepsMessageHeaders(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	consumer := "tracer"
+	topic := "traces"
+	given.a_consumer_is_running(consumer, topic)
+
+	when.message_with_headers_is_published("span 1", map[string]string{"trace": "4bf92f"}, topic, false).and().
+		message_with_headers_is_published("span 2", map[string]string{"id": "span-2"}, topic, false).and().
+		message_with_headers_is_published("span 3", map[string]string{"trace": "00f067"}, topic, true).and().
+		message_with_headers_is_published("span 4", map[string]string{"id": "span-4"}, topic, true)
+
+	then.consumer_receives_headers(consumer, map[string]string{"trace": "4bf92f"}).and().
+		consumer_receives_headers(consumer, map[string]string{"id": "span-2"}).and().
+		consumer_receives_headers(consumer, map[string]string{"trace": "00f067"}).and().
+		consumer_receives_headers(consumer, map[string]string{"id": "span-4"})
+}
+
+func TestClientPublishesAndConsumesOverOneConnection(t *testing.T) {
+	_, when, then := NewCommunicationStage(t)
+
+	consumer := "audit"
+	topic := "orders"
+	when.a_client_consumes_and_publishes(consumer, topic, 30)
+
+	then.consumer_receives_concurrent_messages(30, consumer)
+}
+
+func TestBinaryProtocolCarriesRawBytes(t *testing.T) {
+	_, when, then := NewCommunicationStage(t)
+
+	consumer := "archive"
+	key, body := "\x00\xff", "\x00\x01\xfe\xff\"\n"
+	when.a_client_publishes_raw_bytes(consumer, "blobs", key, body)
+
+	then.consumer_receives_raw_bytes(consumer, key, body)
+}
+
+func TestClientNegotiatesVersions(t *testing.T) {
+	_, _, then := NewCommunicationStage(t)
+
+	then.broker_supports_versions(entity.TypePublish, 0, 0).
+		and().broker_supports_versions(entity.TypeApiVersions, 0, 0).
+		and().a_command_with_version_fails(entity.TypeMetadata, 1, entity.ErrCodeUnsupportedVersion)
+}
+
+func TestBrokerWithMemoryStorage(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	consumer := "memory"
+	topic := "customers"
+	given.server_is_down().and().
+		server_is_up_with(storage.NewMemoryStorage(func(string) int { return 1 }))
+	t.Cleanup(func() {
+		given.server_is_down().and().
+			server_is_up()
+	})
+	given.a_consumer_is_running(consumer, topic)
+
+	when.publish_message("kept in memory", topic)
+
+	then.consumer_receives_messages(consumer, []entity.Message{{Body: "kept in memory"}}).and().
+		no_files_are_stored()
+}
+
+func TestHTTPGatewayPublishesAndReads(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	consumer := "dashboard"
+	topic := "metrics"
+	given.a_consumer_is_running(consumer, topic)
+
+	messages := []entity.Message{
+		{Key: "cpu", Body: "42"},
+		{Key: "cpu", Body: "43"},
+	}
+	when.message_is_published_over_http(messages[0], topic, 0).and().
+		message_is_published_over_http(messages[1], topic, 1)
+
+	then.consumer_receives_messages(consumer, messages).and().
+		messages_are_read_over_http(topic, 0, 10, messages).and().
+		messages_are_read_over_http(topic, 1, 1, messages[1:])
+}
+
+func TestHTTPGatewayCommitsOffsets(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	topic := "reports"
+	given.message_is_published_over_http(entity.Message{Body: "daily"}, topic, 0)
+
+	when.offset_is_committed_over_http("archiver", topic, 0, 1)
+
+	then.committed_offset_over_http_is("archiver", topic, 0, 1).and().
+		http_request_fails(http.MethodPost, "/topics/"+topic+"/messages", "not json", http.StatusBadRequest, entity.ErrCodeInvalidRequest).and().
+		http_request_fails(http.MethodGet, "/topics/"+topic+"/messages?partition=5", "", http.StatusNotFound, entity.ErrCodeUnknownTopic).and().
+		http_request_fails(http.MethodGet, "/groups/archiver/offsets/"+topic+"/x", "", http.StatusBadRequest, entity.ErrCodeInvalidRequest)
+}
+
+func TestHTTPGatewayCommitsForGroupMembers(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	consumer := "bookkeeper"
+	topic := "receipts"
+	for i := 1; i <= 3; i++ {
+		given.publish_is_acknowledged(fmt.Sprintf("receipt %d", i), topic, 0, uint(i-1))
+	}
+	given.a_client_consumer_is_running(consumer, topic, client.ConsumeOptions{ManualCommit: true}).and().
+		consumer_receives_messages(consumer, []entity.Message{{Body: "receipt 1"}, {Body: "receipt 2"}, {Body: "receipt 3"}}).and().
+		offset_is_committed(consumer, topic, 0, 3, false)
+
+	// the member leaving stores its offset, which is the one committed
+	when.offset_is_committed_over_http(consumer, topic, 0, 1).and().
+		consumer_is_down(consumer)
+
+	then.http_request_fails(http.MethodPost, "/groups/"+consumer+"/offsets/"+topic+"/0", `{"offset": 10}`, http.StatusRequestedRangeNotSatisfiable, entity.ErrCodeOffsetOutOfRange).and().
+		a_consumer_is_running(consumer, topic).and().
+		consumer_receives_messages(consumer, []entity.Message{{Body: "receipt 2"}, {Body: "receipt 3"}}).and().
+		committed_offset_over_http_is(consumer, topic, 0, 3)
+}
+
+func TestStreamsTopicAsServerSentEvents(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	topic := "alerts"
+	given.message_is_published_over_http(entity.Message{Body: "disk full"}, topic, 0).and().
+		a_stream_is_running("tail", "/topics/"+topic+"/stream?offset=0", false)
+
+	when.publish_message("disk cleaned", topic)
+
+	then.consumer_receives_messages("tail", []entity.Message{
+		{Body: "disk full"},
+		{Body: "disk cleaned"},
+	})
+}
+
+func TestStreamsConsumerGroupOverWebSocket(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	topic := "quotes"
+	given.a_stream_is_running("board", "/topics/"+topic+"/stream?consumer=board", true)
+
+	id := uuid.NewString()
+	when.publish_message("quote "+id, topic)
+
+	then.consumer_receives_messages("board", []entity.Message{{Body: "quote " + id}})
+
+	when.the_stream_is_closed("board").and().
+		a_stream_is_running("board-replica", "/topics/"+topic+"/stream?consumer=board", true).and().
+		publish_message("quote 2 "+id, topic)
+
+	then.consumer_receives_messages("board-replica", []entity.Message{{Body: "quote 2 " + id}})
+}
+
+func TestFetchLongPollsForMessages(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	topic := "ledger"
+	given.publish_is_acknowledged("first entry", topic, 0, 0).and().
+		a_fetch_is_waiting("auditor", topic, 1, 5*time.Second)
+
+	when.publish_message("second entry", topic)
+
+	then.consumer_receives_messages("auditor", []entity.Message{{Body: "second entry"}}).and().
+		a_fetch_returns(topic, 0, client.FetchOptions{}, []entity.Message{{Body: "first entry"}, {Body: "second entry"}}).and().
+		a_fetch_returns(topic, 0, client.FetchOptions{MaxMessages: 1}, []entity.Message{{Body: "first entry"}}).and().
+		a_fetch_returns(topic, 2, client.FetchOptions{MaxWait: 100 * time.Millisecond}, []entity.Message{})
+}
+
+func TestConsumerCreditHoldsBackMessages(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	consumer := "worker"
+	topic := "jobs"
+	for i := 1; i <= 5; i++ {
+		given.publish_is_acknowledged(fmt.Sprintf("job %d", i), topic, 0, uint(i-1))
+	}
+
+	when.a_consumer_with_credit_is_held_back(consumer, topic, 2)
+
+	// only the first message was processed, the next ones are sent again
+	then.committed_offset_over_http_is(consumer, topic, 0, 1).and().
+		a_consumer_is_running(consumer, topic).and().
+		consumer_receives_messages(consumer, []entity.Message{
+			{Body: "job 2"}, {Body: "job 3"}, {Body: "job 4"}, {Body: "job 5"},
+		})
+}
+
+func TestIdleConsumerIsWokenUpByPublish(t *testing.T) {
+	given, _, then := NewCommunicationStage(t)
+
+	consumer := "ticker"
+	topic := "prices"
+	given.a_consumer_is_running(consumer, topic)
+
+	then.message_is_consumed_within(consumer, topic, "price 1", 100*time.Millisecond).and().
+		message_is_consumed_within(consumer, topic, "price 2", 100*time.Millisecond)
+}
+
+func TestStalledGroupMemberDoesNotBlockTheBroker(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	group := "exporters"
+	topic := "metrics"
+	given.a_stalled_member_is_running("stalled", group, topic).and().
+		large_messages_are_published(256, 64<<10, topic)
+
+	// the rebalance waits for the consumer blocked writing to the stalled
+	// member without holding up the other groups
+	when.a_group_member_is_running("healthy", group, topic, "")
+
+	then.a_consumer_joins_within("pager", "incidents", time.Second).and().
+		message_is_consumed_within("pager", "incidents", "incident 1", 100*time.Millisecond)
+}
+
+func TestConsumerCommitsOffsetsExplicitly(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	consumer := "billing"
+	topic := "payments"
+	for i := 1; i <= 3; i++ {
+		given.publish_is_acknowledged(fmt.Sprintf("payment %d", i), topic, 0, uint(i-1))
+	}
+
+	when.a_client_consumer_is_running(consumer, topic, client.ConsumeOptions{ManualCommit: true})
+
+	then.consumer_receives_messages(consumer, []entity.Message{{Body: "payment 1"}, {Body: "payment 2"}, {Body: "payment 3"}}).and().
+		committed_offset_over_http_is(consumer, topic, 0, 0)
+
+	when.offset_is_committed(consumer, topic, 0, 1, false).and().
+		offset_is_committed(consumer, topic, 0, 2, true)
+
+	then.committed_offset_over_http_is(consumer, topic, 0, 2).and().
+		commit_fails(consumer, topic, 0, 10, client.ErrOffsetOutOfRange).and().
+		commit_fails(consumer, topic, 1, 0, client.ErrNotAssigned).and().
+		a_consumer_is_running(consumer, topic).and().
+		consumer_receives_messages(consumer, []entity.Message{{Body: "payment 3"}})
+}
+
+func TestConsumerFailsOnceItsOffsetExpired(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	topic := "expiring"
+	for i := 1; i <= 3; i++ {
+		given.publish_is_acknowledged(fmt.Sprintf("reading %d", i), topic, 0, uint(i-1))
+	}
+
+	when.expired_messages_are_removed(topic)
+
+	then.a_client_consumer_fails("sensor", topic, client.ConsumeOptions{OffsetReset: entity.OffsetResetError}, client.ErrOffsetOutOfRange)
+}
+
+func TestConsumerAutoCommitsProcessedMessages(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	consumer := "dispatch"
+	topic := "shipments"
+	for i := 1; i <= 3; i++ {
+		given.publish_is_acknowledged(fmt.Sprintf("shipment %d", i), topic, 0, uint(i-1))
+	}
+
+	when.a_client_consumer_is_running(consumer, topic, client.ConsumeOptions{AutoCommitInterval: 50 * time.Millisecond})
+
+	// the last message received is not processed yet
+	then.consumer_receives_messages(consumer, []entity.Message{{Body: "shipment 1"}, {Body: "shipment 2"}, {Body: "shipment 3"}}).and().
+		committed_offset_over_http_is(consumer, topic, 0, 2).and().
+		a_consumer_is_running(consumer, topic).and().
+		consumer_receives_messages(consumer, []entity.Message{{Body: "shipment 3"}})
+}
+
+func TestQueueDeliversEveryMessageToOneMember(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	group := "renderers"
+	topic := "renders"
+	given.a_queue_member_is_running("renderer1", group, topic, client.QueueOptions{}).
+		and().a_queue_member_is_running("renderer2", group, topic, client.QueueOptions{})
+
+	for i := 1; i <= 6; i++ {
+		when.publish_is_acknowledged(fmt.Sprintf("render %d", i), topic, 0, uint(i-1))
+	}
+
+	then.queue_members_ack_messages_once(group, topic, 6, "renderer1", "renderer2").and().
+		committed_offset_over_http_is(group, topic, 0, 6)
+}
+
+func TestQueueRedeliversMessagesNotAcked(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	group := "thumbnailers"
+	topic := "thumbnails"
+	given.publish_is_acknowledged("thumbnail 1", topic, 0, 0).and().
+		publish_is_acknowledged("thumbnail 2", topic, 0, 1).and().
+		a_queue_member_is_running("stalled", group, topic, client.QueueOptions{VisibilityTimeout: 200 * time.Millisecond})
+
+	when.queue_member_receives("stalled", group, topic, "thumbnail 1", false).and().
+		a_queue_member_is_running("healthy", group, topic, client.QueueOptions{})
+
+	// the message of the stalled member is delivered again once its
+	// visibility timeout expires, the healthy member getting the next one
+	then.queue_member_receives("healthy", group, topic, "thumbnail 2", true).and().
+		queue_member_receives("healthy", group, topic, "thumbnail 1", true).and().
+		ack_fails("stalled", group, topic, 0, 0, client.ErrNotAssigned).and().
+		committed_offset_over_http_is(group, topic, 0, 2)
+}
+
+func TestQueueMovesMessagesNackedTooOftenToTheDeadLetterTopic(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	group := "billers"
+	topic := "invoices"
+	options := client.QueueOptions{MaxAttempts: 2, RetryBackoff: 50 * time.Millisecond}
+	given.publish_is_acknowledged("invoice 1", topic, 0, 0).and().
+		publish_is_acknowledged("invoice 2", topic, 0, 1).and().
+		a_queue_member_is_running("biller", group, topic, options)
+
+	// the nacked message is delivered again after the backoff, then moved
+	// to the dead-letter topic on its last attempt
+	when.queue_member_nacks("biller", group, topic, "invoice 1", 1, "card declined").and().
+		queue_member_receives("biller", group, topic, "invoice 2", true).and().
+		queue_member_nacks("biller", group, topic, "invoice 1", 2, "card expired")
+
+	then.dead_letter_is_read_over_http(topic, 0, "invoice 1", 0, 2, "card expired").and().
+		committed_offset_over_http_is(group, topic, 0, 2).and().
+		ack_fails("biller", group, topic, 0, 0, client.ErrNotAssigned)
+}
+
+func TestQueueKeepsTheNackReasonWhenMovingToTheDeadLetterTopicFails(t *testing.T) {
+	given, when, then := NewCommunicationStage(t)
+
+	group := "payers"
+	topic := "payments"
+	options := client.QueueOptions{MaxAttempts: 1, RetryBackoff: 50 * time.Millisecond}
+	given.server_is_down().and().
+		server_is_up_with(&unavailableTopics{
+			Storage: storage.NewMemoryStorage(func(string) int { return 1 }),
+			failing: map[string]bool{entity.DeadLetterTopic(topic): true},
+		})
+	t.Cleanup(func() {
+		given.server_is_down().and().
+			server_is_up()
+	})
+	given.publish_is_acknowledged("payment 1", topic, 0, 0).and().
+		a_queue_member_is_running("payer", group, topic, options)
+
+	// the message is moved once the dead-letter topic opens, with the
+	// reason it was nacked for
+	when.queue_member_nack_fails("payer", group, topic, "payment 1", "insufficient funds").and().
+		backoff_elapses(options.RetryBackoff)
+
+	then.dead_letter_is_read_over_http(topic, 0, "payment 1", 0, 1, "insufficient funds")
+}
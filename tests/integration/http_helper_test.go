@@ -0,0 +1,250 @@
+package integration_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
+)
+
+const gatewayURL = "http://localhost:9004"
+
+// httpRequest sends a request to the HTTP gateway and decodes its JSON reply
+// into value.
+func (s *CommunicationStage) httpRequest(method, path, body string, value any) int {
+	req, err := http.NewRequest(method, gatewayURL+path, strings.NewReader(body))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(value); err != nil {
+		s.t.Errorf("invalid reply to %s %s: %s", method, path, err)
+	}
+	return resp.StatusCode
+}
+
+func (s *CommunicationStage) message_is_published_over_http(message entity.Message, topic string, offset uint) *CommunicationStage {
+	body, err := json.Marshal(message)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	var response entity.Response
+	status := s.httpRequest(http.MethodPost, "/topics/"+topic+"/messages", string(body), &response)
+	if status != http.StatusOK || response.Error != nil {
+		s.t.Errorf("expected publish to succeed, found status %d and error %v", status, response.Error)
+		return s
+	}
+	if response.Topic != topic || response.Offset != offset || response.Timestamp == 0 {
+		s.t.Errorf("expected ack for %s offset %d, found %+v", topic, offset, response)
+	}
+	return s
+}
+
+func (s *CommunicationStage) messages_are_read_over_http(topic string, offset, limit int, expected []entity.Message) *CommunicationStage {
+	var messages []entity.Message
+	path := fmt.Sprintf("/topics/%s/messages?offset=%d&limit=%d", topic, offset, limit)
+	if status := s.httpRequest(http.MethodGet, path, "", &messages); status != http.StatusOK {
+		s.t.Errorf("expected read to succeed, found status %d", status)
+		return s
+	}
+	if len(messages) != len(expected) {
+		s.t.Errorf("expected %d messages, found %d", len(expected), len(messages))
+		return s
+	}
+	for i, m := range messages {
+		if m.Key != expected[i].Key || m.Body != expected[i].Body || m.Offset != uint(offset+i) {
+			s.t.Errorf("expected message %+v at offset %d, found %+v", expected[i], offset+i, m)
+		}
+	}
+	return s
+}
+
+// dead_letter_is_read_over_http checks the message at offset of the
+// dead-letter topic of topic was moved from partition 0 of topic at
+// source, after attempts deliveries, for reason.
+func (s *CommunicationStage) dead_letter_is_read_over_http(topic string, offset int, body string, source uint, attempts int, reason string) *CommunicationStage {
+	var messages []entity.Message
+	path := fmt.Sprintf("/topics/%s/messages?offset=%d&limit=1", entity.DeadLetterTopic(topic), offset)
+	if status := s.httpRequest(http.MethodGet, path, "", &messages); status != http.StatusOK || len(messages) != 1 {
+		s.t.Errorf("expected a dead letter at offset %d, found %d messages with status %d", offset, len(messages), status)
+		return s
+	}
+	expected := map[string]string{
+		entity.HeaderDeliveryAttempt:     strconv.Itoa(attempts),
+		entity.HeaderDeadLetterReason:    reason,
+		entity.HeaderDeadLetterTopic:     topic,
+		entity.HeaderDeadLetterPartition: "0",
+		entity.HeaderDeadLetterOffset:    strconv.FormatUint(uint64(source), 10),
+	}
+	m := messages[0]
+	if m.Body != body {
+		s.t.Errorf("expected dead letter %s, found %s", body, m.Body)
+	}
+	for key, value := range expected {
+		if m.Headers[key] != value {
+			s.t.Errorf("expected header %s of dead letter %s to be %q, found %q", key, body, value, m.Headers[key])
+		}
+	}
+	return s
+}
+
+func (s *CommunicationStage) offset_is_committed_over_http(group, topic string, partition int, offset uint64) *CommunicationStage {
+	var response map[string]any
+	path := fmt.Sprintf("/groups/%s/offsets/%s/%d", group, topic, partition)
+	status := s.httpRequest(http.MethodPost, path, fmt.Sprintf(`{"offset": %d}`, offset), &response)
+	if status != http.StatusOK {
+		s.t.Errorf("expected offset commit to succeed, found status %d: %v", status, response)
+	}
+	return s
+}
+
+func (s *CommunicationStage) committed_offset_over_http_is(group, topic string, partition int, expected uint64) *CommunicationStage {
+	var response struct {
+		Offset uint64 `json:"offset"`
+	}
+	path := fmt.Sprintf("/groups/%s/offsets/%s/%d", group, topic, partition)
+	status := s.httpRequest(http.MethodGet, path, "", &response)
+	if status != http.StatusOK || response.Offset != expected {
+		s.t.Errorf("expected committed offset %d, found %d with status %d", expected, response.Offset, status)
+	}
+	return s
+}
+
+func (s *CommunicationStage) http_request_fails(method, path, body string, status int, code entity.ErrorCode) *CommunicationStage {
+	var response entity.Response
+	found := s.httpRequest(method, path, body, &response)
+	if found != status || response.Error == nil || response.Error.Code != code {
+		s.t.Errorf("expected %s %s to fail with status %d and %s, found status %d and %v", method, path, status, code, found, response.Error)
+	}
+	return s
+}
+
+// a_stream_is_running subscribes to a stream of the HTTP gateway, over a
+// WebSocket or as server-sent events, forwarding the messages streamed as
+// those of consumer.
+func (s *CommunicationStage) a_stream_is_running(consumer, path string, websocket bool) *CommunicationStage {
+	if conn, ok := s.consumerConnections[consumer]; ok {
+		conn.Close()
+	}
+	conn, err := net.Dial("tcp", "localhost:9004")
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.consumerConnections[consumer] = conn
+	s.websockets[consumer] = websocket
+
+	request := "GET " + path + " HTTP/1.1\r\nHost: localhost\r\n"
+	if websocket {
+		request += "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n"
+		request += "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+	}
+	if _, err = io.WriteString(conn, request+"\r\n"); err != nil {
+		s.t.Fatal(err)
+	}
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	if _, err = reader.ReadLine(); err != nil {
+		s.t.Fatal(err)
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if websocket && header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		s.t.Fatalf("expected websocket handshake, found %v", header)
+	}
+	if !websocket && header.Get("Content-Type") != "text/event-stream" {
+		s.t.Fatalf("expected event stream, found %v", header)
+	}
+
+	readResponse := func() (entity.Response, error) {
+		var response entity.Response
+		var payload []byte
+		if websocket {
+			var frame [4]byte
+			if _, err := io.ReadFull(reader.R, frame[:2]); err != nil {
+				return response, err
+			}
+			length := int(frame[1])
+			if length == 126 {
+				if _, err := io.ReadFull(reader.R, frame[2:4]); err != nil {
+					return response, err
+				}
+				length = int(binary.BigEndian.Uint16(frame[2:4]))
+			}
+			payload = make([]byte, length)
+			if _, err := io.ReadFull(reader.R, payload); err != nil {
+				return response, err
+			}
+			if frame[0]&0x0f == 0x8 {
+				return response, io.EOF
+			}
+		} else {
+			line, err := reader.R.ReadBytes('\n')
+			if err != nil {
+				return response, err
+			}
+			payload = bytes.TrimPrefix(line, []byte("data: "))
+			// skip the line ending the event
+			if _, err = reader.R.ReadBytes('\n'); err != nil {
+				return response, err
+			}
+		}
+		err := json.Unmarshal(payload, &response)
+		return response, err
+	}
+	// the subscription is acknowledged before the first message
+	if response, err := readResponse(); err != nil || response.Error != nil {
+		s.t.Errorf("expected the stream to be acknowledged, found %v and %v", response.Error, err)
+		return s
+	}
+
+	messages := make(chan entity.Message, 100)
+	s.messages[consumer] = messages
+	go func() {
+		for {
+			response, err := readResponse()
+			if err != nil {
+				return
+			}
+			var m entity.Message
+			if err = json.Unmarshal([]byte(response.Body), &m); err != nil {
+				s.t.Errorf("invalid message streamed: %s", err)
+				return
+			}
+			messages <- m
+		}
+	}()
+	return s
+}
+
+// the_stream_is_closed closes the stream of consumer, with a close frame
+// when it streams over a WebSocket.
+func (s *CommunicationStage) the_stream_is_closed(consumer string) *CommunicationStage {
+	conn := s.consumerConnections[consumer]
+	if s.websockets[consumer] {
+		// masked close frame with status 1000
+		frame := []byte{0x88, 0x82, 1, 2, 3, 4, 0x03 ^ 1, 0xe8 ^ 2}
+		if _, err := conn.Write(frame); err != nil {
+			s.t.Error(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	conn.Close()
+	delete(s.consumerConnections, consumer)
+	time.Sleep(100 * time.Millisecond)
+	return s
+}
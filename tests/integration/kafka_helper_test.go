@@ -0,0 +1,355 @@
+package integration_test
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// KafkaStage speaks the Kafka protocol to the broker, encoding requests by
+// hand as an off-the-shelf Kafka client would.
+type KafkaStage struct {
+	t *testing.T
+
+	conn          net.Conn
+	correlationID int32
+}
+
+type kafkaRecord struct {
+	offset     int64
+	key, value string
+}
+
+func NewKafkaStage(t *testing.T) (*KafkaStage, *KafkaStage, *KafkaStage) {
+	stage := KafkaStage{t: t}
+	cleanUpFiles("data")
+	conn, err := net.Dial("tcp", "localhost:9003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage.conn = conn
+	t.Cleanup(func() { conn.Close() })
+	return &stage, &stage, &stage
+}
+
+func (s *KafkaStage) and() *KafkaStage {
+	return s
+}
+
+// request sends a request with a v1 header and returns the response body.
+func (s *KafkaStage) request(key, version int16, body []byte) *kafkaDecoder {
+	s.correlationID++
+	raw := binary.BigEndian.AppendUint32(nil, uint32(10+len("tests")+len(body)))
+	raw = binary.BigEndian.AppendUint16(raw, uint16(key))
+	raw = binary.BigEndian.AppendUint16(raw, uint16(version))
+	raw = binary.BigEndian.AppendUint32(raw, uint32(s.correlationID))
+	raw = appendKafkaString(raw, "tests")
+	raw = append(raw, body...)
+	if _, err := s.conn.Write(raw); err != nil {
+		s.t.Fatal(err)
+	}
+
+	s.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var size [4]byte
+	if _, err := io.ReadFull(s.conn, size[:]); err != nil {
+		s.t.Fatal(err)
+	}
+	response := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(s.conn, response); err != nil {
+		s.t.Fatal(err)
+	}
+	d := &kafkaDecoder{data: response}
+	if id := d.int32(); id != s.correlationID {
+		s.t.Fatalf("expected correlation id %d, found %d", s.correlationID, id)
+	}
+	return d
+}
+
+func (s *KafkaStage) api_versions_are_negotiated() *KafkaStage {
+	// a newer client first tries a version the broker does not serve
+	d := s.request(18, 3, nil)
+	if code := d.int16(); code != 35 {
+		s.t.Errorf("expected UNSUPPORTED_VERSION for api versions v3, found %d", code)
+	}
+
+	d = s.request(18, 2, nil)
+	if code := d.int16(); code != 0 {
+		s.t.Errorf("expected api versions v2 to succeed, found error %d", code)
+	}
+	produce := false
+	for i, n := 0, int(d.int32()); i < n; i++ {
+		key, min, max := d.int16(), d.int16(), d.int16()
+		if key == 0 && min <= 3 && max >= 3 {
+			produce = true
+		}
+	}
+	if !produce {
+		s.t.Error("expected produce v3 to be supported")
+	}
+	return s
+}
+
+func (s *KafkaStage) a_record_is_produced(topic string, partition int32, key, value string, offset int64) *KafkaStage {
+	body := binary.BigEndian.AppendUint16(nil, 0xffff)
+	body = binary.BigEndian.AppendUint16(body, 0xffff)
+	body = binary.BigEndian.AppendUint32(body, 1000)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = appendKafkaString(body, topic)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = binary.BigEndian.AppendUint32(body, uint32(partition))
+	batch := encodeKafkaBatch(key, value)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(batch)))
+	body = append(body, batch...)
+
+	d := s.request(0, 3, body)
+	d.int32()
+	d.string()
+	d.int32()
+	d.int32()
+	code, baseOffset, appendTime := d.int16(), d.int64(), d.int64()
+	if code != 0 || baseOffset != offset {
+		s.t.Errorf("expected record stored at offset %d, found offset %d and error %d", offset, baseOffset, code)
+	}
+	if appendTime <= 0 {
+		s.t.Errorf("expected the append time, found %d", appendTime)
+	}
+	return s
+}
+
+func (s *KafkaStage) records_are_fetched(topic string, partition int32, offset int64, expected []kafkaRecord) *KafkaStage {
+	body := binary.BigEndian.AppendUint32(nil, 0xffffffff)
+	body = binary.BigEndian.AppendUint32(body, 100)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = binary.BigEndian.AppendUint32(body, 1<<20)
+	body = append(body, 0)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = appendKafkaString(body, topic)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = binary.BigEndian.AppendUint32(body, uint32(partition))
+	body = binary.BigEndian.AppendUint64(body, uint64(offset))
+	body = binary.BigEndian.AppendUint32(body, 1<<20)
+
+	d := s.request(1, 4, body)
+	d.int32()
+	d.int32()
+	d.string()
+	d.int32()
+	d.int32()
+	if code := d.int16(); code != 0 {
+		s.t.Errorf("expected fetch to succeed, found error %d", code)
+		return s
+	}
+	d.int64()
+	d.int64()
+	d.int32()
+	records := decodeKafkaBatches(s.t, d.bytes())
+	if len(records) != len(expected) {
+		s.t.Errorf("expected %d records, found %d", len(expected), len(records))
+		return s
+	}
+	for i, rec := range records {
+		if rec != expected[i] {
+			s.t.Errorf("expected record %+v, found %+v", expected[i], rec)
+		}
+	}
+	return s
+}
+
+func (s *KafkaStage) offsets_are_listed(topic string, partition int32, earliest, latest int64) *KafkaStage {
+	for timestamp, expected := range map[int64]int64{-2: earliest, -1: latest} {
+		body := binary.BigEndian.AppendUint32(nil, 0xffffffff)
+		body = binary.BigEndian.AppendUint32(body, 1)
+		body = appendKafkaString(body, topic)
+		body = binary.BigEndian.AppendUint32(body, 1)
+		body = binary.BigEndian.AppendUint32(body, uint32(partition))
+		body = binary.BigEndian.AppendUint64(body, uint64(timestamp))
+
+		d := s.request(2, 1, body)
+		d.int32()
+		d.string()
+		d.int32()
+		d.int32()
+		code := d.int16()
+		d.int64()
+		if offset := d.int64(); code != 0 || offset != expected {
+			s.t.Errorf("expected offset %d for timestamp %d, found %d and error %d", expected, timestamp, offset, code)
+		}
+	}
+	return s
+}
+
+func (s *KafkaStage) offset_is_committed(group, topic string, partition int32, offset int64) *KafkaStage {
+	body := appendKafkaString(nil, group)
+	body = binary.BigEndian.AppendUint32(body, 0xffffffff)
+	body = appendKafkaString(body, "")
+	body = binary.BigEndian.AppendUint64(body, 0xffffffffffffffff)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = appendKafkaString(body, topic)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = binary.BigEndian.AppendUint32(body, uint32(partition))
+	body = binary.BigEndian.AppendUint64(body, uint64(offset))
+	body = binary.BigEndian.AppendUint16(body, 0xffff)
+
+	d := s.request(8, 2, body)
+	d.int32()
+	d.string()
+	d.int32()
+	d.int32()
+	if code := d.int16(); code != 0 {
+		s.t.Errorf("expected offset commit to succeed, found error %d", code)
+	}
+	return s
+}
+
+func (s *KafkaStage) committed_offset_is(group, topic string, partition int32, expected int64) *KafkaStage {
+	body := appendKafkaString(nil, group)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = appendKafkaString(body, topic)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = binary.BigEndian.AppendUint32(body, uint32(partition))
+
+	d := s.request(9, 1, body)
+	d.int32()
+	d.string()
+	d.int32()
+	d.int32()
+	offset := d.int64()
+	d.string()
+	if code := d.int16(); code != 0 || offset != expected {
+		s.t.Errorf("expected committed offset %d, found %d and error %d", expected, offset, code)
+	}
+	return s
+}
+
+func appendKafkaString(raw []byte, s string) []byte {
+	raw = binary.BigEndian.AppendUint16(raw, uint16(len(s)))
+	return append(raw, s...)
+}
+
+// encodeKafkaBatch encodes a record batch of magic 2 holding a single record.
+func encodeKafkaBatch(key, value string) []byte {
+	record := []byte{0}
+	record = binary.AppendVarint(record, 0)
+	record = binary.AppendVarint(record, 0)
+	record = binary.AppendVarint(record, int64(len(key)))
+	record = append(record, key...)
+	record = binary.AppendVarint(record, int64(len(value)))
+	record = append(record, value...)
+	record = binary.AppendVarint(record, 0)
+
+	now := time.Now().UnixMilli()
+	batch := binary.BigEndian.AppendUint64(nil, 0)
+	batch = binary.BigEndian.AppendUint32(batch, 0)
+	batch = binary.BigEndian.AppendUint32(batch, 0)
+	batch = append(batch, 2)
+	batch = binary.BigEndian.AppendUint32(batch, 0)
+	batch = binary.BigEndian.AppendUint16(batch, 0)
+	batch = binary.BigEndian.AppendUint32(batch, 0)
+	batch = binary.BigEndian.AppendUint64(batch, uint64(now))
+	batch = binary.BigEndian.AppendUint64(batch, uint64(now))
+	batch = binary.BigEndian.AppendUint64(batch, 0xffffffffffffffff)
+	batch = binary.BigEndian.AppendUint16(batch, 0xffff)
+	batch = binary.BigEndian.AppendUint32(batch, 0xffffffff)
+	batch = binary.BigEndian.AppendUint32(batch, 1)
+	batch = binary.AppendVarint(batch, int64(len(record)))
+	batch = append(batch, record...)
+
+	binary.BigEndian.PutUint32(batch[8:], uint32(len(batch)-12))
+	crc := crc32.Checksum(batch[21:], crc32.MakeTable(crc32.Castagnoli))
+	binary.BigEndian.PutUint32(batch[17:], crc)
+	return batch
+}
+
+func decodeKafkaBatches(t *testing.T, raw []byte) []kafkaRecord {
+	var records []kafkaRecord
+	for len(raw) > 0 {
+		length := int(binary.BigEndian.Uint32(raw[8:]))
+		batch := raw[:12+length]
+		raw = raw[12+length:]
+		if crc32.Checksum(batch[21:], crc32.MakeTable(crc32.Castagnoli)) != binary.BigEndian.Uint32(batch[17:]) {
+			t.Error("batch checksum mismatch")
+			return nil
+		}
+		baseOffset := int64(binary.BigEndian.Uint64(batch))
+		d := &kafkaDecoder{data: batch[57:]}
+		for i, n := 0, int(d.int32()); i < n; i++ {
+			d.varint()
+			d.next(1)
+			d.varint()
+			offsetDelta := d.varint()
+			key := d.next(int(d.varint()))
+			value := d.next(int(d.varint()))
+			for h, headers := 0, int(d.varint()); h < headers; h++ {
+				d.next(int(d.varint()))
+				d.next(int(d.varint()))
+			}
+			records = append(records, kafkaRecord{offset: baseOffset + offsetDelta, key: string(key), value: string(value)})
+		}
+	}
+	return records
+}
+
+type kafkaDecoder struct {
+	data []byte
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if n < 0 {
+		return nil
+	}
+	if n > len(d.data) {
+		n = len(d.data)
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if len(d.data) < 2 {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(d.next(2)))
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if len(d.data) < 4 {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(d.next(4)))
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if len(d.data) < 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(d.next(8)))
+}
+
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *kafkaDecoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+func (d *kafkaDecoder) varint() int64 {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
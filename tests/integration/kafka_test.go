@@ -0,0 +1,21 @@
+package integration_test
+
+import "testing"
+
+func TestKafkaClientProducesAndFetches(t *testing.T) {
+	given, when, then := NewKafkaStage(t)
+
+	topic := "events"
+	given.api_versions_are_negotiated()
+
+	when.a_record_is_produced(topic, 0, "k1", "first", 0).and().
+		a_record_is_produced(topic, 0, "k2", "second", 1).and().
+		offset_is_committed("analytics", topic, 0, 1)
+
+	then.records_are_fetched(topic, 0, 0, []kafkaRecord{
+		{offset: 0, key: "k1", value: "first"},
+		{offset: 1, key: "k2", value: "second"},
+	}).and().
+		offsets_are_listed(topic, 0, 0, 2).and().
+		committed_offset_is("analytics", topic, 0, 1)
+}
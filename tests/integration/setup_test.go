@@ -4,23 +4,46 @@ import (
 	"net"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/rafaelmgr12/kafka-clone/internal/domain/entity"
 	"github.com/rafaelmgr12/kafka-clone/internal/infra"
+	"github.com/rafaelmgr12/kafka-clone/internal/storage"
 )
 
 var serverShutDown chan struct{}
-var serverStartUp chan struct{}
+
+// serverStartUp starts the server with the storage sent, or with registry
+// when it is nil.
+var serverStartUp chan entity.Storage
+
+// registry stores the topics of the server, closed by cleanUpFiles before
+// removing them.
+var registry *storage.Registry
 
 func TestMain(m *testing.M) {
 	serverShutDown = make(chan struct{}, 1)
-	serverStartUp = make(chan struct{})
+	serverStartUp = make(chan entity.Storage)
+	registry = storage.NewRegistry("data", func(topic string) storage.Config {
+		if topic == "expiring" {
+			// every message gets its own segment, removed once another
+			// one follows
+			return storage.Config{SegmentBytes: 1, RetentionBytes: 1}
+		}
+		return storage.Config{}
+	}, func(topic string) int {
+		if topic == "orders" {
+			return 3
+		}
+		return 1
+	})
 
 	go func() {
 		for {
 			println("wait server start up channel")
 			select {
 			// support to start server multiple times
-			case <-serverStartUp:
+			case store := <-serverStartUp:
 				println("starting server")
 				tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:9001")
 				if err != nil {
@@ -32,20 +55,58 @@ func TestMain(m *testing.M) {
 				if err != nil {
 					panic(err)
 				}
+				kafkaAddr, err := net.ResolveTCPAddr("tcp", "localhost:9003")
+				if err != nil {
+					panic(err)
+				}
+				kafkaListen, err := net.ListenTCP("tcp", kafkaAddr)
+				if err != nil {
+					panic(err)
+				}
+				httpAddr, err := net.ResolveTCPAddr("tcp", "localhost:9004")
+				if err != nil {
+					panic(err)
+				}
+				httpListen, err := net.ListenTCP("tcp", httpAddr)
+				if err != nil {
+					panic(err)
+				}
+				if store == nil {
+					if err = registry.OpenAll(); err != nil {
+						panic(err)
+					}
+					store = registry
+				}
 				conf := infra.Config{
-					Path:    "data",
-					Workers: 5,
+					Storage:   store,
+					Workers:   5,
+					Kafka:     kafkaListen,
+					KafkaHost: "localhost",
+					HTTP:      httpListen,
 				}
 				infra.Start(conf, listen, serverShutDown)
 				if err = listen.Close(); err != nil {
 					panic(err)
 				}
+				if err = kafkaListen.Close(); err != nil {
+					panic(err)
+				}
+				// the http gateway closed its listener on shutdown
 				println("server stopped")
 			}
 		}
 	}()
 
-	serverStartUp <- struct{}{}
+	serverStartUp <- nil
+	// the http gateway listens last
+	for {
+		conn, err := net.Dial("tcp", "localhost:9004")
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 
 	defer func() {
 		serverShutDown <- struct{}{}
@@ -55,6 +116,7 @@ func TestMain(m *testing.M) {
 }
 
 func cleanUpFiles(root string) error {
+	registry.Close()
 	os.RemoveAll(root)
 	return os.MkdirAll(root, 0775)
 }